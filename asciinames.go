@@ -0,0 +1,203 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"fmt"
+	"hash/crc32"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// The romanization of each hiragana. Katakana are looked up by converting them to
+// hiragana first. Combinations like "kya" and "fa" are handled by romanizeKana().
+var hiraganaRomaji = map[rune]string{
+	'あ': "a", 'い': "i", 'う': "u", 'え': "e", 'お': "o",
+	'か': "ka", 'き': "ki", 'く': "ku", 'け': "ke", 'こ': "ko",
+	'さ': "sa", 'し': "shi", 'す': "su", 'せ': "se", 'そ': "so",
+	'た': "ta", 'ち': "chi", 'つ': "tsu", 'て': "te", 'と': "to",
+	'な': "na", 'に': "ni", 'ぬ': "nu", 'ね': "ne", 'の': "no",
+	'は': "ha", 'ひ': "hi", 'ふ': "fu", 'へ': "he", 'ほ': "ho",
+	'ま': "ma", 'み': "mi", 'む': "mu", 'め': "me", 'も': "mo",
+	'や': "ya", 'ゆ': "yu", 'よ': "yo",
+	'ら': "ra", 'り': "ri", 'る': "ru", 'れ': "re", 'ろ': "ro",
+	'わ': "wa", 'ゐ': "i", 'ゑ': "e", 'を': "o", 'ん': "n",
+	'が': "ga", 'ぎ': "gi", 'ぐ': "gu", 'げ': "ge", 'ご': "go",
+	'ざ': "za", 'じ': "ji", 'ず': "zu", 'ぜ': "ze", 'ぞ': "zo",
+	'だ': "da", 'ぢ': "ji", 'づ': "zu", 'で': "de", 'ど': "do",
+	'ば': "ba", 'び': "bi", 'ぶ': "bu", 'べ': "be", 'ぼ': "bo",
+	'ぱ': "pa", 'ぴ': "pi", 'ぷ': "pu", 'ぺ': "pe", 'ぽ': "po",
+	'ゔ': "vu",
+	'ぁ': "a", 'ぃ': "i", 'ぅ': "u", 'ぇ': "e", 'ぉ': "o",
+	'ゃ': "ya", 'ゅ': "yu", 'ょ': "yo", 'ゎ': "wa",
+}
+
+const (
+	smallTsu = 'っ'
+	longMark = 'ー'
+)
+
+// Turn a name into one with only printable ASCII characters, for --ascii-names.
+// Full-width characters and letters with diacritics become their plain ASCII
+// counterparts and kana are romanized. Anything else, like kanji, can't be, so
+// it's replaced with a space and a hash of the name is appended, so that names
+// that only differ in what was dropped don't end up the same. If nothing is
+// left, the hash is used on its own.
+// The extension is kept as is, so that e.g. "表紙.jpg" doesn't become ".jpg".
+func asciiName(name string) string {
+	ext := filepath.Ext(name)
+	if !isASCII(ext) {
+		ext = ""
+	}
+	stem := strings.TrimSuffix(name, ext)
+	if isASCII(stem) {
+		return name
+	}
+
+	var res strings.Builder
+	dropped := false
+	runes := []rune(norm.NFKC.String(stem))
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		if r < utf8.RuneSelf {
+			if unicode.IsPrint(r) {
+				res.WriteRune(r)
+			} else {
+				dropped = true
+			}
+			continue
+		}
+
+		if romaji, n := romanizeKana(runes[i:]); n > 0 {
+			res.WriteString(romaji)
+			i += n - 1
+		} else if r == longMark {
+			// Lengthen the previous vowel.
+			if s := res.String(); s != "" && strings.ContainsRune("aeiou", rune(s[len(s)-1])) {
+				res.WriteByte(s[len(s)-1])
+			} else {
+				dropped = true
+			}
+		} else if stripped := stripDiacritics(r); stripped != "" {
+			res.WriteString(stripped)
+		} else {
+			res.WriteByte(' ')
+			dropped = true
+		}
+	}
+
+	s := strings.Join(strings.Fields(res.String()), " ")
+	hash := fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(stem)))
+	if strings.Trim(s, " .-_") == "" {
+		return hash + ext
+	} else if dropped {
+		return s + " " + hash + ext
+	}
+
+	return s + ext
+}
+
+// Run asciiName() on every part of a path.
+func asciiPath(path string) string {
+	parts := strings.Split(filepath.ToSlash(path), "/")
+	for i, part := range parts {
+		parts[i] = asciiName(part)
+	}
+
+	return filepath.FromSlash(strings.Join(parts, "/"))
+}
+
+// Romanize the kana at the start of the runes. Returns the romaji and the number
+// of runes it covers, or 0 if they don't start with kana.
+func romanizeKana(runes []rune) (string, int) {
+	kana := func(i int) (string, bool) {
+		if i >= len(runes) {
+			return "", false
+		}
+		r := runes[i]
+		// Katakana are at a fixed offset from their hiragana.
+		if r >= 'ァ' && r <= 'ヶ' {
+			r -= 'ァ' - 'ぁ'
+		}
+		if r == smallTsu {
+			return "", true
+		}
+		romaji, ok := hiraganaRomaji[r]
+		return romaji, ok
+	}
+	isSmall := func(i int) bool {
+		if i >= len(runes) {
+			return false
+		}
+		return strings.ContainsRune("ぁぃぅぇぉゃゅょァィゥェォャュョ", runes[i])
+	}
+
+	romaji, ok := kana(0)
+	if !ok {
+		return "", 0
+	} else if romaji == "" {
+		// A small tsu doubles the consonant that follows, e.g. "kitte".
+		next, n := romanizeKana(runes[1:])
+		if n == 0 || next == "" || strings.ContainsRune("aeiou", rune(next[0])) {
+			return next, n + 1
+		} else if strings.HasPrefix(next, "ch") {
+			return "t" + next, n + 1
+		}
+		return next[:1] + next, n + 1
+	}
+
+	if !isSmall(1) || len(romaji) < 2 && romaji != "u" {
+		return romaji, 1
+	}
+	small, _ := kana(1)
+	base := romaji[:len(romaji)-1]
+	switch {
+	case romaji == "u":
+		// E.g. "wi" and "we".
+		return "w" + small[len(small)-1:], 2
+	case strings.HasPrefix(small, "y") && strings.HasSuffix(romaji, "i"):
+		// E.g. "kya", and "sha" rather than "shya".
+		if base == "sh" || base == "ch" || base == "j" {
+			return base + small[1:], 2
+		}
+		return base + small, 2
+	case len(small) == 1:
+		// E.g. "fa" and "ti".
+		return base + small, 2
+	}
+
+	return romaji, 1
+}
+
+// Get the ASCII letters of the rune with its diacritics removed, e.g. "e" for "é",
+// or an empty string if it isn't a letter with diacritics.
+func stripDiacritics(r rune) string {
+	var res strings.Builder
+	for _, d := range norm.NFKD.String(string(r)) {
+		if d < utf8.RuneSelf && unicode.IsPrint(d) {
+			res.WriteRune(d)
+		} else if !unicode.Is(unicode.Mn, d) {
+			return ""
+		}
+	}
+
+	return res.String()
+}
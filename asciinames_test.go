@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"testing"
+)
+
+func TestAsciiName(t *testing.T) {
+	hash := func(s string) string {
+		return fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(s)))
+	}
+
+	tests := []struct {
+		name, expected string
+	}{
+		{"0001.jpg", "0001.jpg"},
+		{"Ｖｏｌ．１", "Vol.1"},
+		{"Café", "Cafe"},
+		{"ひらがな カタカナ", "hiragana katakana"},
+		{"きって", "kitte"},
+		{"ラーメン", "raamen"},
+		// Names that only differ in what was dropped must stay different.
+		{"進撃の巨人 1", "no 1 " + hash("進撃の巨人 1")},
+		{"暗殺の教室 1", "no 1 " + hash("暗殺の教室 1")},
+		{"表紙.jpg", hash("表紙") + ".jpg"},
+		{"巻\x01 1.jpg", "1 " + hash("巻\x01 1") + ".jpg"},
+	}
+
+	for _, test := range tests {
+		if res := asciiName(test.name); res != test.expected {
+			t.Errorf("asciiName(%q) = %q, expected %q.", test.name, res, test.expected)
+		}
+	}
+}
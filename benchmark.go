@@ -0,0 +1,109 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"encoding/json"
+	"os"
+	"runtime"
+	"time"
+)
+
+// How often we check the memory usage while benchmarking.
+const memSampleInterval = time.Millisecond * 250
+
+// The numbers printed by --benchmark for a single download.
+type BenchmarkResult struct {
+	URL            string  `json:"url"`
+	Pages          int     `json:"pages"`
+	Bytes          int64   `json:"bytes"`
+	Seconds        float64 `json:"seconds"`
+	PagesPerSecond float64 `json:"pages_per_second"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+	PeakHeapBytes  uint64  `json:"peak_heap_bytes"`
+	Workers        int     `json:"workers"`
+}
+
+func NewBenchmarkResult(url string, res *DownloadResult, peakHeap uint64) *BenchmarkResult {
+	br := &BenchmarkResult{
+		URL:           url,
+		Pages:         len(res.Paths),
+		Bytes:         res.Bytes,
+		Seconds:       res.Duration.Seconds(),
+		PeakHeapBytes: peakHeap,
+		Workers:       workers,
+	}
+	if br.Seconds > 0 {
+		br.PagesPerSecond = float64(br.Pages) / br.Seconds
+		br.BytesPerSecond = float64(br.Bytes) / br.Seconds
+	}
+
+	return br
+}
+
+// Print the results as JSON to stdout if --json is set, otherwise log them.
+func (br *BenchmarkResult) Print() {
+	if jsonOutput {
+		if err := json.NewEncoder(os.Stdout).Encode(br); err != nil {
+			log.Error(err)
+		}
+		return
+	}
+
+	log.Info("Benchmark results:")
+	log.Infof("  Workers:     %d", br.Workers)
+	log.Infof("  Pages:       %d (%.2f/s)", br.Pages, br.PagesPerSecond)
+	log.Infof("  Downloaded:  %s (%s/s)", formatBytes(br.Bytes), formatBytes(int64(br.BytesPerSecond)))
+	log.Infof("  Total time:  %.2fs", br.Seconds)
+	log.Infof("  Peak memory: %s", formatBytes(int64(br.PeakHeapBytes)))
+}
+
+// Keep track of the peak heap usage until the returned function is called,
+// which returns the peak.
+func sampleMemory() (stop func() uint64) {
+	var peak uint64
+	sample := func() {
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		if ms.HeapAlloc > peak {
+			peak = ms.HeapAlloc
+		}
+	}
+
+	ticker := time.NewTicker(memSampleInterval)
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		for {
+			select {
+			case <-ticker.C:
+				sample()
+			case <-done:
+				sample()
+				return
+			}
+		}
+	}()
+
+	return func() uint64 {
+		ticker.Stop()
+		close(done)
+		<-finished
+		return peak
+	}
+}
@@ -17,12 +17,17 @@ package main
 // along with this program.  If not, see <http://www.gnu.org/licenses/>.
 
 import (
+	"encoding/json"
 	"errors"
 	"path/filepath"
 	//"flag"
 	"fmt"
 	"os"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	flag "github.com/spf13/pflag"
@@ -36,11 +41,16 @@ import (
 var log = logger.GetLog("")
 
 // Set by make on compilation.
-var version = "UNSET"
+var (
+	version = "UNSET"
+	commit  = ""
+)
 
 // Errors.
 var (
 	ErrInvalidOptionFormat = errors.New("Invalid option format. Should be key=value.")
+	ErrEmptyOptionKey      = errors.New("Invalid option format. The key cannot be empty.")
+	ErrInvalidZipTime      = errors.New("Invalid --zip-time. Should be \"now\", seconds since the Unix epoch, or an RFC 3339 timestamp.")
 )
 
 // Flag for options passed through the CLI that satisfies
@@ -56,6 +66,7 @@ func (opt *OptionsFlag) String() string {
 	for k, v := range map[string]string(*opt) {
 		res = append(res, fmt.Sprintf("%q: %q", k, v))
 	}
+	sort.Strings(res)
 
 	content := strings.Join(res, ", ")
 	if content != "" {
@@ -65,16 +76,29 @@ func (opt *OptionsFlag) String() string {
 	return ""
 }
 
+// Split on the first "=", so values can contain more of them. Keys are case
+// insensitive like plugin options are, and if one is given more than once,
+// the last value wins, so -o can override the directory defaults and itself.
 func (opt *OptionsFlag) Set(v string) error {
 	split := strings.SplitN(v, "=", 2)
 	if len(split) < 2 {
 		return ErrInvalidOptionFormat
 	}
+	key := strings.TrimSpace(split[0])
+	if key == "" {
+		return ErrEmptyOptionKey
+	}
 
 	if *opt == nil {
 		*opt = OptionsFlag(make(map[string]string))
 	}
-	(*opt)[split[0]] = split[1]
+	// Otherwise which of them ends up being used would be random.
+	for k := range *opt {
+		if strings.EqualFold(k, key) {
+			delete(*opt, k)
+		}
+	}
+	(*opt)[key] = split[1]
 	return nil
 }
 
@@ -83,10 +107,21 @@ func (opt *OptionsFlag) Type() string {
 }
 
 var (
-	options                                                    OptionsFlag
-	workers                                                    int
+	options, hostConcurrency, pluginZip                        OptionsFlag
+	workers, splitSize, maxIdleConns, descrambleWorkers        int
+	pageRetries, maxFailedPages, requestJitter, slowStart      int
+	progressWidth, progressPadding, timeout                    int
 	verbose, defaults, noprompt, zipit, printVersion, override bool
-	dldir                                                      string
+	verifyPages, failFast, dedupPages, printOptions, saveCover bool
+	benchmark, jsonOutput, listVolumes, contactSheet           bool
+	noProgress, onlyMetadata, flattenSingle, highlightProblems bool
+	noDescramble, streamZip, preview, deepDetect, reportKeys   bool
+	toStdout, volumeLog, preflight, asciiNames, logHeaders     bool
+	logSortFields, zipVolumes                                  bool
+	dldir, cookies, archiveName, accounts, seriesDir           string
+	seriesNumbering, zipTime, credentials, unicodeNormalize    string
+	exportRects, dumpResponses, dirMode, fileMode              string
+	requestRate                                                float64
 	urls                                                       []string
 )
 
@@ -94,7 +129,17 @@ func init() {
 	flag.VarP(&options, "option", "o",
 		"Options in a key=value format passed to plugins.")
 	flag.IntVarP(&workers, "workers", "w", 10,
-		"The number of workers to use.")
+		"The number of workers to use. Defaults to $MINDL_WORKERS if set.")
+	flag.IntVar(&descrambleWorkers, "descramble-workers", 0,
+		"The number of goroutines that descramble and encode pages, so that workers can move on to the next page once one is downloaded. 0 means the workers do it themselves.")
+	flag.IntVar(&pageRetries, "page-retries", 0,
+		"The number of times to retry a page that failed with what looks like a temporary error, such as a network error.")
+	flag.IntVar(&maxFailedPages, "max-failed-pages", 0,
+		"The number of pages that can fail even after retrying before the whole download fails. The pages that failed are skipped.")
+	flag.IntVar(&timeout, "timeout", 20,
+		"The timeout in seconds for HTTP requests, including downloading the response. 0 means no timeout. Plugins with a Timeout option can override it.")
+	flag.IntVar(&maxIdleConns, "max-idle-conns", 0,
+		"The maximum number of idle HTTP connections to keep per host. 0 means the same as --workers.")
 	flag.BoolVarP(&verbose, "verbose", "v", false,
 		"Set to display debug messages.")
 	flag.BoolVarP(&defaults, "defaults", "d", false,
@@ -103,10 +148,112 @@ func init() {
 		"Set to turn off prompts for options and instead throw an error if a required option is left unset.")
 	flag.BoolVarP(&zipit, "zip", "z", false,
 		"Set to ZIP the files after the download finishes.")
+	flag.BoolVar(&streamZip, "stream-zip", false,
+		"Set to write files straight into the ZIP files instead of zipping them after the download. Files are kept in memory until they're complete.")
+	flag.BoolVar(&noProgress, "no-progress", false,
+		"Set to never reserve a line at the bottom of the terminal for the progress, and only log it every now and then instead.")
+	flag.BoolVar(&highlightProblems, "highlight-problems", false,
+		"Set to briefly color the progress line red when an error is logged, or yellow for a warning.")
+	flag.IntVar(&progressWidth, "progress-width", 0,
+		"The width of the progress bar. 0 means it's based on the width of the terminal.")
+	flag.IntVar(&progressPadding, "progress-padding", 0,
+		"The padding to the left of the progress bar. 0 means the default.")
+	flag.Var(&pluginZip, "plugin-zip",
+		"Whether or not to zip the downloads of a plugin in a plugin=true|false format, overriding --zip for that plugin. "+
+			"Can be used multiple times.")
+	flag.Var(&hostConcurrency, "host-concurrency",
+		"The maximum number of concurrent requests to a host and its subdomains in a host=N format. Can be used multiple times.")
+	flag.Float64Var(&requestRate, "request-rate", 0,
+		"The maximum number of HTTP requests per second across all workers. 0 means no limit.")
+	flag.IntVar(&slowStart, "slow-start", 0,
+		"The number of seconds over which to ramp up from a single worker to --workers at the start of each download, "+
+			"to avoid tripping rate limiters with a burst of requests. 0 starts them all at once.")
+	flag.IntVar(&requestJitter, "request-jitter", 0,
+		"The maximum random delay in milliseconds before each HTTP request, so that requests don't come in at a regular pace. 0 means no delay.")
+	flag.StringVar(&archiveName, "archive-name", defaultArchiveTemplate,
+		"The name of the ZIP files. {dir}, {title}, {series} and {volume} are replaced with the values for each archive.")
+	flag.StringVar(&zipTime, "zip-time", "",
+		"The modification time to give every file in the ZIP files, for reproducible archives. "+
+			"Either \"now\", seconds since the Unix epoch, or an RFC 3339 timestamp. Empty means no time is set.")
+	flag.IntVar(&splitSize, "split-size", 0,
+		"Split the ZIP files into parts of at most this many MiB each. 0 means no splitting.")
+	flag.BoolVar(&failFast, "fail-fast", false,
+		"Set to stop at the first URL that fails instead of continuing with the rest.")
+	flag.BoolVar(&dedupPages, "dedup-pages", false,
+		"Set to remove files identical to the previous one, such as placeholders for missing pages.")
+	flag.BoolVar(&benchmark, "benchmark", false,
+		"Set to print pages/s, bytes/s, the total time and peak memory usage after each download.")
+	flag.BoolVar(&jsonOutput, "json", false,
+		"Set to print results as JSON to stdout instead of logging them. Currently only affects --benchmark and --list-volumes.")
+	flag.BoolVar(&printOptions, "print-options", false,
+		"Set to print the values of the options of each plugin before downloading.")
 	flag.StringVarP(&dldir, "directory", "D", "downloads/",
-		"The directory in which to save the downloaded files.")
+		"The directory in which to save the downloaded files. Defaults to $MINDL_DIRECTORY if set.")
+	flag.StringVar(&accounts, "accounts", "",
+		"A file with one username:password per line. Plugins that support it will rotate between them "+
+			"for each URL and switch to the next one if an account gets rejected.")
+	flag.StringVar(&credentials, "credentials-file", "",
+		"A file with one plugin:username:password per line. Plugins that require logging in will use them "+
+			"unless the username and password are passed with --option.")
+	flag.StringVar(&cookies, "cookies", "",
+		"A Netscape cookies.txt file or a \"name=value; name2=value2\" string with cookies to use. "+
+			"Plugins that support it will use the session in them instead of logging in.")
 	flag.BoolVar(&printVersion, "version", false,
-		"Print the program version.")
+		"Print the program version and build information.")
+	flag.StringVar(&seriesDir, "series", "",
+		"Put the files of all the URLs in a single directory with this name instead of one per volume.")
+	flag.StringVar(&seriesNumbering, "series-numbering", "continue",
+		"How to number pages with --series. \"continue\" continues numbering across volumes, "+
+			"\"prefix\" prefixes them with the volume number (e.g. v02-0001).")
+	flag.BoolVar(&zipVolumes, "zip-volumes", false,
+		"With --series, zip each volume into an archive of its own as soon as it's downloaded, "+
+			"instead of zipping the whole series once every URL is done.")
+	flag.StringVar(&unicodeNormalize, "unicode-normalize", "NFC",
+		"The Unicode normalization of titles used for names and metadata. NFC, NFD, NFKC or none.")
+	flag.StringVar(&dirMode, "dir-mode", "755",
+		"The permissions of the directories created, in octal. Still subject to the umask.")
+	flag.StringVar(&fileMode, "file-mode", "666",
+		"The permissions of the files created, in octal. Still subject to the umask.")
+	flag.BoolVar(&asciiNames, "ascii-names", false,
+		"Set to transliterate directory and file names to ASCII, romanizing kana and dropping what can't be, "+
+			"like kanji, in which case a hash of the original name is appended to keep names apart. "+
+			"The original title is kept in the metadata.")
+	flag.BoolVar(&flattenSingle, "flatten-single", false,
+		"Set to move the files into the download directory itself when a download results in a single directory.")
+	flag.BoolVar(&deepDetect, "deep-detect", false,
+		"Set to fetch URLs no plugin recognizes and look for known readers in the page.")
+	flag.BoolVar(&preview, "preview", false,
+		"Set to download the free preview pages of content you don't own instead, without logging in. Only BookLive supports it for now, and previews are capped at 50 pages.")
+	flag.BoolVar(&noDescramble, "no-descramble", false,
+		"Set to save images as they were downloaded without descrambling them, with a .scrambled suffix. Useful for reporting descrambling bugs.")
+	flag.BoolVar(&toStdout, "stdout", false,
+		"Set to write the file to stdout instead of to disk, for piping. Only works with a single URL that results in a single file.")
+	flag.BoolVar(&preflight, "preflight", false,
+		"Set to check if the site is up with a single request before each download, if the plugin supports it.")
+	flag.BoolVar(&volumeLog, "volume-log", false,
+		"Set to also write everything logged while downloading a volume to mindl.log in its directory, for attaching to bug reports.")
+	flag.BoolVar(&logSortFields, "log-sort-fields", true,
+		"Whether or not to sort the fields of log entries by name. Turning it off can help when logging a lot with --verbose.")
+	flag.BoolVar(&logHeaders, "log-headers", false,
+		"Set to log the status, content type, length and server of every HTTP response, which is otherwise only done with --verbose.")
+	flag.StringVar(&dumpResponses, "dump-responses", "",
+		"A directory to write the body of every API response and page to, with passwords, tokens and keys redacted. "+
+			"Useful for reporting breakage when a site changes.")
+	flag.StringVar(&exportRects, "export-rects", "",
+		"A directory to write the rectangles used to descramble pages to as JSON, one file per distinct set. "+
+			"For descrambling them with other programs.")
+	flag.BoolVar(&reportKeys, "report-keys", false,
+		"Set to log the type of descrambling keys and how a sample page of each volume was descrambled. Useful for reporting descrambling bugs.")
+	flag.BoolVar(&saveCover, "save-cover", false,
+		"Set to also save the cover of each volume as cover.jpg, if the plugin can tell which page it is.")
+	flag.BoolVar(&contactSheet, "contact-sheet", false,
+		"Set to also save an image with thumbnails of every page next to each downloaded directory.")
+	flag.BoolVar(&listVolumes, "list-volumes", false,
+		"Set to list the volumes in the series of each URL instead of downloading them.")
+	flag.BoolVar(&verifyPages, "verify-pages", false,
+		"Set to fail the download if fewer files than expected were downloaded.")
+	flag.BoolVar(&onlyMetadata, "only-metadata", false,
+		"Set to only write the metadata (e.g. ComicInfo.xml) of each URL without downloading any pages. Only works with plugins that provide metadata.")
 	flag.BoolVar(&override, "override", false,
 		"Override special options, such as forcing the number of workers.")
 
@@ -116,12 +263,68 @@ func init() {
 func main() {
 	flag.Parse()
 	if printVersion {
-		fmt.Println(version)
+		printVersionInfo()
 		os.Exit(0)
 	}
 
 	urls = flag.Args()
 	logger.Verbose(verbose)
+	logger.SortFields(logSortFields)
+	if err := applyEnvDefaults(); err != nil {
+		log.Fatal(err)
+	}
+	if toStdout {
+		if err := checkStdoutFlags(); err != nil {
+			log.Fatal(err)
+		}
+		// Keep everything but the file itself out of the pipe.
+		stdout, os.Stdout = os.Stdout, os.Stderr
+	}
+	if maxIdleConns > 0 {
+		plugins.MaxIdleConnsPerHost = maxIdleConns
+	} else {
+		plugins.MaxIdleConnsPerHost = workers
+	}
+	plugins.SetRequestRate(requestRate)
+	plugins.SetRequestJitter(time.Duration(requestJitter) * time.Millisecond)
+	plugins.SetDescrambleWorkers(descrambleWorkers)
+	if err := plugins.SetUnicodeNormalization(unicodeNormalize); err != nil {
+		log.Fatal(err)
+	}
+	plugins.SaveCovers = saveCover
+	plugins.NoDescramble = noDescramble
+	plugins.ReportKeys = reportKeys
+	plugins.ExportRectsDir = exportRects
+	plugins.DumpResponsesDir = dumpResponses
+	plugins.LogHeaders = logHeaders
+	plugins.Preview = preview
+	plugins.HTTPTimeout = timeout
+	if err := setHostConcurrency(hostConcurrency); err != nil {
+		log.Fatal(err)
+	}
+	if err := setPermissions(dirMode, fileMode); err != nil {
+		log.Fatal(err)
+	}
+	if err := parsePluginZip(pluginZip); err != nil {
+		log.Fatal(err)
+	}
+	if accounts != "" {
+		if err := plugins.SetAccountsFile(accounts); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if credentials != "" {
+		cf, err := plugins.LoadCredentialsFile(credentials)
+		if err != nil {
+			log.Fatal(err)
+		}
+		plugins.SetCredentialSource(cf)
+	}
+	if cookies != "" {
+		if err := plugins.SetUserCookies(cookies); err != nil {
+			log.Fatal(err)
+		}
+	}
 	// Ensure the path uses os.PathSeparator and ends with one.
 	dldir = strings.TrimSuffix(filepath.FromSlash(dldir), string(os.PathSeparator)) + string(os.PathSeparator)
 
@@ -130,71 +333,635 @@ func main() {
 		os.Exit(0)
 	}
 
-	pm := PluginManager(Plugins[:])
+	// Options from the download directory's defaults file are used unless overridden with -o.
+	if dirDefaults, err := loadDirDefaults(dldir); err != nil {
+		log.Fatal(err)
+	} else if len(dirDefaults) != 0 {
+		log.Debugf("Loaded %d option(s) from %s.", len(dirDefaults), filepath.Join(dldir, dirDefaultsFile))
+		options = mergeOptions(dirDefaults, options)
+	}
+
+	var err error
+	if zipModTime, err = parseZipTime(zipTime); err != nil {
+		log.Fatal(err)
+	}
+	if seriesDir != "" {
+		numbering, err := ParseSeriesNumbering(seriesNumbering)
+		if err != nil {
+			log.Fatal(err)
+		}
+		series = NewSeriesNamer(seriesDir, numbering)
+	} else if zipVolumes {
+		log.Warn("--zip-volumes does nothing without --series.")
+	}
+
+	pm := PluginManager(plugins.Registered())
 	handlers := pm.FindHandlers(urls)
+	// Errors for URLs that are known to fail before we start downloading.
+	invalid := make([]error, len(urls))
 	for i, h := range handlers {
+		// Make sure the URL isn't malformed in a way the handlers can tell.
+		var err error
+		if h, err = pm.ValidateHandlers(urls[i], h); err != nil {
+			log.Errorf("Invalid URL %s: %s", urls[i], err)
+			invalid[i] = err
+		}
+		// Look for known readers in the page itself if its URL is unfamiliar.
+		if len(h) == 0 && err == nil && deepDetect {
+			log.Infof("Found no handler for %s. Looking for known readers in the page...", urls[i])
+			if u, dh, err := pm.DetectHandlers(urls[i]); err != nil {
+				log.Errorf("Failed to fetch %s: %s", urls[i], err)
+			} else if len(dh) != 0 {
+				urls[i], h = u, dh
+			}
+		}
+		handlers[i] = h
 		// Ensure we have at least one handler for each URL.
-		if len(h) == 0 {
+		if len(h) == 0 && err == nil {
 			log.Errorf("Found no handler for: %s", urls[i])
 		}
 		// Set options for the plugin.
-		if err := pm.SetOptions(h, map[string]string(options), defaults, noprompt); err != nil {
+		if err := pm.SetOptions(urls[i], h, map[string]string(options), defaults, noprompt); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := checkDirectoryOption(handlers); err != nil {
+		log.Fatal(err)
+	}
+	if printOptions {
+		printPluginOptions(handlers)
+	}
+
+	// Keep track of the HTTP usage of each plugin for the summary at the end.
+	usage := make(map[string]plugins.HTTPStats)
+	usageOrder := make([]string, 0, len(handlers))
+
+	// The error for each URL, or nil if it succeeded.
+	results := make([]error, 0, len(urls))
+
+	// Keep other instances from writing to the same directory until we're done.
+	var lock *DirLock
+	if !listVolumes {
+		if lock, err = LockDirectory(dldir); err != nil {
 			log.Fatal(err)
 		}
 	}
 
 	// Start downloading.
 	for i, h := range handlers {
+		// If we're dealing with multiple URLs, tag what gets logged while
+		// processing each, including errors before it's downloaded.
+		if len(urls) > 1 {
+			logger.SetTag(fmt.Sprintf("%d/%d", i+1, len(urls)))
+		}
 		// Make the user pick a handler if multiple plugins
 		// can handle a URL.
 		// TODO: Make it possible to run mindl without user input.
-		if p, err := pm.SelectPlugin(h); err != nil {
-			log.Fatal(err)
+		if invalid[i] != nil {
+			results = append(results, invalid[i])
+		} else if p, err := pm.SelectPlugin(h); err != nil {
+			log.Error(err)
+			results = append(results, err)
 		} else {
 			// If we're dealing with multiple URLs, print which one we're processing.
 			if len(urls) > 1 {
 				log.Infof("Processing URL: %s", urls[i])
 			}
-			log.Infof("Starting download using \"%s\"...", pluginName(p))
-			startDownloading(urls[i], p)
+			name := pluginName(p)
+			before := plugins.GetHTTPStats()
+			if listVolumes {
+				results = append(results, printVolumes(urls[i], p))
+			} else {
+				log.Infof("Starting download using \"%s\"...", name)
+				results = append(results, startDownloading(urls[i], p))
+			}
+			if _, ok := usage[name]; !ok {
+				usageOrder = append(usageOrder, name)
+			}
+			usage[name] = usage[name].Add(plugins.GetHTTPStats().Sub(before))
 		}
+
+		if failFast && results[i] != nil {
+			log.Warn("Stopping at the first failure due to --fail-fast.")
+			break
+		}
+	}
+
+	logger.SetTag("")
+	seriesErr := zipSeries(results)
+	if seriesErr != nil {
+		log.Error(seriesErr)
+	}
+	lock.Unlock()
+	printUsageSummary(usage, usageOrder)
+	if failed := printResultSummary(urls, results); failed != 0 || seriesErr != nil {
+		os.Exit(1)
 	}
 }
 
-func startDownloading(url string, plugin plugins.Plugin) {
-	dm := NewDownloadManager(plugin, dldir)
-	lr, _ := minterm.NewLineReserver()
+// Print the volumes in the series of the URL, for --list-volumes.
+func printVolumes(url string, p plugins.Plugin) (err error) {
+	vl, ok := p.(plugins.VolumeLister)
+	if !ok {
+		err = fmt.Errorf("\"%s\" can't list volumes.", pluginName(p))
+		log.Error(err)
+		return
+	}
+	// Plugins panic on errors.
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+		if err != nil {
+			log.Error(err)
+		}
+	}()
+
+	vols, err := vl.ListVolumes(url)
+	if err != nil {
+		return
+	}
+	if jsonOutput {
+		return json.NewEncoder(os.Stdout).Encode(vols)
+	}
+
+	log.Infof("Found %d volume(s):", len(vols))
+	log.Infof("  %-6s %-5s %s", "Volume", "Owned", "Title")
+	for _, v := range vols {
+		number := v.Number
+		if number == "" {
+			number = "-"
+		}
+		log.Infof("  %-6s %-5s %s", number, v.Owned, v.Title)
+		if v.URL != "" {
+			log.Infof("  %-6s %-5s %s", "", "", v.URL)
+		}
+	}
+
+	return
+}
+
+// The Directory option names the directory of a single volume, so refuse it if
+// its plugin could handle more than one of the URLs, which would all end up in
+// the same directory.
+func checkDirectoryOption(handlers [][]plugins.Plugin) error {
+	count := make(map[plugins.Plugin]int)
+	for _, h := range handlers {
+		for _, p := range h {
+			if count[p]++; count[p] != 2 {
+				continue
+			}
+			if dir, _ := plugins.OptionsToMap(p.Options())["Directory"].(string); dir != "" {
+				return fmt.Errorf("The Directory option of \"%s\" can only be used when downloading a single URL with it.", pluginName(p))
+			}
+		}
+	}
+
+	return nil
+}
+
+// Parse the --host-concurrency values and pass them on to the plugins package.
+func setHostConcurrency(opts OptionsFlag) error {
+	limits := make(map[string]int)
+	for host, v := range opts {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("Invalid concurrency for %s: %s", host, v)
+		}
+		limits[host] = n
+	}
+
+	return plugins.SetHostConcurrency(limits)
+}
+
+// Whether or not to zip the downloads of each plugin, by lowercase plugin name.
+// Plugins that aren't in it follow --zip.
+var zipPlugins = make(map[string]bool)
+
+// Parse the --plugin-zip values, making sure they're for plugins that exist.
+func parsePluginZip(opts OptionsFlag) error {
+	known := make(map[string]bool)
+	for _, p := range plugins.Registered() {
+		known[strings.ToLower(p.Name())] = true
+	}
+	for name, v := range opts {
+		if !known[strings.ToLower(name)] {
+			return fmt.Errorf("Unknown plugin for --plugin-zip: %s", name)
+		}
+		zip, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("Invalid --plugin-zip value for %s: %s", name, v)
+		}
+		zipPlugins[strings.ToLower(name)] = zip
+	}
+
+	return nil
+}
+
+// Zip the series directory once every volume has been downloaded to it, as
+// long as none of them failed, so that the archive isn't missing any.
+func zipSeries(results []error) error {
+	if seriesZipper == nil {
+		return nil
+	}
+	// Some could've been skipped by --fail-fast.
+	complete := len(results) == len(urls)
+	for _, err := range results {
+		complete = complete && err == nil
+	}
+	if !complete {
+		log.Warnf("Not zipping %s since not every volume was downloaded.", series.Dir)
+		return nil
+	}
+
+	archives, err := seriesZipper.ZipSeries()
+	for _, archive := range archives {
+		log.Infof("Series archive: %s", archive)
+	}
+	return err
+}
+
+// Whether or not to zip what the plugin downloads.
+func zipFor(p plugins.Plugin) bool {
+	if zip, ok := zipPlugins[strings.ToLower(p.Name())]; ok {
+		return zip
+	}
+
+	return zipit
+}
+
+// Parse the --dir-mode and --file-mode values.
+func setPermissions(dir, file string) error {
+	d, err := strconv.ParseUint(dir, 8, 32)
+	if err != nil || d > 0777 {
+		return fmt.Errorf("Invalid directory mode: %s", dir)
+	}
+	f, err := strconv.ParseUint(file, 8, 32)
+	if err != nil || f > 0777 {
+		return fmt.Errorf("Invalid file mode: %s", file)
+	}
+	permission, filePermission = int(d), int(f)
+
+	return nil
+}
+
+// Print the values of the options of every plugin that will be used, with passwords masked.
+func printPluginOptions(handlers [][]plugins.Plugin) {
+	seen := make(map[plugins.Plugin]bool)
+	for _, h := range handlers {
+		for _, p := range h {
+			if seen[p] {
+				continue
+			}
+			seen[p] = true
+
+			log.Infof("Options for \"%s\":", pluginName(p))
+			for _, opt := range p.Options() {
+				// Special options aren't set by the user.
+				if strings.HasPrefix(opt.Key(), "!") {
+					continue
+				}
+
+				var v interface{} = opt.Value()
+				if pw, ok := opt.(*plugins.PasswordOption); ok {
+					v = pw.Masked()
+				}
+				log.Infof("  %s = %v", opt.Key(), v)
+			}
+		}
+	}
+}
+
+// Print which URLs succeeded and which failed if we processed more
+// than one URL. Returns the number of URLs that didn't succeed.
+func printResultSummary(urls []string, results []error) (failed int) {
+	for _, err := range results {
+		if err != nil {
+			failed++
+		}
+	}
+	failed += len(urls) - len(results) // Skipped due to --fail-fast.
+	if len(urls) < 2 {
+		return
+	}
+
+	log.Infof("Summary: %d succeeded, %d failed.", len(urls)-failed, failed)
+	for i, url := range urls {
+		if i >= len(results) {
+			log.Warnf("  SKIPPED %s", url)
+		} else if results[i] != nil {
+			log.Errorf("  FAILED  %s: %s", url, results[i])
+		} else {
+			log.Infof("  OK      %s", url)
+		}
+	}
+
+	return
+}
+
+// Print a table with the number of requests and bytes used by each plugin.
+func printUsageSummary(usage map[string]plugins.HTTPStats, order []string) {
+	if len(order) == 0 {
+		return
+	}
+
+	log.Info("HTTP usage summary:")
+	log.Infof("  %-20s %10s %8s %8s %12s", "Plugin", "Requests", "Failed", "Retries", "Downloaded")
+	var total plugins.HTTPStats
+	for _, name := range order {
+		stats := usage[name]
+		total = total.Add(stats)
+		log.Infof("  %-20s %10d %8d %8d %12s", name, stats.Requests, stats.Failed, stats.Retries, formatBytes(stats.Bytes))
+	}
+	if len(order) > 1 {
+		log.Infof("  %-20s %10d %8d %8d %12s", "Total", total.Requests, total.Failed, total.Retries,
+			formatBytes(total.Bytes))
+	}
+}
+
+// Format a number of bytes using binary prefixes.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// Print the version along with build information useful for bug reports.
+func printVersionInfo() {
+	fmt.Printf("mindl %s\n", version)
+	if commit != "" {
+		fmt.Printf("  Commit:  %s\n", commit)
+	}
+	fmt.Printf("  Go:      %s\n", runtime.Version())
+	fmt.Printf("  OS/Arch: %s/%s\n", runtime.GOOS, runtime.GOARCH)
+}
+
+// Where the file goes if --stdout is set. os.Stdout itself
+// is replaced by stderr so that logging doesn't end up in it.
+var stdout *os.File
+
+// Environment variables used as the defaults of flags, for when setting
+// flags isn't convenient, e.g. in containers. Flags take precedence.
+var envFlags = []struct {
+	flag, env string
+}{
+	{"directory", "MINDL_DIRECTORY"},
+	{"workers", "MINDL_WORKERS"},
+}
+
+// Set the flags that weren't set explicitly to the values of their environment variables.
+func applyEnvDefaults() error {
+	for _, ef := range envFlags {
+		v := os.Getenv(ef.env)
+		if v == "" || flag.CommandLine.Changed(ef.flag) {
+			continue
+		}
+		if err := flag.Set(ef.flag, v); err != nil {
+			return fmt.Errorf("Invalid %s: %s", ef.env, err)
+		}
+		log.Debugf("Using %s from %s: %s", ef.flag, ef.env, v)
+	}
+
+	return nil
+}
+
+// Make sure --stdout isn't combined with anything that would make more
+// than one file or that needs the files to be on disk.
+func checkStdoutFlags() error {
+	if len(urls) > 1 {
+		return errors.New("--stdout only works with a single URL.")
+	}
+	conflicts := []struct {
+		set  bool
+		name string
+	}{
+		{zipit, "zip"}, {len(pluginZip) != 0, "plugin-zip"}, {streamZip, "stream-zip"}, {splitSize > 0, "split-size"},
+		{seriesDir != "", "series"}, {contactSheet, "contact-sheet"}, {dedupPages, "dedup-pages"},
+		{flattenSingle, "flatten-single"}, {onlyMetadata, "only-metadata"}, {saveCover, "save-cover"},
+		{listVolumes, "list-volumes"}, {benchmark, "benchmark"},
+	}
+	for _, c := range conflicts {
+		if c.set {
+			return fmt.Errorf("--stdout can't be used with --%s.", c.name)
+		}
+	}
+
+	return nil
+}
+
+// Shared by all downloads if --series is set.
+var series *SeriesNamer
+
+// The last download manager that downloaded to the series directory with
+// zipping on, which zips it once every URL is done. See ZipSeries().
+var seriesZipper *DownloadManager
+
+// The parsed --zip-time. "now" is the time mindl was started, so that
+// it's the same for every archive.
+var zipModTime time.Time
+
+func parseZipTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	} else if strings.EqualFold(s, "now") {
+		return time.Now(), nil
+	} else if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0).UTC(), nil
+	} else if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+
+	return time.Time{}, ErrInvalidZipTime
+}
+
+func startDownloading(url string, plugin plugins.Plugin) error {
+	dm, err := NewDownloadManager(plugin, dldir)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	dm.Observer = &ProgressBarObserver{Width: progressWidth, Padding: progressPadding}
+	dm.verifyCount = verifyPages
+	dm.splitSize = int64(splitSize) * 1024 * 1024
+	dm.zipTime = zipModTime
+	dm.dedup = dedupPages
+	dm.archiveTemplate = archiveName
+	dm.contactSheet = contactSheet
+	dm.flattenSingle = flattenSingle
+	dm.streamZip = streamZip
+	dm.onlyMetadata = onlyMetadata
+	dm.pageRetries = pageRetries
+	dm.maxFailedPages = maxFailedPages
+	dm.volumeLog = volumeLog
+	dm.preflight = preflight
+	dm.asciiNames = asciiNames
+	dm.slowStart = time.Duration(slowStart) * time.Second
+	// Only set if non-nil, since a nil *os.File would be a non-nil io.Writer.
+	if stdout != nil {
+		dm.stdout = stdout
+	}
+	if series != nil {
+		dm.namer = series
+		dm.zipVolumes = zipVolumes
+		if zipFor(plugin) {
+			seriesZipper = dm
+		}
+		defer series.NextVolume()
+	}
 	defer func() {
 		if r := recover(); r != nil {
 			log.Fatalf("Panicked: %v", r)
 		}
 	}()
-	defer lr.Release()
+	if isTerminal(os.Stdin) {
+		dm.pauser = NewPauser()
+		log.Info("Enter \"p\" at any time to pause or resume the download.")
+		defer listenForPause(dm.pauser)()
+	}
+	// The progress would just get in the way of whatever's reading stdout.
+	if stdout == nil {
+		defer showProgress(dm)()
+	}
+
+	var stopSampling func() uint64
+	if benchmark {
+		stopSampling = sampleMemory()
+	}
+	res, err := dm.Run(url, workers, zipFor(plugin), override)
+	if benchmark {
+		NewBenchmarkResult(url, res, stopSampling()).Print()
+	}
+	if res.Retries != 0 || len(res.Errors) != 0 {
+		log.Warnf("Retried pages %d time(s). %d page(s) failed and were skipped.", res.Retries, len(res.Errors))
+		for _, err := range res.Errors {
+			log.Warnf("  Skipped: %s", err)
+		}
+	}
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	log.Infof("Done! Got a total of %d downloads (%s in %s).", len(res.Paths),
+		formatBytes(res.Bytes), res.Duration.Round(time.Second))
+	for _, archive := range res.Archives {
+		log.Infof("  Archive: %s", archive)
+	}
+	return nil
+}
+
+// How often to log the progress when we can't display it on a reserved line.
+const progressLogInterval = time.Second * 10
+
+// How long the reserved line stays colored after a warning or error with --highlight-problems.
+const problemHighlightDuration = time.Second * 3
+
+// Escape codes for coloring the reserved line.
+const (
+	ansiRed    = "\x1b[31m"
+	ansiYellow = "\x1b[33m"
+	ansiReset  = "\x1b[0m"
+)
+
+// Display the progress of the download manager until the returned function is called.
+// If we're writing to a terminal, a line is reserved at the bottom for it, otherwise
+// (e.g. when redirected to a file or with --no-progress) it's logged in regular
+// intervals instead.
+func showProgress(dm *DownloadManager) (stop func()) {
+	var lr *minterm.LineReserver
+	var ticker *time.Ticker
+	if isTerminal(os.Stdout) && !noProgress {
+		lr, _ = minterm.NewLineReserver()
+		ticker = time.NewTicker(time.Millisecond * 500)
+	} else {
+		ticker = time.NewTicker(progressLogInterval)
+	}
+
+	// Briefly color the reserved line when a warning or error is logged.
+	var problem struct {
+		at      time.Time
+		isError bool
+		m       sync.Mutex
+	}
+	problemLogged := make(chan struct{}, 1)
+	if lr != nil && highlightProblems {
+		logger.OnProblem(func(isError bool) {
+			problem.m.Lock()
+			problem.at, problem.isError = time.Now(), isError
+			problem.m.Unlock()
+			select {
+			case problemLogged <- struct{}{}:
+			default:
+			}
+		})
+	}
+	highlight := func(p string) string {
+		problem.m.Lock()
+		defer problem.m.Unlock()
+		if p == "" || time.Since(problem.at) > problemHighlightDuration {
+			return p
+		} else if problem.isError {
+			return ansiRed + p + ansiReset
+		}
+		return ansiYellow + p + ansiReset
+	}
 
 	// Get a new progress string and refresh the reserved line
-	// in regular intervals.
-	ticker := time.NewTicker(time.Millisecond * 500)
+	// (or log it) in regular intervals.
 	done := make(chan struct{})
-	defer func() {
-		ticker.Stop()
-		done <- struct{}{}
-	}()
 	go func() {
 		for {
 			select {
 			case <-ticker.C:
-				lr.Set(dm.ProgressString())
-				lr.Refresh()
+			case <-problemLogged:
 			case <-done:
 				return
 			}
+
+			// The bar only makes sense on a line of its own.
+			var p string
+			if lr != nil {
+				p = dm.ProgressString()
+			} else {
+				p = dm.ProgressSummary()
+			}
+			if dm.pauser.Paused() {
+				p = "[PAUSED] " + p
+			}
+			if lr != nil {
+				lr.Set(highlight(p))
+				lr.Refresh()
+			} else if p != "" {
+				log.Info(p)
+			}
 		}
 	}()
 
-	dls, err := dm.Download(url, workers, zipit, override)
+	return func() {
+		ticker.Stop()
+		done <- struct{}{}
+		if lr != nil {
+			logger.OnProblem(nil)
+			lr.Release()
+		}
+	}
+}
+
+// Whether or not the file is a terminal, as opposed to e.g. a pipe or a regular file.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
 	if err != nil {
-		log.Error(err)
-		return
+		return false
 	}
-	log.Infof("Done! Got a total of %d downloads.", len(dls))
+
+	return info.Mode()&os.ModeCharDevice != 0
 }
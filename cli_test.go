@@ -0,0 +1,100 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/MinoMino/mindl/plugins"
+)
+
+func TestOptionsFlagSet(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		expected OptionsFlag
+		err      error
+	}{
+		{"single", []string{"Username=mino"}, OptionsFlag{"Username": "mino"}, nil},
+		{"value with =", []string{"Password=a=b=c"}, OptionsFlag{"Password": "a=b=c"}, nil},
+		{"empty value", []string{"Password="}, OptionsFlag{"Password": ""}, nil},
+		{"key with spaces", []string{" I Like =Potatoes"}, OptionsFlag{"I Like": "Potatoes"}, nil},
+		{"several", []string{"a=1", "b=2"}, OptionsFlag{"a": "1", "b": "2"}, nil},
+		{"repeated key", []string{"a=1", "a=2"}, OptionsFlag{"a": "2"}, nil},
+		{"case variant key", []string{"Lossless=true", "lossless=false"}, OptionsFlag{"lossless": "false"}, nil},
+		{"empty key", []string{"=value"}, nil, ErrEmptyOptionKey},
+		{"blank key", []string{"  =value"}, nil, ErrEmptyOptionKey},
+		{"no =", []string{"Username"}, nil, ErrInvalidOptionFormat},
+		{"empty", []string{""}, nil, ErrInvalidOptionFormat},
+	}
+
+	for _, test := range tests {
+		var opt OptionsFlag
+		var err error
+		for _, arg := range test.args {
+			if err = opt.Set(arg); err != nil {
+				break
+			}
+		}
+		if err != test.err {
+			t.Errorf("%s: expected error %v, got %v.", test.name, test.err, err)
+		} else if !reflect.DeepEqual(opt, test.expected) {
+			t.Errorf("%s: expected %v, got %v.", test.name, test.expected, opt)
+		}
+	}
+}
+
+func TestOptionsFlagString(t *testing.T) {
+	var opt OptionsFlag
+	if s := opt.String(); s != "" {
+		t.Errorf("Expected an empty string without options, got %q.", s)
+	}
+	opt.Set("b=2")
+	opt.Set("a=1")
+	if s, expected := opt.String(), `{"a": "1", "b": "2"}`; s != expected {
+		t.Errorf("Expected %s, got %s.", expected, s)
+	}
+}
+
+// A plugin with a Directory option. Panics if anything but its name and options are used.
+type directoryPlugin struct {
+	plugins.Plugin
+	name    string
+	options []plugins.Option
+}
+
+func newDirectoryPlugin(name, dir string) *directoryPlugin {
+	opt := plugins.NewDirectoryOption()
+	opt.V = dir
+	return &directoryPlugin{name: name, options: []plugins.Option{
+		opt,
+		&plugins.StringOption{K: "Username", V: "mino"},
+	}}
+}
+
+func (dp *directoryPlugin) Name() string              { return dp.name }
+func (dp *directoryPlugin) Version() string           { return "" }
+func (dp *directoryPlugin) Options() []plugins.Option { return dp.options }
+
+func TestCheckDirectoryOption(t *testing.T) {
+	a, b := newDirectoryPlugin("A", ""), newDirectoryPlugin("B", "")
+	withDir := newDirectoryPlugin("C", "My Volume")
+
+	tests := []struct {
+		name     string
+		handlers [][]plugins.Plugin
+		fail     bool
+	}{
+		{"single URL", [][]plugins.Plugin{{withDir}}, false},
+		{"different plugins", [][]plugins.Plugin{{withDir}, {a}, {b}}, false},
+		{"unset", [][]plugins.Plugin{{a}, {a}, {b}}, false},
+		{"several URLs", [][]plugins.Plugin{{a}, {withDir}, {withDir}}, true},
+		{"possible handler", [][]plugins.Plugin{{withDir}, {a, withDir}}, true},
+		{"no handler", [][]plugins.Plugin{{withDir}, {}}, false},
+	}
+
+	for _, test := range tests {
+		if err := checkDirectoryOption(test.handlers); (err != nil) != test.fail {
+			t.Errorf("%s: expected failure %v, got: %v", test.name, test.fail, err)
+		}
+	}
+}
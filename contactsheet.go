@@ -0,0 +1,158 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	_ "image/png"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/MinoMino/mindl/plugins"
+)
+
+// The layout of contact sheets. Cells are a bit taller than
+// they are wide since that's the shape of most pages.
+const (
+	contactSheetColumns    = 6
+	contactSheetCellWidth  = 200
+	contactSheetCellHeight = 300
+	contactSheetPadding    = 4
+	contactSheetQuality    = 85
+)
+
+// Write a contact sheet for each top-level directory of the download next to it,
+// with a thumbnail of every page in it. Reads the pages back from disk.
+func (dm *DownloadManager) writeContactSheets() ([]string, error) {
+	dirs := make(map[string][]string)
+	for _, file := range dm.paths {
+		if plugins.IsCover(file) {
+			continue
+		}
+		switch strings.ToLower(filepath.Ext(file)) {
+		case ".jpg", ".jpeg", ".png":
+			dir, _ := dm.splitTopDirectory(file)
+			dirs[dir] = append(dirs[dir], file)
+		}
+	}
+
+	res := make([]string, 0, len(dirs))
+	for dir, files := range dirs {
+		sort.Strings(files)
+		path := filepath.Join(dm.directory, dir+" (contact sheet).jpg")
+		log.Infof("Writing contact sheet to: %s", filepath.Base(path))
+		if err := writeContactSheet(path, files); err != nil {
+			return res, err
+		}
+		res = append(res, path)
+	}
+
+	return res, nil
+}
+
+// Tile thumbnails of the images into a single JPEG at path.
+func writeContactSheet(path string, files []string) error {
+	rows := (len(files) + contactSheetColumns - 1) / contactSheetColumns
+	sheet := image.NewRGBA(image.Rect(0, 0,
+		contactSheetColumns*(contactSheetCellWidth+contactSheetPadding)+contactSheetPadding,
+		rows*(contactSheetCellHeight+contactSheetPadding)+contactSheetPadding))
+	draw.Draw(sheet, sheet.Bounds(), image.White, image.ZP, draw.Src)
+
+	for i, file := range files {
+		img, err := decodeImageFile(file)
+		if err != nil {
+			return err
+		}
+
+		thumb := thumbnail(img, contactSheetCellWidth, contactSheetCellHeight)
+		// Center the thumbnail in its cell.
+		tb := thumb.Bounds()
+		x := contactSheetPadding + (i%contactSheetColumns)*(contactSheetCellWidth+contactSheetPadding)
+		y := contactSheetPadding + (i/contactSheetColumns)*(contactSheetCellHeight+contactSheetPadding)
+		at := image.Pt(x+(contactSheetCellWidth-tb.Dx())/2, y+(contactSheetCellHeight-tb.Dy())/2)
+		draw.Draw(sheet, tb.Add(at), thumb, image.ZP, draw.Src)
+	}
+
+	f, err := createFile(path)
+	if err != nil {
+		return err
+	}
+	if err := jpeg.Encode(f, sheet, &jpeg.Options{Quality: contactSheetQuality}); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func decodeImageFile(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	return img, err
+}
+
+// Scale the image to fit within the given size while keeping the aspect ratio.
+// Each pixel of the result is the average of the pixels it covers, which is
+// good enough for thumbnails and doesn't need anything outside the standard library.
+func thumbnail(src image.Image, maxWidth, maxHeight int) *image.RGBA {
+	b := src.Bounds()
+	w, h := maxWidth, b.Dy()*maxWidth/b.Dx()
+	if h > maxHeight {
+		w, h = b.Dx()*maxHeight/b.Dy(), maxHeight
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		sy0, sy1 := b.Min.Y+y*b.Dy()/h, b.Min.Y+(y+1)*b.Dy()/h
+		if sy1 == sy0 {
+			sy1++
+		}
+		for x := 0; x < w; x++ {
+			sx0, sx1 := b.Min.X+x*b.Dx()/w, b.Min.X+(x+1)*b.Dx()/w
+			if sx1 == sx0 {
+				sx1++
+			}
+
+			var r, g, bl, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			dst.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(bl / n), uint16(a / n)})
+		}
+	}
+
+	return dst
+}
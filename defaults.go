@@ -0,0 +1,70 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The file in the download directory with default options for downloads to it.
+const dirDefaultsFile = ".mindl"
+
+// Load the options in the defaults file of the directory, if any. The file has
+// one option per line in the same key=value format as -o. Empty lines and lines
+// starting with # are ignored.
+func loadDirDefaults(dir string) (OptionsFlag, error) {
+	f, err := os.Open(filepath.Join(dir, dirDefaultsFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var res OptionsFlag
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if err := res.Set(line); err != nil {
+			return nil, fmt.Errorf("Invalid option on line %d of %s. Should be key=value.", n, f.Name())
+		}
+	}
+
+	return res, s.Err()
+}
+
+// Merge two sets of options, with the ones in high taking precedence.
+// Keys are case insensitive, like they are when setting plugin options.
+func mergeOptions(low, high OptionsFlag) OptionsFlag {
+	res := make(OptionsFlag, len(low)+len(high))
+	for k, v := range low {
+		res[strings.ToLower(k)] = v
+	}
+	for k, v := range high {
+		res[strings.ToLower(k)] = v
+	}
+
+	return res
+}
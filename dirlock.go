@@ -0,0 +1,75 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// The lock file created in the download directory while we're using it.
+const dirLockFile = ".mindl.lock"
+
+var ErrDirectoryLocked = errors.New("Another instance of mindl is already downloading to this directory.")
+
+// An exclusive lock on a download directory, so that two instances don't write
+// the same temporary files and archives at once. The lock is held by the OS on
+// an open file, so it goes away with the process even if it gets killed.
+type DirLock struct {
+	f *os.File
+}
+
+// Lock the directory, creating it if need be. Fails with ErrDirectoryLocked
+// if another process already holds the lock.
+func LockDirectory(dir string) (*DirLock, error) {
+	if err := os.MkdirAll(dir, os.FileMode(permission)); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, dirLockFile)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, os.FileMode(filePermission))
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// The PID is only there for the curious.
+	f.Truncate(0)
+	fmt.Fprintf(f, "%d\n", os.Getpid())
+	log.Debugf("Locked the download directory with: %s", path)
+
+	return &DirLock{f}, nil
+}
+
+// Release the lock. Does nothing if the lock is nil. The lock file is left
+// behind, since removing it would let another instance lock a new file of
+// the same name while a third is still waiting on the old one.
+func (dl *DirLock) Unlock() {
+	if dl == nil {
+		return
+	}
+
+	if err := unlockFile(dl.f); err != nil {
+		log.Warnf("Failed to unlock the download directory: %s", err)
+	}
+	dl.f.Close()
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLockDirectory(t *testing.T) {
+	root, err := ioutil.TempDir("", "mindl-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	dir := filepath.Join(root, "downloads")
+	lock, err := LockDirectory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LockDirectory(dir); err != ErrDirectoryLocked {
+		t.Errorf("Expected ErrDirectoryLocked while locked, got: %v", err)
+	}
+
+	lock.Unlock()
+	if _, err := os.Stat(filepath.Join(dir, dirLockFile)); err != nil {
+		t.Errorf("Expected the lock file to be left behind, got: %s", err)
+	}
+	lock, err = LockDirectory(dir)
+	if err != nil {
+		t.Fatalf("Expected to lock the directory again after unlocking, got: %s", err)
+	}
+	lock.Unlock()
+
+	// A nil lock, e.g. when not downloading, is fine to unlock.
+	var nilLock *DirLock
+	nilLock.Unlock()
+}
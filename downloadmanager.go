@@ -18,6 +18,9 @@ package main
 
 import (
 	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha1"
 	"errors"
 	"fmt"
 	"io"
@@ -25,12 +28,15 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
+	"github.com/MinoMino/mindl/logger"
 	. "github.com/MinoMino/mindl/plugins"
-
-	"github.com/MinoMino/minprogress"
 )
 
 // Create a channel to catch interrupts and exit cleanly.
@@ -40,7 +46,16 @@ func init() {
 	signal.Notify(interrupt, os.Interrupt)
 }
 
-var permission = 0755
+// The permissions of the directories and files we create. Set by --dir-mode and --file-mode.
+var (
+	permission     = 0755
+	filePermission = 0666
+)
+
+// Create or truncate a file with the permissions set by --file-mode.
+func createFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, os.FileMode(filePermission))
+}
 
 var (
 	ErrNilGenerator            = errors.New("DownloadGenerator() returned nil on first call.")
@@ -50,6 +65,13 @@ var (
 	ErrInvaidSpecialOptionType = errors.New("A special option was not of the expected type.")
 	ErrInterrupted             = errors.New("The download failed to finish because of an interrupt.")
 	ErrDisabled                = errors.New("This plugin is temporarily disabled.")
+	ErrNoMetadata              = errors.New("The plugin did not provide any metadata.")
+	ErrStreamedResume          = errors.New("Files can't be resumed while streaming them to an archive.")
+	ErrStreamDiscarded         = errors.New("The archives being streamed to were discarded.")
+	ErrNoPreview               = errors.New("The plugin can't download a preview of this URL.")
+	ErrPreviewUnsupported      = errors.New("The plugin doesn't support downloading previews.")
+	ErrStdoutMultipleFiles     = errors.New("Only downloads of a single file can be written to stdout.")
+	ErrStdoutResume            = errors.New("Files can't be resumed while writing them to stdout.")
 )
 
 type IODataHandler func(data []byte) error
@@ -59,11 +81,14 @@ type IOCloseHandler func() error
 // through it. Can also register handlers that are called when we get data.
 type IOController struct {
 	io.Writer
+	// If set, writes block while it's paused.
+	pauser         *Pauser
 	dataCallbacks  []IODataHandler
 	closeCallbacks []IOCloseHandler
 }
 
 func (ioctrl *IOController) Write(p []byte) (int, error) {
+	ioctrl.pauser.Wait()
 	for _, cb := range ioctrl.dataCallbacks {
 		if err := cb(p); err != nil {
 			return 0, err
@@ -91,6 +116,19 @@ func (ioctrl *IOController) Close() error {
 	return nil
 }
 
+// Close the writer without calling the close handlers, so that a file that
+// failed to be written isn't reported as saved. If the writer is an Aborter,
+// it's aborted rather than closed.
+func (ioctrl *IOController) Abort() error {
+	if aborter, ok := ioctrl.Writer.(Aborter); ok {
+		return aborter.Abort()
+	} else if closer, ok := ioctrl.Writer.(io.WriteCloser); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
 func (ioctrl *IOController) RegisterDataCallback(cb IODataHandler) {
 	ioctrl.dataCallbacks = append(ioctrl.dataCallbacks, cb)
 }
@@ -104,16 +142,39 @@ type DownloadReporter struct {
 	plugin         Plugin
 	saved          chan<- string
 	reportCallback IODataHandler
+	// Called with the expected size of data that's about to be reported. add is
+	// set if other sized data is still being received, e.g. by the goroutines
+	// of a plugin downloading several files at once.
+	sizeCallback func(size int64, add bool)
+	// The number of sized copies in progress.
+	sizing int
+	sizem  sync.Mutex
 	// Other callbacks.
 	callbacks []IODataHandler
-	dstdir    string
-	dirm      sync.Mutex
+	// If set, called with the hash of the content of every file saved.
+	hashCallback func(path string, sum []byte)
+	// If set, the paths given by the plugin are passed through it.
+	rename func(path string) string
+	// If set, files are added to its archives instead of being written to disk.
+	stream *ZipStreamer
+	// If set, the one file of the download is written to it instead of to disk.
+	stdout *stdoutTarget
+	pauser *Pauser
+	dstdir string
+	dirm   sync.Mutex
 }
 
 func (dr *DownloadReporter) FileWriter(dst string, report bool) (w io.WriteCloser, err error) {
 	if err := dr.assertValidPath(dst); err != nil {
 		return nil, err
 	}
+	dst = dr.renamePath(dst)
+	if dr.stdout != nil {
+		return dr.stdoutWriter(dst, report)
+	} else if dr.stream != nil {
+		sf := &streamedFile{zs: dr.stream, path: dst}
+		return dr.fileWriter(sf, filepath.Join(dr.dstdir, dst), report, true), nil
+	}
 
 	// Create the directories if we have to first.
 	dst = filepath.Join(dr.dstdir, dst)
@@ -121,15 +182,87 @@ func (dr *DownloadReporter) FileWriter(dst string, report bool) (w io.WriteClose
 		return nil, err
 	}
 
-	f, err := os.Create(dst)
+	f, err := createFile(dst)
 	if err != nil {
 		return nil, err
 	}
 
-	ioctrl := &IOController{Writer: f}
+	return dr.fileWriter(f, dst, report, true), nil
+}
+
+func (dr *DownloadReporter) PartialSize(dst string) (int64, error) {
+	if err := dr.assertValidPath(dst); err != nil {
+		return 0, err
+	} else if dr.stream != nil || dr.stdout != nil {
+		// Nothing is left on disk to resume from.
+		return 0, nil
+	}
+
+	info, err := os.Stat(filepath.Join(dr.dstdir, dr.renamePath(dst)))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (dr *DownloadReporter) ResumeWriter(dst string, offset int64, report bool) (io.WriteCloser, error) {
+	if err := dr.assertValidPath(dst); err != nil {
+		return nil, err
+	} else if dr.stdout != nil {
+		if offset != 0 {
+			return nil, ErrStdoutResume
+		}
+		return dr.FileWriter(dst, report)
+	} else if dr.stream != nil {
+		if offset != 0 {
+			return nil, ErrStreamedResume
+		}
+		return dr.FileWriter(dst, report)
+	}
+	dst = dr.renamePath(dst)
+
+	// Create the directories if we have to first.
+	dst = filepath.Join(dr.dstdir, dst)
+	if err := dr.makeDirectories(dst); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE, os.FileMode(filePermission))
+	if err != nil {
+		return nil, err
+	}
+	// Get rid of anything past the offset, like a partially written last chunk.
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return nil, err
+	} else if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// We'd only be hashing part of the file if we resumed.
+	return dr.fileWriter(f, dst, report, offset == 0), nil
+}
+
+// Wrap the file in an IOController that reports it as saved when it's closed.
+func (dr *DownloadReporter) fileWriter(f io.WriteCloser, dst string, report, hash bool) io.WriteCloser {
+	ioctrl := &IOController{Writer: f, pauser: dr.pauser}
 	for _, cb := range dr.callbacks {
 		ioctrl.RegisterDataCallback(cb)
 	}
+	if hash && dr.hashCallback != nil {
+		h := sha1.New()
+		ioctrl.RegisterDataCallback(func(data []byte) error {
+			h.Write(data)
+			return nil
+		})
+		ioctrl.RegisterCloseCallback(func() error {
+			dr.hashCallback(dst, h.Sum(nil))
+			return nil
+		})
+	}
 	// Report when we close the file.
 	ioctrl.RegisterCloseCallback(func() error {
 		dr.saved <- dst
@@ -140,15 +273,30 @@ func (dr *DownloadReporter) FileWriter(dst string, report bool) (w io.WriteClose
 		ioctrl.RegisterDataCallback(dr.reportCallback)
 	}
 
-	return ioctrl, nil
+	return ioctrl
 }
 
 func (dr *DownloadReporter) Copy(dst io.Writer, src io.Reader) (written int64, err error) {
-	return dr.copy(dst, src, true)
+	return dr.copy(dst, src, 0, true)
 }
 
-func (dr *DownloadReporter) copy(dst io.Writer, src io.Reader, report bool) (written int64, err error) {
-	ioctrl := &IOController{Writer: dst}
+func (dr *DownloadReporter) CopySized(dst io.Writer, src io.Reader, size int64) (written int64, err error) {
+	return dr.copy(dst, src, size, true)
+}
+
+func (dr *DownloadReporter) copy(dst io.Writer, src io.Reader, size int64, report bool) (written int64, err error) {
+	if report && size > 0 && dr.sizeCallback != nil {
+		dr.sizem.Lock()
+		dr.sizeCallback(size, dr.sizing > 0)
+		dr.sizing++
+		dr.sizem.Unlock()
+		defer func() {
+			dr.sizem.Lock()
+			dr.sizing--
+			dr.sizem.Unlock()
+		}()
+	}
+	ioctrl := &IOController{Writer: dst, pauser: dr.pauser}
 	dst = ioctrl
 	for _, cb := range dr.callbacks {
 		ioctrl.RegisterDataCallback(cb)
@@ -183,13 +331,36 @@ func (dr *DownloadReporter) copy(dst io.Writer, src io.Reader, report bool) (wri
 		}
 	}
 
+	// The server could've closed the connection early without an error.
+	if err == nil && size > 0 && written != size {
+		err = fmt.Errorf("Expected %d bytes, but got %d. The download was cut short.", size, written)
+	}
+
 	return written, err
 }
 
 func (dr *DownloadReporter) SaveData(dst string, src io.Reader, report bool) (int64, error) {
+	return dr.SaveDataSized(dst, src, 0, report)
+}
+
+func (dr *DownloadReporter) SaveDataSized(dst string, src io.Reader, size int64, report bool) (int64, error) {
 	if err := dr.assertValidPath(dst); err != nil {
 		return 0, err
 	}
+	dst = dr.renamePath(dst)
+	if dr.stdout != nil {
+		w, err := dr.stdoutWriter(dst, false)
+		if err != nil {
+			return 0, err
+		}
+		n, err := dr.copy(w, src, size, report)
+		if err != nil {
+			return n, err
+		}
+		return n, w.Close()
+	} else if dr.stream != nil {
+		return dr.streamData(dst, src, size, report)
+	}
 
 	// Create the directories if we have to first.
 	dst = filepath.Join(dr.dstdir, dst)
@@ -197,25 +368,59 @@ func (dr *DownloadReporter) SaveData(dst string, src io.Reader, report bool) (in
 		return 0, err
 	}
 
-	f, err := os.Create(dst)
+	f, err := createFile(dst)
 	if err != nil {
 		return 0, err
 	}
 	defer f.Close()
 
-	if n, err := dr.copy(f, src, report); err != nil {
+	var w io.Writer = f
+	h := sha1.New()
+	if dr.hashCallback != nil {
+		w = io.MultiWriter(f, h)
+	}
+
+	if n, err := dr.copy(w, src, size, report); err != nil {
 		return n, err
 	} else {
+		if dr.hashCallback != nil {
+			dr.hashCallback(dst, h.Sum(nil))
+		}
 		// Tell the manager we got a file.
 		dr.saved <- dst
 		return n, err
 	}
 }
 
+// Same as SaveDataSized(), but adds the file to the archive being streamed to.
+// The file is only added if all of the data was received.
+func (dr *DownloadReporter) streamData(dst string, src io.Reader, size int64, report bool) (int64, error) {
+	sf := &streamedFile{zs: dr.stream, path: dst}
+	dst = filepath.Join(dr.dstdir, dst)
+	var w io.Writer = sf
+	h := sha1.New()
+	if dr.hashCallback != nil {
+		w = io.MultiWriter(sf, h)
+	}
+
+	n, err := dr.copy(w, src, size, report)
+	if err != nil {
+		return n, err
+	} else if err := sf.Close(); err != nil {
+		return n, err
+	}
+	if dr.hashCallback != nil {
+		dr.hashCallback(dst, h.Sum(nil))
+	}
+	dr.saved <- dst
+	return n, nil
+}
+
 func (dr *DownloadReporter) SaveFile(dst, src string) (int64, error) {
 	if err := dr.assertValidPath(dst); err != nil {
 		return 0, err
 	}
+	dst = dr.renamePath(dst)
 
 	// Make sure src exists and get its size.
 	info, err := os.Stat(src)
@@ -223,6 +428,41 @@ func (dr *DownloadReporter) SaveFile(dst, src string) (int64, error) {
 		return 0, err
 	}
 
+	if dr.stdout != nil {
+		w, err := dr.stdoutWriter(dst, false)
+		if err != nil {
+			return 0, err
+		}
+		f, err := os.Open(src)
+		if err != nil {
+			return 0, err
+		}
+		_, err = io.Copy(w, f)
+		f.Close()
+		if err != nil {
+			return 0, err
+		} else if err := w.Close(); err != nil {
+			return 0, err
+		}
+		return info.Size(), os.Remove(src)
+	} else if dr.stream != nil {
+		f, err := os.Open(src)
+		if err != nil {
+			return 0, err
+		}
+		err = dr.stream.Add(dst, f)
+		f.Close()
+		if err != nil {
+			return 0, err
+		}
+		dst = filepath.Join(dr.dstdir, dst)
+		if err := os.Remove(src); err != nil {
+			return 0, err
+		}
+		dr.saved <- dst
+		return info.Size(), nil
+	}
+
 	// Create the directories if we have to first.
 	dst = filepath.Join(dr.dstdir, dst)
 	if err = dr.makeDirectories(dst); err != nil {
@@ -235,6 +475,41 @@ func (dr *DownloadReporter) SaveFile(dst, src string) (int64, error) {
 	return info.Size(), nil
 }
 
+// Get a writer to stdout for the file at the path, which has already been renamed.
+func (dr *DownloadReporter) stdoutWriter(dst string, report bool) (io.WriteCloser, error) {
+	w, err := dr.stdout.claim()
+	if err != nil {
+		return nil, err
+	}
+
+	return dr.fileWriter(w, filepath.Join(dr.dstdir, dst), report, true), nil
+}
+
+// Where the file of a download is written to with --stdout. Only a single file
+// can be written, since there would be no telling where one ends and the next
+// begins, so any files after the first fail with ErrStdoutMultipleFiles.
+type stdoutTarget struct {
+	w    io.Writer
+	used int32
+}
+
+func (st *stdoutTarget) claim() (io.WriteCloser, error) {
+	if !atomic.CompareAndSwapInt32(&st.used, 0, 1) {
+		return nil, ErrStdoutMultipleFiles
+	}
+
+	return nopWriteCloser{st.w}, nil
+}
+
+// Keeps the IOController from closing stdout.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
 func (dr *DownloadReporter) TempFile() (f *os.File, err error) {
 	f, err = ioutil.TempFile(filepath.Join(dr.dstdir, ".tmp"), fmt.Sprintf("mindl-%s-", dr.plugin.Name()))
 	if err != nil {
@@ -261,6 +536,14 @@ func (dr *DownloadReporter) makeDirectories(path string) error {
 	return nil
 }
 
+func (dr *DownloadReporter) renamePath(path string) string {
+	if dr.rename == nil {
+		return path
+	}
+
+	return dr.rename(path)
+}
+
 // Asserts it's a relative path, that it's a file, and that it has at least one parent directory.
 func (dr *DownloadReporter) assertValidPath(path string) error {
 	if filepath.IsAbs(path) {
@@ -280,21 +563,141 @@ func (dr *DownloadReporter) assertValidPath(path string) error {
 // The manager itself.
 
 type DownloadManager struct {
-	progress  *minprogress.ProgressBar
+	// Receives updates on the progress. Defaults to a ProgressBarObserver.
+	Observer  ProgressObserver
 	paths     []string
 	plugin    Plugin
 	directory string
 	m         sync.Mutex
+	// Whether or not to fail if we got fewer files than the plugin said we would.
+	verifyCount bool
+	// If positive, the approximate maximum size in bytes of each archive when zipping.
+	splitSize int64
+	// Whether or not to remove files identical to the previous file in the same directory.
+	dedup  bool
+	hashes map[string]string
+	// If set, used to pause the workers.
+	pauser *Pauser
+	// The template for archive names. See archiveName().
+	archiveTemplate string
+	metadata        *Metadata
+	// If set, puts the files in a directory shared with other downloads.
+	namer *SeriesNamer
+	// Whether or not to zip each volume of a series as soon as it's downloaded
+	// instead of zipping the whole series at the end. See ZipSeries().
+	zipVolumes bool
+	// Whether or not to transliterate names to ASCII, and the original name of
+	// each top-level directory that was transliterated.
+	asciiNames bool
+	originals  map[string]string
+	// Whether or not to write a contact sheet for each directory after downloading.
+	contactSheet bool
+	// If set, the modification time of every file in the archives.
+	zipTime time.Time
+	// Whether or not to only write the metadata, without downloading any files.
+	onlyMetadata bool
+	// Whether or not to move the files up a level if there's a single top-level directory.
+	flattenSingle bool
+	// Whether or not to write files straight into the archives when zipping.
+	streamZip bool
+	// The streamer for the current download, if streaming.
+	stream *ZipStreamer
+	// If set, the single file of a download is written to it instead of to disk.
+	stdout io.Writer
+	// Whether or not to check if the site is up before downloading, if the plugin can.
+	preflight bool
+	// Whether or not to write what was logged during a download to a file in each
+	// of its top-level directories, and the directories it has written to so far.
+	volumeLog  bool
+	volumeDirs []string
+	// If positive, how long it takes to ramp up from one worker to all of them.
+	slowStart time.Duration
+	// How many times to run a downloader again if it fails with a retryable error.
+	pageRetries int
+	// How many downloaders can fail for good before we give up on the whole download.
+	maxFailedPages int
+	// The archives created by the last download and the bytes it received.
+	archives []string
+	bytes    int64
+	// The errors of the downloaders that failed for good without making the
+	// download fail, and the number of times downloaders were run again.
+	failed  []error
+	retries int64
+}
+
+// Everything we know about a download after it's done.
+type DownloadResult struct {
+	// The downloaded files, or what's left of them if they were zipped.
+	Paths []string
+	// The archives created, if zipped.
+	Archives []string
+	// The number of bytes received by the plugin through the reporters.
+	Bytes    int64
+	Duration time.Duration
+	// Errors for individual files that didn't make the download as a whole fail.
+	Errors []error
+	// The number of times a file was retried, whether or not it succeeded in the end.
+	Retries int64
+}
+
+// Same as Download(), but with more information about the result. The result
+// is never nil, even if an error is returned.
+func (dm *DownloadManager) Run(url string, maxWorkers int, zipit, override bool) (*DownloadResult, error) {
+	start := time.Now()
+	paths, err := dm.Download(url, maxWorkers, zipit, override)
+
+	dm.m.Lock()
+	defer dm.m.Unlock()
+	return &DownloadResult{
+		Paths:    paths,
+		Archives: dm.archives,
+		Bytes:    atomic.LoadInt64(&dm.bytes),
+		Duration: time.Since(start),
+		Errors:   dm.failed,
+		Retries:  atomic.LoadInt64(&dm.retries),
+	}, err
 }
 
-func NewDownloadManager(plugin Plugin, directory string) *DownloadManager {
+// Returns an error if the directory can't be created or written to, so that
+// we don't find out only after logging in and getting to the first file.
+func NewDownloadManager(plugin Plugin, directory string) (*DownloadManager, error) {
+	if err := assertWritable(directory); err != nil {
+		return nil, err
+	}
+
 	return &DownloadManager{
+		Observer:  &ProgressBarObserver{},
 		plugin:    plugin,
 		directory: directory,
+	}, nil
+}
+
+// Make sure the directory exists and that we can create files in it.
+func assertWritable(dir string) error {
+	if err := os.MkdirAll(dir, os.FileMode(permission)); err != nil {
+		return fmt.Errorf("Could not create the download directory: %s", err)
 	}
+
+	f, err := ioutil.TempFile(dir, ".mindl-probe-")
+	if err != nil {
+		return fmt.Errorf("The download directory is not writable: %s", err)
+	}
+	f.Close()
+
+	return os.Remove(f.Name())
 }
 
-func (dm *DownloadManager) Download(url string, maxWorkers int, zipit, override bool) ([]string, error) {
+func (dm *DownloadManager) Download(url string, maxWorkers int, zipit, override bool) (paths []string, err error) {
+	defer func() {
+		dm.Observer.OnFinish(paths, err)
+	}()
+	// Wake up any plugin still sleeping once we return, e.g. after an interrupt.
+	ctx, cancel := context.WithCancel(context.Background())
+	SetSleepContext(ctx)
+	defer func() {
+		cancel()
+		SetSleepContext(nil)
+	}()
 	defer func() {
 		if r := recover(); r != nil {
 			log.Info("Cleaning up early due to a panic...")
@@ -336,47 +739,136 @@ func (dm *DownloadManager) Download(url string, maxWorkers int, zipit, override
 		}
 	}
 
+	if pv, ok := dm.plugin.(Previewer); Preview && !ok {
+		return nil, ErrPreviewUnsupported
+	} else if Preview && !pv.HasPreview(url) {
+		return nil, ErrNoPreview
+	}
+	if pf, ok := dm.plugin.(Preflighter); ok && dm.preflight {
+		log.Debug("Checking if the site is up...")
+		if err := pf.Preflight(url); err != nil {
+			return nil, fmt.Errorf("Preflight check failed: %s", err)
+		}
+	}
+
+	dm.m.Lock()
+	dm.archives = nil
+	dm.stream = nil
+	dm.failed = nil
+	dm.volumeDirs = nil
+	dm.originals = nil
+	dm.m.Unlock()
+	if dm.volumeLog {
+		buf := &lockedBuffer{}
+		logger.Tee(buf)
+		defer func() {
+			logger.Tee(nil)
+			// The error itself is only logged by whoever called us.
+			if err != nil {
+				fmt.Fprintf(buf, "The download failed: %s\n", err)
+			}
+			dm.writeVolumeLog(buf.Bytes())
+		}()
+	}
+	atomic.StoreInt64(&dm.bytes, 0)
+	atomic.StoreInt64(&dm.retries, 0)
+
 	var dlCount int
 	dlgen, total := dm.plugin.DownloadGenerator(url)
 	if dlgen == nil {
 		panic(ErrNilGenerator)
+	} else if dm.onlyMetadata {
+		return dm.downloadMetadata(total)
 	}
-
-	if total == UnknownTotal {
-		dm.progress = minprogress.NewProgressBar(minprogress.UnknownTotal)
-	} else {
-		dm.progress = minprogress.NewProgressBar(total)
+	var stdout *stdoutTarget
+	if dm.stdout != nil {
+		// Downloads of unknown size only fail once they get to a second file.
+		if total != UnknownTotal && total != 1 {
+			dm.Observer.OnError(ErrStdoutMultipleFiles)
+			log.Infof("Cleaning up early since the download has %d files...", total)
+			dm.plugin.Cleanup(ErrStdoutMultipleFiles)
+			return nil, ErrStdoutMultipleFiles
+		}
+		stdout = &stdoutTarget{w: dm.stdout}
+	}
+	if stream := dm.zipStreamer(zipit); stream != nil {
+		dm.stream = stream
+		// Gets rid of the incomplete archives if we don't make it to the end.
+		defer stream.Discard()
 	}
-	dm.progress.SpeedUnits = minprogress.DataUnits
-	dm.progress.Unit = "file"
-	dm.progress.Units = "files"
-	dm.progress.ReportsPerSample = 8 * maxWorkers
+
+	// Peek at the second downloader so that we know if there will only ever be
+	// one worker, in which case the observer shouldn't expect reports from more.
 	next := dlgen()
-	// nil or error to signal the goroutines are done.
-	done := make(chan error)
+	var peeked Downloader
+	if next != nil {
+		peeked = dlgen()
+	}
+	activeWorkers := maxWorkers
+	if peeked == nil || total == 1 {
+		activeWorkers = 1
+	} else if total > 0 && total < activeWorkers {
+		activeWorkers = total
+	}
+	dm.Observer.OnStart(total, activeWorkers)
+	// nil or error to signal the goroutines are done. Buffered so that the
+	// spawner can always finish, even if we've stopped waiting for it.
+	done := make(chan error, 1)
 	// Report the paths to the files as they're done and written to disk.
 	got := make(chan string, maxWorkers)
+	// Closed to make the spawner stop spawning workers if we're interrupted.
+	stop := make(chan struct{})
 	// Use a WaitGroup to make sure all goroutines finish before we exit on error.
 	var wg sync.WaitGroup
 
 	// Run a goroutine that spawns workers as needed.
 	go func() {
+		// Pass the result down the chain once the workers still running and the
+		// pages they handed off for descrambling are done, so that none outlive us.
+		finish := func(err error) {
+			wg.Wait()
+			if derr := WaitDescrambles(); err == nil {
+				err = derr
+			}
+			done <- err
+		}
 		// Deal with potential panic by spawner.
 		defer func() {
 			if r := recover(); r != nil {
-				done <- fmt.Errorf("Spawner panicked: %s", r)
+				finish(fmt.Errorf("Spawner panicked: %s", r))
 				return
 			}
 		}()
 
 		workerLimiter := make(chan struct{}, maxWorkers)
 		ec := make(chan error, maxWorkers)
+		started := time.Now()
 		for dlCount = 0; next != nil; dlCount++ {
+			// Hold off on using more slots than the slow start allows so far.
+			for {
+				limit := dm.slowStartWorkers(time.Since(started), maxWorkers)
+				if limit >= maxWorkers || len(workerLimiter) < limit {
+					break
+				}
+				select {
+				case err := <-ec:
+					finish(err)
+					return
+				case <-stop:
+					finish(ErrInterrupted)
+					return
+				case <-time.After(slowStartPoll):
+				}
+			}
+
 			// Blocks until we have worker slots or we get an error.
 			select {
 			case err := <-ec:
-				// Pass the error down the chain and return immediately.
-				done <- err
+				// Stop spawning.
+				finish(err)
+				return
+			case <-stop:
+				finish(ErrInterrupted)
 				return
 			case workerLimiter <- struct{}{}:
 			}
@@ -396,26 +888,39 @@ func (dm *DownloadManager) Download(url string, maxWorkers int, zipit, override
 
 				// Prepare the reporter for this particular worker.
 				reporter := &DownloadReporter{
-					plugin: dm.plugin,
-					saved:  got,
+					plugin:       dm.plugin,
+					saved:        got,
+					hashCallback: dm.hashCallback(),
+					pauser:       dm.pauser,
 					//callbacks: []IODataHandler{},
 					reportCallback: func(data []byte) error {
-						dm.progress.Report(n, len(data))
+						atomic.AddInt64(&dm.bytes, int64(len(data)))
+						dm.Observer.OnProgress(n, len(data))
 						return nil
 					},
+					sizeCallback: func(size int64, add bool) {
+						dm.Observer.OnFileSize(n, size, add)
+					},
 					dstdir: dm.directory,
+					stream: dm.stream,
+					stdout: stdout,
 				}
+				reporter.rename = dm.renamer()
 				// Make sure we report we're done with the download regardless of what happens.
-				defer dm.progress.Done(n)
+				defer dm.Observer.OnWorkerDone(n)
 				// Run the task.
-				if err := dl(n, reporter); err != nil {
+				if err := dm.runDownloader(n, dl, reporter); err != nil && !dm.tolerateFailure(n, err) {
 					ec <- err
 					return
 				}
 				// Free the slot.
 				<-workerLimiter
 			}(dlCount, next)
-			next = dlgen()
+			if peeked != nil {
+				next, peeked = peeked, nil
+			} else {
+				next = dlgen()
+			}
 		}
 
 		wg.Wait()
@@ -423,50 +928,141 @@ func (dm *DownloadManager) Download(url string, maxWorkers int, zipit, override
 		// All workers are done, but we could still have errors buffered.
 		select {
 		case err := <-ec:
-			done <- err
+			finish(err)
 			return
 		default:
 		}
 
 		if dlCount == 0 {
-			done <- errors.New("Got no downloaders from the plugin.")
+			finish(errors.New("Got no downloaders from the plugin."))
 		} else {
-			done <- nil
+			finish(nil)
 		}
 	}()
 
 	dm.m.Lock()
 	// All the paths to the files that have been written to disk.
 	dm.paths = make([]string, 0, 100)
+	dm.hashes = make(map[string]string)
 	dm.m.Unlock()
+	gotPath := func(path string) {
+		path = filepath.FromSlash(path)
+		dm.m.Lock()
+		dm.paths = append(dm.paths, path)
+		if dm.volumeLog {
+			dm.addVolumeDir(path)
+		}
+		dm.m.Unlock()
+		// Report progress. Covers aren't part of the total.
+		if !IsCover(path) {
+			dm.Observer.OnFileDone(path)
+		}
+		log.Debug("Got file: " + path)
+	}
 loop:
 	for {
 		select {
 		case <-interrupt:
+			dm.Observer.OnError(ErrInterrupted)
 			log.Info("Interrupted! Cleaning up...")
+			// Keep the workers still running from blocking on got forever.
+			close(stop)
+			go func() {
+				for {
+					select {
+					case <-got:
+					case <-done:
+						return
+					}
+				}
+			}()
 			dm.plugin.Cleanup(ErrInterrupted)
 			return nil, ErrInterrupted
 		case err := <-done:
 			if err != nil {
+				dm.Observer.OnError(err)
 				log.Info("Cleaning up early due to an error...")
 				dm.plugin.Cleanup(err)
 				return nil, err
 			} else {
+				// The last files can still be buffered once the workers are done.
+				for len(got) > 0 {
+					gotPath(<-got)
+				}
 				break loop
 			}
 		case path := <-got:
-			path = filepath.FromSlash(path)
-			dm.m.Lock()
-			dm.paths = append(dm.paths, path)
-			dm.m.Unlock()
-			// Report progress.
-			dm.progress.Progress(1)
-			log.Debug("Got file: " + path)
+			gotPath(path)
 		}
 	}
 
-	if zipit {
-		if _, err := dm.ZipDownloads(true); err != nil {
+	if got := countPages(dm.paths); dm.verifyCount && total != UnknownTotal && got < total {
+		err := fmt.Errorf("Expected %d files, but only got %d. The download is incomplete.", total, got)
+		dm.Observer.OnError(err)
+		log.Info("Cleaning up early due to missing files...")
+		dm.plugin.Cleanup(err)
+		return dm.paths, err
+	}
+
+	if dm.dedup {
+		if err := dm.removeDuplicates(); err != nil {
+			dm.Observer.OnError(err)
+			log.Info("Cleaning up early due to error while removing duplicates...")
+			dm.plugin.Cleanup(err)
+			return dm.paths, err
+		}
+	}
+
+	// There's nowhere to put the metadata if the file went to stdout.
+	if dm.stdout == nil {
+		dm.metadata = nil
+		if mp, ok := dm.plugin.(MetadataProvider); ok {
+			dm.metadata = mp.Metadata()
+		}
+		if dm.metadata == nil {
+			dm.metadata = dm.originalNameMetadata()
+		}
+		if err := dm.writeMetadata(dm.metadata); err != nil {
+			dm.Observer.OnError(err)
+			log.Info("Cleaning up early due to error while writing metadata...")
+			dm.plugin.Cleanup(err)
+			return dm.paths, err
+		}
+	}
+
+	// Not worth failing the download over.
+	if dm.contactSheet {
+		if _, err := dm.writeContactSheets(); err != nil {
+			log.Warnf("Failed to write the contact sheet: %s", err)
+		}
+	}
+
+	// Archives already end up at the top, so only bother if we're not zipping.
+	if dm.flattenSingle && !zipit && dm.namer == nil {
+		if err := dm.flattenDownloads(); err != nil {
+			dm.Observer.OnError(err)
+			log.Info("Cleaning up early due to error while flattening...")
+			dm.plugin.Cleanup(err)
+			return dm.paths, err
+		}
+	}
+
+	// The series directory is zipped once every volume is in it, unless each
+	// volume gets an archive of its own.
+	if zipit && (dm.namer == nil || dm.zipVolumes) {
+		var archives []string
+		if dm.stream != nil {
+			archives, err = dm.stream.Close(dm.archiveName)
+		} else if dm.namer != nil {
+			archives, err = dm.zipVolume()
+		} else {
+			archives, err = dm.ZipDownloads(true)
+		}
+		dm.m.Lock()
+		dm.archives = archives
+		dm.m.Unlock()
+		if err != nil {
+			dm.Observer.OnError(err)
 			log.Info("Cleaning up early due to error while zipping...")
 			dm.plugin.Cleanup(err)
 			return dm.paths, err
@@ -478,69 +1074,573 @@ loop:
 	return dm.paths, nil
 }
 
-func (dm *DownloadManager) ProgressString() string {
-	var res string
-	if dm.progress != nil {
+// Run the downloader, running it again up to pageRetries times if it fails with
+// an error that IsRetryable() considers temporary, like a network error.
+func (dm *DownloadManager) runDownloader(n int, dl Downloader, rep Reporter) error {
+	attempt := 0
+	return RetryIf(dm.pageRetries+1, DefaultRetryBackoff, IsRetryable, func() error {
+		if attempt++; attempt > 1 {
+			atomic.AddInt64(&dm.retries, 1)
+			log.Warnf("Retrying download #%d (%d/%d)...", n, attempt-1, dm.pageRetries)
+		}
+		return dl(n, rep)
+	})
+}
+
+// Whether or not the download can go on without the downloader that failed for
+// good. Up to maxFailedPages of them are tolerated, so that a few broken pages
+// don't fail a volume, but a dead server doesn't get hammered for every page.
+func (dm *DownloadManager) tolerateFailure(n int, err error) bool {
+	dm.m.Lock()
+	defer dm.m.Unlock()
+	if len(dm.failed) >= dm.maxFailedPages {
+		if dm.maxFailedPages > 0 {
+			log.Errorf("More than %d downloads failed. Giving up on the rest.", dm.maxFailedPages)
+		}
+		return false
+	}
+
+	log.Errorf("Download #%d failed, skipping it: %s", n, err)
+	dm.failed = append(dm.failed, fmt.Errorf("Download #%d: %s", n, err))
+	return true
+}
+
+// Returns a callback that keeps track of the hashes of saved files if we need them.
+func (dm *DownloadManager) hashCallback() func(string, []byte) {
+	if !dm.dedup {
+		return nil
+	}
+
+	return func(path string, sum []byte) {
+		dm.m.Lock()
+		dm.hashes[filepath.FromSlash(path)] = string(sum)
+		dm.m.Unlock()
+	}
+}
+
+// Some readers serve the same placeholder image for pages that are missing or
+// require a purchase, so remove files identical to the previous one in the same
+// directory, in order of filename. Files we don't have a hash for are kept.
+func (dm *DownloadManager) removeDuplicates() error {
+	dm.m.Lock()
+	defer dm.m.Unlock()
+
+	paths := make([]string, len(dm.paths))
+	copy(paths, dm.paths)
+	sort.Strings(paths)
+
+	kept := make([]string, 0, len(paths))
+	var dropped int
+	for i, path := range paths {
+		sum, ok := dm.hashes[path]
+		if ok && i > 0 && filepath.Dir(paths[i-1]) == filepath.Dir(path) && dm.hashes[paths[i-1]] == sum {
+			log.Debugf("Removing duplicate: %s", path)
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			dropped++
+			continue
+		}
+		kept = append(kept, path)
+	}
+
+	if dropped != 0 {
+		log.Infof("Dropped %d duplicate page(s).", dropped)
+	}
+	dm.paths = kept
+	return nil
+}
+
+// The name of the metadata file written to each top-level directory.
+const comicInfoFile = "ComicInfo.xml"
+
+// Write the metadata without downloading any files, for --only-metadata. The
+// plugin has been initialized (and logged in) by then, so it still gets cleaned up.
+func (dm *DownloadManager) downloadMetadata(total int) ([]string, error) {
+	var md *Metadata
+	if mp, ok := dm.plugin.(MetadataProvider); ok {
+		md = mp.Metadata()
+	}
+	if md == nil || md.Title == "" {
+		log.Info("Cleaning up...")
+		dm.plugin.Cleanup(ErrNoMetadata)
+		return nil, ErrNoMetadata
+	}
+	dm.metadata = md
+
+	dm.m.Lock()
+	dm.paths = nil
+	dm.m.Unlock()
+	err := func() error {
+		dir := filepath.Join(dm.directory, SanitizeFilename(md.Title))
+		if err := os.MkdirAll(dir, os.FileMode(permission)); err != nil {
+			return err
+		}
+		data, err := md.ComicInfo(total)
+		if err != nil {
+			return err
+		}
+
+		path := filepath.Join(dir, comicInfoFile)
+		log.Infof("Writing metadata to: %s", path)
+		if err := ioutil.WriteFile(path, data, os.FileMode(filePermission)); err != nil {
+			return err
+		}
 		dm.m.Lock()
-		dls := len(dm.paths)
-		if dls != 0 {
-			res = dm.progress.String() + " | Last: " + filepath.Base(dm.paths[len(dm.paths)-1])
+		dm.paths = []string{path}
+		dm.m.Unlock()
+		return nil
+	}()
+
+	log.Info("Cleaning up...")
+	dm.plugin.Cleanup(err)
+	return dm.paths, err
+}
+
+// The number of files that are pages, i.e. everything but covers.
+func countPages(paths []string) int {
+	var res int
+	for _, path := range paths {
+		if !IsCover(path) {
+			res++
+		}
+	}
+
+	return res
+}
+
+// Write the metadata to every top-level directory we downloaded to.
+func (dm *DownloadManager) writeMetadata(md *Metadata) error {
+	if md == nil {
+		return nil
+	}
+
+	dm.m.Lock()
+	defer dm.m.Unlock()
+	pages := make(map[string]int)
+	order := make([]string, 0, 1)
+	for _, file := range dm.paths {
+		dir, _ := dm.splitTopDirectory(file)
+		if _, ok := pages[dir]; !ok {
+			order = append(order, dir)
+			pages[dir] = 0
+		}
+		if !IsCover(file) {
+			pages[dir]++
+		}
+	}
+
+	for _, dir := range order {
+		data, err := md.ComicInfo(pages[dir])
+		if err != nil {
+			return err
+		}
+
+		path := filepath.Join(dm.directory, dir, comicInfoFile)
+		log.Debugf("Writing metadata to: %s", path)
+		if dm.stream != nil {
+			err = dm.stream.Add(filepath.Join(dir, comicInfoFile), bytes.NewReader(data))
 		} else {
-			res = dm.progress.String()
+			err = ioutil.WriteFile(path, data, os.FileMode(filePermission))
 		}
+		if err != nil {
+			return err
+		}
+		dm.paths = append(dm.paths, path)
+	}
+
+	return nil
+}
+
+// How often the spawner checks if the slow start allows another worker.
+const slowStartPoll = 100 * time.Millisecond
+
+// Get the number of workers the slow start allows after the time elapsed since
+// the download started, going linearly from one to the maximum.
+func (dm *DownloadManager) slowStartWorkers(elapsed time.Duration, maxWorkers int) int {
+	if dm.slowStart <= 0 || elapsed >= dm.slowStart {
+		return maxWorkers
+	}
+
+	return 1 + int(float64(maxWorkers-1)*float64(elapsed)/float64(dm.slowStart))
+}
+
+// Get the function the reporters use to rename the paths they're given, if any.
+func (dm *DownloadManager) renamer() func(string) string {
+	if !dm.asciiNames {
+		if dm.namer != nil {
+			return dm.namer.Rename
+		}
+		return nil
+	}
+
+	return func(p string) string {
+		renamed := asciiPath(p)
+		// Paths given by plugins are relative and always have a top-level directory.
+		orig := strings.SplitN(filepath.ToSlash(p), "/", 2)[0]
+		dir := strings.SplitN(filepath.ToSlash(renamed), "/", 2)[0]
+		dm.m.Lock()
+		if dm.originals == nil {
+			dm.originals = make(map[string]string)
+		}
+		dm.originals[dir] = orig
 		dm.m.Unlock()
+		if dm.namer != nil {
+			return dm.namer.Rename(renamed)
+		}
+		return renamed
+	}
+}
+
+// With --ascii-names, the plugin's title would only survive as the romanized
+// directory name, so keep the original in the metadata if the plugin has none.
+// Returns nil if there's no single directory that got renamed.
+func (dm *DownloadManager) originalNameMetadata() *Metadata {
+	dm.m.Lock()
+	defer dm.m.Unlock()
+	if len(dm.originals) != 1 {
+		return nil
+	}
+	for dir, orig := range dm.originals {
+		if dir != orig {
+			return &Metadata{Title: orig}
+		}
+	}
+
+	return nil
+}
+
+// The name of the file written to each top-level directory with --volume-log.
+const volumeLogFile = "mindl.log"
+
+// Keep track of the top-level directory of the file for writeVolumeLog().
+// Has to be called with the lock held.
+func (dm *DownloadManager) addVolumeDir(path string) {
+	dir, _ := dm.splitTopDirectory(path)
+	for _, d := range dm.volumeDirs {
+		if d == dir {
+			return
+		}
+	}
+	dm.volumeDirs = append(dm.volumeDirs, dir)
+}
+
+// Write the log of the download to each top-level directory it wrote to. If a
+// directory is gone because it was zipped or flattened, the log is put next to
+// where it was instead. Failing to write it isn't worth failing the download over.
+func (dm *DownloadManager) writeVolumeLog(data []byte) {
+	dm.m.Lock()
+	dirs := dm.volumeDirs
+	dm.m.Unlock()
+	if len(dirs) == 0 {
+		log.Warn("Nothing was saved, so there's no directory to write the log to.")
+		return
+	}
+
+	for _, dir := range dirs {
+		path := filepath.Join(dm.directory, dir+".log")
+		if info, err := os.Stat(filepath.Join(dm.directory, dir)); err == nil && info.IsDir() {
+			path = filepath.Join(dm.directory, dir, volumeLogFile)
+		}
+		if err := ioutil.WriteFile(path, data, os.FileMode(filePermission)); err != nil {
+			log.Warnf("Failed to write the log to %s: %s", path, err)
+		} else {
+			log.Infof("Wrote the log of the download to: %s", path)
+		}
+	}
+}
+
+// A bytes.Buffer that's safe to write to from multiple goroutines.
+type lockedBuffer struct {
+	buf bytes.Buffer
+	m   sync.Mutex
+}
+
+func (lb *lockedBuffer) Write(p []byte) (int, error) {
+	lb.m.Lock()
+	defer lb.m.Unlock()
+	return lb.buf.Write(p)
+}
+
+func (lb *lockedBuffer) Bytes() []byte {
+	lb.m.Lock()
+	defer lb.m.Unlock()
+	return lb.buf.Bytes()
+}
+
+// Get a string representing the progress if the observer can provide one.
+func (dm *DownloadManager) ProgressString() string {
+	if s, ok := dm.Observer.(fmt.Stringer); ok {
+		return s.String()
+	}
+
+	return ""
+}
+
+// Get a compact one-line summary of the progress if the observer can provide one.
+func (dm *DownloadManager) ProgressSummary() string {
+	if s, ok := dm.Observer.(interface {
+		Summary() string
+	}); ok {
+		return s.Summary()
+	}
+
+	return ""
+}
+
+// Split a list of files into parts whose total size doesn't exceed the split size.
+// A file is never split, so a part can still exceed it if a single file does.
+func (dm *DownloadManager) splitFiles(root string, files []string) ([][]string, error) {
+	if dm.splitSize <= 0 {
+		return [][]string{files}, nil
+	}
+
+	res := make([][]string, 0, 1)
+	var part []string
+	var size int64
+	for _, file := range files {
+		info, err := os.Stat(filepath.Join(root, file))
+		if err != nil {
+			return nil, err
+		}
+
+		if len(part) != 0 && size+info.Size() > dm.splitSize {
+			res = append(res, part)
+			part = nil
+			size = 0
+		}
+		part = append(part, file)
+		size += info.Size()
+	}
+
+	return append(res, part), nil
+}
+
+// Zip the files, given as paths relative to root, into a new archive at path.
+// If modified isn't zero, every entry gets it as its modification time.
+// The archive is written to a temporary file that's renamed once it's complete,
+// so that an error or an interrupt never leaves a corrupt archive behind.
+func zipFiles(path, root string, files []string, modified time.Time) (err error) {
+	tmp := path + ".tmp"
+	outf, err := createFile(tmp)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			outf.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	zipf := zip.NewWriter(outf)
+	for _, file := range files {
+		select {
+		case <-interrupt:
+			log.Info("Interrupted! Discarding the incomplete archive...")
+			return ErrInterrupted
+		default:
+		}
+
+		log.Debugf("  Zipping file: %s", file)
+		fw, err := zipf.CreateHeader(zipHeader(file, modified))
+		if err != nil {
+			return err
+		}
+
+		fr, err := os.Open(filepath.Join(root, file))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(fw, fr)
+		fr.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := zipf.Close(); err != nil {
+		return err
+	} else if err := outf.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// Make the header of a file in an archive. The modification time is only set if non-zero.
+func zipHeader(name string, modified time.Time) *zip.FileHeader {
+	header := &zip.FileHeader{Name: filepath.ToSlash(name), Method: zip.Deflate}
+	// The header flag 0x800 indicates UTF-8 filenames, albeit not supported everywhere,
+	// and some old extractors misbehave with it, so only set it if it matters.
+	if !isASCII(header.Name) {
+		header.Flags |= 0x800
+	}
+	if !modified.IsZero() {
+		header.Modified = modified
+	}
+
+	return header
+}
+
+// Whether or not the string only has ASCII characters.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Split the path of a downloaded file into its top-level directory and the rest of
+// the path relative to it. A top-level directory is guaranteed by DownloadReporter.
+// Uses filepath.Rel() rather than trimming the prefix so that it works regardless
+// of whether or not the download directory ends with a separator or is cleaned.
+func (dm *DownloadManager) splitTopDirectory(path string) (dir, rest string) {
+	rel, err := filepath.Rel(dm.directory, path)
+	if err != nil {
+		rel = strings.TrimPrefix(path, dm.directory)
+	}
+
+	split := strings.SplitN(rel, string(os.PathSeparator), 2)
+	if len(split) < 2 {
+		return split[0], ""
+	}
+
+	return split[0], split[1]
+}
+
+// The default template for archive names.
+const defaultArchiveTemplate = "{dir}.zip"
+
+// Get the file name of the archive for a top-level directory using the archive template.
+// The placeholders are {dir}, {title}, {series} and {volume}, where the metadata ones
+// fall back to the directory name (or in the case of {volume}, nothing) if unknown.
+func (dm *DownloadManager) archiveName(dir string) string {
+	template := dm.archiveTemplate
+	if template == "" {
+		template = defaultArchiveTemplate
+	}
+
+	// Every volume of a series is zipped from the same directory.
+	if dm.namer != nil && dm.zipVolumes && !strings.Contains(template, "{volume}") {
+		ext := filepath.Ext(template)
+		template = fmt.Sprintf("%s v%02d%s", strings.TrimSuffix(template, ext), dm.namer.Volume(), ext)
+	}
+
+	title, series, volume := dir, dir, ""
+	if md := dm.metadata; md != nil {
+		if md.Title != "" {
+			title, series = md.Title, md.Title
+		}
+		if md.Series != "" {
+			series = md.Series
+		}
+		volume = md.Volume
+	}
+
+	name := strings.NewReplacer(
+		"{dir}", dir,
+		"{title}", title,
+		"{series}", series,
+		"{volume}", volume,
+	).Replace(template)
+	if name = SanitizeFilename(name); dm.asciiNames {
+		name = asciiName(name)
+	}
+	if filepath.Ext(name) == "" {
+		name += ".zip"
+	}
+
+	return name
+}
+
+// Append a counter to the path if it's taken, either by an existing
+// file or by one of the given paths we're about to create.
+func uniquePath(path string, taken []string) string {
+	isTaken := func(p string) bool {
+		for _, t := range taken {
+			if t == p {
+				return true
+			}
+		}
+		_, err := os.Stat(p)
+		return err == nil
+	}
+
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	res := path
+	for i := 2; isTaken(res); i++ {
+		res = fmt.Sprintf("%s (%d)%s", base, i, ext)
 	}
 
 	return res
 }
 
+// Make a streamer for the download if we're zipping and streaming was asked for,
+// unless something needs the files on disk after the download, which it warns about.
+func (dm *DownloadManager) zipStreamer(zipit bool) *ZipStreamer {
+	if !zipit || !dm.streamZip {
+		return nil
+	}
+
+	var reason string
+	switch {
+	case dm.splitSize > 0:
+		reason = "splitting archives"
+	case dm.dedup:
+		reason = "removing duplicates"
+	case dm.contactSheet:
+		reason = "contact sheets"
+	case dm.namer != nil:
+		reason = "series directories"
+	default:
+		return NewZipStreamer(dm.directory, dm.zipTime)
+	}
+
+	log.Warnf("Can't stream files to the archives with %s. Zipping them after the download instead.", reason)
+	return nil
+}
+
 // Zip top-level directories separately, then delete the directories after doing so if desired.
 func (dm *DownloadManager) ZipDownloads(deleteAfter bool) ([]string, error) {
 	// We zip every top-level directory separately.
 	files := make(map[string][]string) // files[topdir] = file
 	dm.m.Lock()
 	for _, file := range dm.paths {
-		split := strings.Split(strings.TrimPrefix(file, dm.directory), string(os.PathSeparator))
-		// len(split) >= 2 is guaranteed by DownloadReporter.
-		files[split[0]] = append(files[split[0]], strings.Join(split[1:], string(os.PathSeparator)))
+		dir, rest := dm.splitTopDirectory(file)
+		files[dir] = append(files[dir], rest)
 	}
 	dm.m.Unlock()
 
 	res := make([]string, 0, len(files))
 	for dir, filelist := range files {
-		path := filepath.Join(dm.directory, dir+".zip")
-		log.Infof("Zipping files to: %s", filepath.Base(path))
-		res = append(res, dir)
-		outf, err := os.Create(path)
+		// Files are added in the order they finished downloading, so sort them to
+		// make sure pages are in order, which also matters when splitting.
+		sort.Strings(filelist)
+		parts, err := dm.splitFiles(filepath.Join(dm.directory, dir), filelist)
 		if err != nil {
 			return nil, err
 		}
 
-		zipf := zip.NewWriter(outf)
-		for _, file := range filelist {
-			log.Debugf("  Zipping file: %s", file)
-			// The header flag 0x800 will indicate UTF-8 filenames, albeit not supported everywhere.
-			header := &zip.FileHeader{Name: filepath.ToSlash(file), Method: zip.Deflate, Flags: 0x800}
-			fw, err := zipf.CreateHeader(header)
-			if err != nil {
-				return nil, err
-			}
-
-			fr, err := os.Open(filepath.Join(dm.directory, dir, file))
-			if err != nil {
-				return nil, err
+		name := dm.archiveName(dir)
+		ext := filepath.Ext(name)
+		for i, part := range parts {
+			var path string
+			if len(parts) == 1 {
+				path = filepath.Join(dm.directory, name)
+			} else {
+				path = filepath.Join(dm.directory, fmt.Sprintf("%s.part%02d%s", strings.TrimSuffix(name, ext), i+1, ext))
 			}
-			io.Copy(fw, fr)
-			if err := fr.Close(); err != nil {
+			path = uniquePath(path, res)
+			log.Infof("Zipping files to: %s", filepath.Base(path))
+			if err := zipFiles(path, filepath.Join(dm.directory, dir), part, dm.zipTime); err != nil {
 				return nil, err
 			}
-		}
-
-		if err := zipf.Close(); err != nil {
-			return nil, err
-		}
-		if err := outf.Close(); err != nil {
-			return nil, err
+			res = append(res, path)
 		}
 	}
 
@@ -556,3 +1656,115 @@ func (dm *DownloadManager) ZipDownloads(deleteAfter bool) ([]string, error) {
 
 	return res, nil
 }
+
+// Zip the files of the current volume of a series, then delete them along with
+// the series directory if nothing else is left in it. Unlike ZipDownloads(), the
+// rest of the series directory is kept, since other volumes could be in it.
+func (dm *DownloadManager) zipVolume() ([]string, error) {
+	archives, err := dm.ZipDownloads(false)
+	if err != nil {
+		return archives, err
+	}
+
+	dm.m.Lock()
+	defer dm.m.Unlock()
+	dirs := make(map[string]bool)
+	for _, path := range dm.paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return archives, err
+		}
+		for dir := filepath.Dir(path); dir != filepath.Clean(dm.directory) && dir != "."; dir = filepath.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+	// Deepest first, and only if they're empty.
+	sorted := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		sorted = append(sorted, dir)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(sorted)))
+	for _, dir := range sorted {
+		os.Remove(dir)
+	}
+
+	return archives, nil
+}
+
+// Zip the series directory once every volume has been downloaded to it. Files
+// that were already in it are zipped too, since they're part of the series.
+// Does nothing if each volume was zipped as soon as it was downloaded.
+func (dm *DownloadManager) ZipSeries() ([]string, error) {
+	if dm.namer == nil || dm.zipVolumes {
+		return nil, nil
+	}
+
+	var paths []string
+	root := filepath.Join(dm.directory, dm.namer.Dir)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			paths = append(paths, path)
+		}
+		return err
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Named after the series rather than the last volume.
+	series := dm.namer.Dir
+	if dm.metadata != nil && dm.metadata.Series != "" {
+		series = dm.metadata.Series
+	}
+	dm.m.Lock()
+	dm.paths = paths
+	dm.metadata = &Metadata{Title: dm.namer.Dir, Series: series}
+	dm.m.Unlock()
+	return dm.ZipDownloads(true)
+}
+
+// If everything was downloaded to a single top-level directory, move its contents
+// into the download directory and delete it. Nothing is moved if any of them would
+// overwrite an existing file.
+func (dm *DownloadManager) flattenDownloads() error {
+	dm.m.Lock()
+	defer dm.m.Unlock()
+	dirs := make(map[string]bool)
+	for _, path := range dm.paths {
+		dir, _ := dm.splitTopDirectory(path)
+		dirs[dir] = true
+	}
+	if len(dirs) != 1 {
+		return nil
+	}
+
+	var dir string
+	for d := range dirs {
+		dir = d
+	}
+	top := filepath.Join(dm.directory, dir)
+	entries, err := ioutil.ReadDir(top)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if _, err := os.Stat(filepath.Join(dm.directory, e.Name())); err == nil {
+			log.Warnf("Not flattening '%s', since '%s' already exists in the download directory.", dir, e.Name())
+			return nil
+		}
+	}
+
+	log.Debugf("Moving the contents of '%s' to the download directory...", top)
+	for _, e := range entries {
+		if err := os.Rename(filepath.Join(top, e.Name()), filepath.Join(dm.directory, e.Name())); err != nil {
+			return err
+		}
+	}
+	for i, path := range dm.paths {
+		_, rest := dm.splitTopDirectory(path)
+		dm.paths[i] = filepath.Join(dm.directory, rest)
+	}
+
+	return os.Remove(top)
+}
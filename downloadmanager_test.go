@@ -0,0 +1,434 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/MinoMino/mindl/plugins"
+	"github.com/MinoMino/mindl/plugins/dummy"
+)
+
+func TestCopySizedShortRead(t *testing.T) {
+	dr := &DownloadReporter{reportCallback: func([]byte) error { return nil }}
+	var buf bytes.Buffer
+	// A reader that ends early without an error, like a connection closed by the server.
+	n, err := dr.CopySized(&buf, bytes.NewReader(make([]byte, 100)), 150)
+	if err == nil {
+		t.Error("Expected an error when getting fewer bytes than the expected size.")
+	} else if n != 100 {
+		t.Errorf("Expected 100 bytes written, got %d.", n)
+	}
+
+	buf.Reset()
+	if _, err := dr.CopySized(&buf, bytes.NewReader(make([]byte, 150)), 150); err != nil {
+		t.Errorf("Expected no error when getting the expected size, got: %s", err)
+	}
+	// Unknown sizes can't be checked.
+	if _, err := dr.CopySized(&buf, bytes.NewReader(make([]byte, 100)), 0); err != nil {
+		t.Errorf("Expected no error when the size is unknown, got: %s", err)
+	}
+}
+
+func TestCopySizedConcurrent(t *testing.T) {
+	var adds []bool
+	called := make(chan struct{}, 3)
+	dr := &DownloadReporter{
+		reportCallback: func([]byte) error { return nil },
+		sizeCallback: func(size int64, add bool) {
+			adds = append(adds, add)
+			called <- struct{}{}
+		},
+	}
+
+	// The first copy is still going when the second one starts, like two
+	// parts of a page downloaded at once.
+	pr, pw := io.Pipe()
+	first := make(chan error)
+	go func() {
+		_, err := dr.CopySized(ioutil.Discard, pr, 10)
+		first <- err
+	}()
+	<-called
+	if _, err := dr.CopySized(ioutil.Discard, bytes.NewReader(make([]byte, 20)), 20); err != nil {
+		t.Fatal(err)
+	}
+	pw.Write(make([]byte, 10))
+	pw.Close()
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+	// Nothing else is being received by then.
+	if _, err := dr.CopySized(ioutil.Discard, bytes.NewReader(make([]byte, 30)), 30); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []bool{false, true, false}; !reflect.DeepEqual(adds, expected) {
+		t.Errorf("Expected the sizes to be added as %v, got %v.", expected, adds)
+	}
+}
+
+func TestSaveDataSizedShortRead(t *testing.T) {
+	root, err := ioutil.TempDir("", "mindl-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	saved := make(chan string, 1)
+	dr := &DownloadReporter{saved: saved, dstdir: root, reportCallback: func([]byte) error { return nil }}
+	if _, err := dr.SaveDataSized(filepath.Join("a", "0001.bin"), bytes.NewReader(make([]byte, 100)), 150, true); err == nil {
+		t.Error("Expected an error when getting fewer bytes than the expected size.")
+	}
+	select {
+	case path := <-saved:
+		t.Errorf("The truncated file was reported as saved: %s", path)
+	default:
+	}
+}
+
+func TestDownloadResumableShortBody(t *testing.T) {
+	root, err := ioutil.TempDir("", "mindl-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// Cuts the body short, like a connection dropped mid-download.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "200")
+		w.Write(make([]byte, 100))
+	}))
+	defer srv.Close()
+
+	saved := make(chan string, 1)
+	dr := &DownloadReporter{saved: saved, dstdir: root, reportCallback: func([]byte) error { return nil }}
+	dst := filepath.Join("a", "file.bin")
+	if _, err := DownloadResumable(srv.Client(), srv.URL, dr, dst); err == nil {
+		t.Error("Expected an error when the body is cut short.")
+	}
+	select {
+	case path := <-saved:
+		t.Errorf("The partial file was reported as saved: %s", path)
+	default:
+	}
+	// What we got is kept to resume from.
+	if size, err := dr.PartialSize(dst); err != nil {
+		t.Error(err)
+	} else if size != 100 {
+		t.Errorf("Expected 100 bytes kept to resume from, got %d.", size)
+	}
+}
+
+func TestSplitTopDirectory(t *testing.T) {
+	sep := string(filepath.Separator)
+	tests := []struct {
+		directory, path string
+		dir, rest       string
+	}{
+		{"downloads", filepath.Join("downloads", "a", "0001.jpg"), "a", "0001.jpg"},
+		{"downloads" + sep, filepath.Join("downloads", "a", "0001.jpg"), "a", "0001.jpg"},
+		{"downloads", filepath.Join("downloads", "b", "sub", "0001.jpg"), "b", filepath.Join("sub", "0001.jpg")},
+		{"downloads" + sep, filepath.Join("downloads", "b", "sub", "0001.jpg"), "b", filepath.Join("sub", "0001.jpg")},
+		{filepath.Join(".", "downloads"), filepath.Join("downloads", "c", "0002.png"), "c", "0002.png"},
+		{"downloads", filepath.Join("downloads", "d"), "d", ""},
+	}
+
+	for _, test := range tests {
+		dm := &DownloadManager{directory: test.directory}
+		dir, rest := dm.splitTopDirectory(test.path)
+		if dir != test.dir || rest != test.rest {
+			t.Errorf("splitTopDirectory(%q) with directory %q = (%q, %q), expected (%q, %q).",
+				test.path, test.directory, dir, rest, test.dir, test.rest)
+		}
+	}
+}
+
+func TestZipDownloads(t *testing.T) {
+	files := map[string][]string{
+		"a": {"0001.jpg", "0002.jpg"},
+		"b": {"0001.jpg", filepath.Join("extra", "cover.jpg")},
+		"c": {"0001.png"},
+	}
+
+	for _, trailing := range []bool{false, true} {
+		root, err := ioutil.TempDir("", "mindl-test-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(root)
+
+		dm := &DownloadManager{directory: root}
+		if trailing {
+			dm.directory += string(filepath.Separator)
+		}
+		for dir, names := range files {
+			for _, name := range names {
+				path := filepath.Join(root, dir, name)
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				} else if err := ioutil.WriteFile(path, []byte(name), 0644); err != nil {
+					t.Fatal(err)
+				}
+				dm.paths = append(dm.paths, path)
+			}
+		}
+
+		archives, err := dm.ZipDownloads(true)
+		if err != nil {
+			t.Fatalf("Trailing separator %v: %s", trailing, err)
+		} else if len(archives) != len(files) {
+			t.Fatalf("Trailing separator %v: expected %d archives, got %d: %v", trailing, len(files), len(archives), archives)
+		}
+		for dir, names := range files {
+			path := filepath.Join(root, dir+".zip")
+			zr, err := zip.OpenReader(path)
+			if err != nil {
+				t.Errorf("Trailing separator %v: %s", trailing, err)
+				continue
+			}
+			var got, expected []string
+			for _, f := range zr.File {
+				got = append(got, f.Name)
+			}
+			zr.Close()
+			for _, name := range names {
+				expected = append(expected, filepath.ToSlash(name))
+			}
+			sort.Strings(got)
+			sort.Strings(expected)
+			if !reflect.DeepEqual(got, expected) {
+				t.Errorf("Trailing separator %v: %s has entries %v, expected %v.", trailing, filepath.Base(path), got, expected)
+			}
+			if _, err := os.Stat(filepath.Join(root, dir)); !os.IsNotExist(err) {
+				t.Errorf("Trailing separator %v: '%s' was not deleted after zipping.", trailing, dir)
+			}
+		}
+	}
+}
+
+func TestWriteMetadataCover(t *testing.T) {
+	root, err := ioutil.TempDir("", "mindl-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := os.MkdirAll(filepath.Join(root, "Title"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Covers saved with --save-cover aren't pages.
+	dm := &DownloadManager{directory: root}
+	for _, name := range []string{"0001.jpg", CoverFilename, "0002.jpg"} {
+		dm.paths = append(dm.paths, filepath.Join(root, "Title", name))
+	}
+	if n := countPages(dm.paths); n != 2 {
+		t.Errorf("Expected 2 pages, got %d.", n)
+	}
+	if err := dm.writeMetadata(&Metadata{Title: "Title"}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(root, "Title", comicInfoFile))
+	if err != nil {
+		t.Fatal(err)
+	} else if !strings.Contains(string(data), "<PageCount>2</PageCount>") {
+		t.Errorf("Expected a page count of 2 in:\n%s", data)
+	}
+}
+
+func TestDownloadSeriesZip(t *testing.T) {
+	tests := []struct {
+		zipVolumes bool
+		archives   map[string]int
+	}{
+		{false, map[string]int{"Series.zip": 6}},
+		{true, map[string]int{"Series v01.zip": 3, "Series v02.zip": 3}},
+	}
+
+	for _, test := range tests {
+		root, err := ioutil.TempDir("", "mindl-test-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(root)
+		setDummyOptions(t, map[string]string{"FailAt": "-1", "PanicAt": "-1", "Delay": "0"})
+
+		namer := NewSeriesNamer("Series", PrefixVolume)
+		var dm *DownloadManager
+		for i := 0; i < 2; i++ {
+			if dm, err = NewDownloadManager(&dummy.Plugin, root); err != nil {
+				t.Fatal(err)
+			}
+			dm.namer, dm.zipVolumes = namer, test.zipVolumes
+			if _, err := dm.Download("dummy://3", 2, true, false); err != nil {
+				t.Fatalf("Zip volumes %v: %s", test.zipVolumes, err)
+			}
+			namer.NextVolume()
+		}
+		if _, err := dm.ZipSeries(); err != nil {
+			t.Fatalf("Zip volumes %v: %s", test.zipVolumes, err)
+		}
+
+		entries, _ := ioutil.ReadDir(root)
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		if len(names) != len(test.archives) {
+			t.Errorf("Zip volumes %v: expected only the archives %v, found %v.", test.zipVolumes, test.archives, names)
+			continue
+		}
+		for name, files := range test.archives {
+			var bins int
+			for _, entry := range zipEntries(t, filepath.Join(root, name)) {
+				if filepath.Ext(entry) == ".bin" {
+					bins++
+				}
+			}
+			if bins != files {
+				t.Errorf("Zip volumes %v: expected %d files in %s, got %d.", test.zipVolumes, files, name, bins)
+			}
+		}
+	}
+}
+
+// Wraps a plugin to record its Cleanup() calls and how many of its
+// downloaders were still running when they were made.
+type cleanupRecorder struct {
+	Plugin
+	running int64
+	errs    []error
+	left    []int64
+	m       sync.Mutex
+}
+
+func (cr *cleanupRecorder) DownloadGenerator(url string) (func() Downloader, int) {
+	dlgen, length := cr.Plugin.DownloadGenerator(url)
+	return func() Downloader {
+		dl := dlgen()
+		if dl == nil {
+			return nil
+		}
+		return func(n int, rep Reporter) error {
+			atomic.AddInt64(&cr.running, 1)
+			defer atomic.AddInt64(&cr.running, -1)
+			return dl(n, rep)
+		}
+	}, length
+}
+
+func (cr *cleanupRecorder) Cleanup(err error) {
+	cr.m.Lock()
+	cr.errs = append(cr.errs, err)
+	cr.left = append(cr.left, atomic.LoadInt64(&cr.running))
+	cr.m.Unlock()
+	cr.Plugin.Cleanup(err)
+}
+
+// Set the options of the dummy plugin until the test is done.
+func setDummyOptions(t *testing.T, values map[string]string) {
+	for _, opt := range dummy.Plugin.Options() {
+		if v, ok := values[opt.Key()]; ok {
+			old := opt.Value()
+			if err := opt.Set(v); err != nil {
+				t.Fatal(err)
+			}
+			opt := opt
+			t.Cleanup(func() { opt.(*IntOption).V = old.(int) })
+		}
+	}
+}
+
+// Wait for the number of goroutines to go back down to what it was, since
+// goroutines that are done can take a moment to actually exit.
+func checkGoroutines(t *testing.T, name string, before int) {
+	n := runtime.NumGoroutine()
+	for i := 0; i < 200 && n > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+		n = runtime.NumGoroutine()
+	}
+	if n > before {
+		buf := make([]byte, 1<<16)
+		t.Errorf("%s: %d goroutines leaked:\n%s", name, n-before, buf[:runtime.Stack(buf, true)])
+	}
+}
+
+func TestDownloadFailingWorker(t *testing.T) {
+	tests := []struct {
+		name      string
+		options   map[string]string
+		errSubstr string
+	}{
+		{"error", map[string]string{"FailAt": "2"}, "Download #2 failed on purpose."},
+		{"panic", map[string]string{"PanicAt": "2"}, "Worker #2 panicked: Download #2 panicked on purpose."},
+		{"first", map[string]string{"FailAt": "0"}, "Download #0 failed on purpose."},
+	}
+
+	for _, test := range tests {
+		root, err := ioutil.TempDir("", "mindl-test-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(root)
+		setDummyOptions(t, map[string]string{"FailAt": "-1", "PanicAt": "-1", "Delay": "5"})
+		setDummyOptions(t, test.options)
+
+		before := runtime.NumGoroutine()
+		cr := &cleanupRecorder{Plugin: &dummy.Plugin}
+		dm, err := NewDownloadManager(cr, root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = dm.Download("dummy://20", 4, false, false)
+		if err == nil || !strings.Contains(err.Error(), test.errSubstr) {
+			t.Errorf("%s: expected the error %q, got: %v", test.name, test.errSubstr, err)
+		}
+		if len(cr.errs) != 1 || cr.errs[0] != err {
+			t.Errorf("%s: expected a single Cleanup() with the error, got: %v", test.name, cr.errs)
+		} else if cr.left[0] != 0 {
+			t.Errorf("%s: %d downloaders were still running when cleaning up.", test.name, cr.left[0])
+		}
+		checkGoroutines(t, test.name, before)
+	}
+}
+
+func TestDownloadInterrupted(t *testing.T) {
+	root, err := ioutil.TempDir("", "mindl-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	setDummyOptions(t, map[string]string{"FailAt": "-1", "PanicAt": "-1", "Delay": "50"})
+
+	before := runtime.NumGoroutine()
+	cr := &cleanupRecorder{Plugin: &dummy.Plugin}
+	dm, err := NewDownloadManager(cr, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		interrupt <- os.Interrupt
+	}()
+	if _, err = dm.Download("dummy://50", 4, false, false); err != ErrInterrupted {
+		t.Errorf("Expected ErrInterrupted, got: %v", err)
+	}
+	if len(cr.errs) != 1 || cr.errs[0] != ErrInterrupted {
+		t.Errorf("Expected a single Cleanup() with ErrInterrupted, got: %v", cr.errs)
+	}
+	// The workers still running are woken up from their sleep and stop.
+	checkGoroutines(t, "interrupted", before)
+}
@@ -2,7 +2,9 @@ package logger
 
 import (
 	"fmt"
+	"io"
 	"os"
+	"sync"
 
 	log "github.com/MinoMino/logrus"
 	lcf "github.com/MinoMino/logrus-custom-formatter"
@@ -25,6 +27,69 @@ func (std *stdoutReferer) Write(p []byte) (int, error) {
 
 type Fields map[string]interface{}
 
+// A hook that calls the function set with OnProblem() whenever
+// a warning or anything more severe is logged.
+type problemHook struct {
+	callback func(isError bool)
+	m        sync.Mutex
+}
+
+func (ph *problemHook) Levels() []log.Level {
+	return []log.Level{log.PanicLevel, log.FatalLevel, log.ErrorLevel, log.WarnLevel}
+}
+
+func (ph *problemHook) Fire(e *log.Entry) error {
+	ph.m.Lock()
+	cb := ph.callback
+	ph.m.Unlock()
+	if cb != nil {
+		cb(e.Level != log.WarnLevel)
+	}
+
+	return nil
+}
+
+var problems = &problemHook{}
+
+// A hook that also writes every entry to the writer set with Tee(),
+// formatted the same way as they are on stdout.
+type teeHook struct {
+	w         io.Writer
+	formatter log.Formatter
+	m         sync.Mutex
+}
+
+func (th *teeHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (th *teeHook) Fire(e *log.Entry) error {
+	th.m.Lock()
+	defer th.m.Unlock()
+	if th.w == nil {
+		return nil
+	}
+
+	b, err := th.formatter.Format(e)
+	if err != nil {
+		return err
+	}
+	_, err = th.w.Write(b)
+	return err
+}
+
+var tee = &teeHook{}
+
+// The formatter used both for stdout and the tee.
+var formatter *lcf.CustomFormatter
+
+// A tag put before the name of every entry, to tell apart the logs of different
+// URLs when downloading several. Set with SetTag().
+var (
+	tag  string
+	tagM sync.RWMutex
+)
+
 func init() {
 	NameHandler := func(e *log.Entry, f *lcf.CustomFormatter) (interface{}, error) {
 		if n, ok := e.Data["name"]; ok {
@@ -33,13 +98,57 @@ func init() {
 
 		return "", nil
 	}
+	TagHandler := func(e *log.Entry, f *lcf.CustomFormatter) (interface{}, error) {
+		tagM.RLock()
+		defer tagM.RUnlock()
+		if tag != "" {
+			return fmt.Sprintf("<%s> ", tag), nil
+		}
+
+		return "", nil
+	}
 
 	std := &stdoutReferer{&os.Stdout}
 	log.SetOutput(std)
-	templ := "(%[ascTime]s %[shortLevelName]s) %[name]s%-45[message]s%[fields]s\n"
-	formatter := lcf.NewFormatter(templ, lcf.CustomHandlers{"name": NameHandler})
+	templ := "(%[ascTime]s %[shortLevelName]s) %[tag]s%[name]s%-45[message]s%[fields]s\n"
+	formatter = lcf.NewFormatter(templ, lcf.CustomHandlers{"name": NameHandler, "tag": TagHandler})
 	formatter.TimestampFormat = "15:04:05"
 	log.SetFormatter(formatter)
+	log.AddHook(problems)
+	tee.formatter = formatter
+	log.AddHook(tee)
+}
+
+// Call the function whenever a warning or an error is logged, so that problems
+// can be made harder to miss. It's called before the entry is written and must
+// not log anything itself. nil stops calling the previous function.
+func OnProblem(fn func(isError bool)) {
+	problems.m.Lock()
+	problems.callback = fn
+	problems.m.Unlock()
+}
+
+// Also write everything logged from now on to the writer, e.g. to keep a
+// log of a single download. nil stops writing to the previous one.
+func Tee(w io.Writer) {
+	tee.m.Lock()
+	tee.w = w
+	tee.m.Unlock()
+}
+
+// Tag everything logged from now on, e.g. with the index of the URL being
+// downloaded. An empty tag stops tagging.
+func SetTag(t string) {
+	tagM.Lock()
+	tag = t
+	tagM.Unlock()
+}
+
+// Whether or not to sort the fields of each entry by key, which is the default.
+// Not sorting saves a bit of time when logging a lot, at the cost of fields
+// showing up in a random order.
+func SortFields(enable bool) {
+	formatter.DisableSorting = !enable
 }
 
 func Verbose(enable bool) {
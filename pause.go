@@ -0,0 +1,133 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Lines read from stdin. Everything that reads from stdin should go through
+// readLine(), so that a line meant for a prompt isn't swallowed by the pause
+// listener or vice versa.
+var (
+	stdinLines = make(chan string)
+	stdinOnce  sync.Once
+)
+
+// Start reading lines from stdin into stdinLines if we haven't already.
+func startStdinReader() {
+	stdinOnce.Do(func() {
+		go func() {
+			s := bufio.NewScanner(os.Stdin)
+			for s.Scan() {
+				stdinLines <- strings.TrimRight(s.Text(), "\r")
+			}
+			close(stdinLines)
+		}()
+	})
+}
+
+// Read a line from stdin without the line ending. Returns false on EOF.
+func readLine() (string, bool) {
+	startStdinReader()
+	line, ok := <-stdinLines
+	return line, ok
+}
+
+// Blocks writes while paused. Since every write done through a DownloadReporter
+// waits on it, pausing stops workers before they write their next chunk, which
+// in turn stops them from reading from the network.
+type Pauser struct {
+	paused bool
+	cond   *sync.Cond
+}
+
+func NewPauser() *Pauser {
+	return &Pauser{cond: sync.NewCond(&sync.Mutex{})}
+}
+
+// Block until not paused. Does nothing on a nil Pauser.
+func (p *Pauser) Wait() {
+	if p == nil {
+		return
+	}
+
+	p.cond.L.Lock()
+	for p.paused {
+		p.cond.Wait()
+	}
+	p.cond.L.Unlock()
+}
+
+// Pause if running, resume if paused. Returns whether or not we're now paused.
+func (p *Pauser) Toggle() bool {
+	p.cond.L.Lock()
+	defer p.cond.L.Unlock()
+	p.paused = !p.paused
+	if !p.paused {
+		p.cond.Broadcast()
+	}
+
+	return p.paused
+}
+
+func (p *Pauser) Paused() bool {
+	if p == nil {
+		return false
+	}
+
+	p.cond.L.Lock()
+	defer p.cond.L.Unlock()
+	return p.paused
+}
+
+// Toggle the pauser whenever the user enters "p" until the returned function is called.
+// Always resumes when stopped so that nothing is left blocked.
+func listenForPause(p *Pauser) (stop func()) {
+	startStdinReader()
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case line, ok := <-stdinLines:
+				if !ok {
+					return
+				} else if strings.ToLower(strings.TrimSpace(line)) != "p" {
+					continue
+				}
+
+				if p.Toggle() {
+					log.Info("Paused. Enter \"p\" again to resume.")
+				} else {
+					log.Info("Resumed.")
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		if p.Paused() {
+			p.Toggle()
+		}
+	}
+}
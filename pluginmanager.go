@@ -17,10 +17,11 @@ package main
 // along with this program.  If not, see <http://www.gnu.org/licenses/>.
 
 import (
-	"bufio"
 	"errors"
 	"fmt"
-	"os"
+	"io"
+	"io/ioutil"
+	"net/http"
 	"strconv"
 	"strings"
 
@@ -35,6 +36,7 @@ var (
 	ErrNoPlugins            = errors.New("No plugins to select from.")
 	ErrUnsetRequired        = errors.New("A required plugin option was not set and prompting is off.")
 	ErrRequiredHidden       = errors.New("A required plugin option is also hidden.")
+	ErrInvalidOptions       = errors.New("One or more plugin options were invalid.")
 )
 
 func (pm *PluginManager) FindHandlers(urls []string) [][]Plugin {
@@ -77,13 +79,51 @@ func (pm *PluginManager) SelectPlugin(ps []Plugin) (Plugin, error) {
 
 // Set a plugin's options, prompting the user for missing required fields.
 // If prompting isn't desired, return an error instead if required fields
-// are unset.
-func (pm *PluginManager) SetOptions(ps []Plugin, usropts map[string]string, defaults, noprompt bool) error {
+// are unset. The options are validated once they're all set.
+func (pm *PluginManager) SetOptions(url string, ps []Plugin, usropts map[string]string, defaults, noprompt bool) error {
+	if err := pm.setOptions(url, ps, usropts, defaults, noprompt); err != nil {
+		return err
+	}
+
+	return pm.validateOptions(ps)
+}
+
+// Call Validate() on every option and plugin that implements Validator,
+// logging every error before returning ErrInvalidOptions if there were any.
+func (pm *PluginManager) validateOptions(ps []Plugin) error {
+	invalid := false
+	for _, p := range ps {
+		plog := log.WithField("plugin", pluginName(p))
+		for _, opt := range p.Options() {
+			if v, ok := opt.(Validator); ok {
+				if err := v.Validate(); err != nil {
+					plog.Errorf("Invalid value for \"%s\": %s", opt.Key(), err)
+					invalid = true
+				}
+			}
+		}
+		if v, ok := p.(Validator); ok {
+			if err := v.Validate(); err != nil {
+				plog.Errorf("Invalid options: %s", err)
+				invalid = true
+			}
+		}
+	}
+
+	if invalid {
+		return ErrInvalidOptions
+	}
+	return nil
+}
+
+func (pm *PluginManager) setOptions(url string, ps []Plugin, usropts map[string]string, defaults, noprompt bool) error {
 	// A map of all unset options.
 	unset := make(map[Plugin][]Option)
 	// A map of all unset required options.
 	unsetReq := make(map[Plugin][]Option)
 	for _, p := range ps {
+		noAuth := authNotRequired(p, url)
+		creds := credentialOptions(p)
 		plgopts := p.Options()
 		for _, plgopt := range plgopts {
 			set := false
@@ -98,8 +138,19 @@ func (pm *PluginManager) SetOptions(ps []Plugin, usropts map[string]string, defa
 				}
 			}
 
-			// If unset, populate the above maps.
-			if !set {
+			// Options set by the user take priority over the credentials source.
+			if val, ok := creds[strings.ToLower(plgopt.Key())]; ok && !set {
+				if err := plgopt.Set(val); err != nil {
+					return err
+				}
+				set = true
+				log.WithField("plugin", pluginName(p)).Debugf("Set Option: %s from the credentials file",
+					plgopt.Key())
+			}
+
+			// If unset, populate the above maps. Auth options are skipped
+			// altogether if the plugin says we don't need them for this URL.
+			if !set && !noAuth[strings.ToLower(plgopt.Key())] {
 				if plgopt.IsRequired() {
 					// An option can't be required and hidden.
 					if plgopt.IsHidden() {
@@ -163,10 +214,120 @@ func (pm *PluginManager) SetOptions(ps []Plugin, usropts map[string]string, defa
 	return nil
 }
 
+// Filter out the plugins that can't parse the URL despite saying they can handle it.
+// If none of them can, the error from the first one is returned.
+func (pm *PluginManager) ValidateHandlers(url string, ps []Plugin) ([]Plugin, error) {
+	res := make([]Plugin, 0, len(ps))
+	var first error
+	for _, p := range ps {
+		if up, ok := p.(URLParser); ok {
+			if _, err := up.Parse(url); err != nil {
+				log.WithField("plugin", pluginName(p)).Debugf("Could not parse %s: %s", url, err)
+				if first == nil {
+					first = fmt.Errorf("%s: %s", pluginName(p), err)
+				}
+				continue
+			}
+		}
+		res = append(res, p)
+	}
+
+	if len(res) == 0 && first != nil {
+		return nil, first
+	}
+	return res, nil
+}
+
+// The most we read of a page when looking for signatures.
+const maxDetectSize = 4 << 20
+
+// Fetch the page and ask every plugin that implements PageDetector if it recognizes
+// it, for URLs that no plugin can handle. Returns the URL the plugins that did can
+// handle (the first one's if they disagree) and those plugins.
+func (pm *PluginManager) DetectHandlers(url string) (string, []Plugin, error) {
+	client := NewHTTPClient(HTTPTimeout)
+	r, err := client.Do(NewGetRequest(url))
+	if err != nil {
+		return "", nil, err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return "", nil, &ErrHTTPStatusCode{StatusCode: r.StatusCode}
+	}
+	page, err := ioutil.ReadAll(io.LimitReader(r.Body, maxDetectSize))
+	if err != nil {
+		return "", nil, err
+	}
+
+	var handled string
+	res := make([]Plugin, 0, 1)
+	for _, p := range []Plugin(*pm) {
+		pd, ok := p.(PageDetector)
+		if !ok {
+			continue
+		}
+		sig, u, ok := pd.DetectPage(url, page)
+		if !ok || (handled != "" && u != handled) || !p.CanHandle(u) {
+			continue
+		}
+
+		log.WithField("plugin", pluginName(p)).Infof("Found %s. Downloading from: %s", sig, u)
+		handled = u
+		res = append(res, p)
+	}
+
+	return handled, res, nil
+}
+
+// Get the keys (in lowercase) of the auth options of the plugin if it
+// says the URL can be downloaded from without authentication, if we're
+// only getting the preview, or if the credentials will come from an
+// accounts file instead.
+func authNotRequired(p Plugin, url string) map[string]bool {
+	res := make(map[string]bool)
+	if pv, ok := p.(Previewer); ok && Preview && pv.HasPreview(url) {
+		log.WithField("plugin", pluginName(p)).Debug("No authentication required for the preview of: " + url)
+		if ac, ok := p.(AuthChecker); ok {
+			for _, key := range ac.AuthOptions() {
+				res[strings.ToLower(key)] = true
+			}
+		}
+	} else if ac, ok := p.(AuthChecker); ok && HasAccounts() {
+		log.WithField("plugin", pluginName(p)).Debug("Using the accounts file for: " + url)
+		for _, key := range ac.AuthOptions() {
+			res[strings.ToLower(key)] = true
+		}
+	} else if ok && !ac.RequiresAuth(url) {
+		log.WithField("plugin", pluginName(p)).Debug("No authentication required for: " + url)
+		for _, key := range ac.AuthOptions() {
+			res[strings.ToLower(key)] = true
+		}
+	}
+
+	return res
+}
+
+// Get the auth options of the plugin (keys in lowercase) with the values
+// from the credentials source, if it has credentials for the plugin.
+func credentialOptions(p Plugin) map[string]string {
+	res := make(map[string]string)
+	ac, ok := p.(AuthChecker)
+	if !ok {
+		return res
+	}
+
+	keys := ac.AuthOptions()
+	if acc, ok := GetCredentials(p.Name()); ok && len(keys) >= 2 {
+		res[strings.ToLower(keys[0])] = acc.Username
+		res[strings.ToLower(keys[1])] = acc.Password
+	}
+
+	return res
+}
+
 func prompt(msg string) string {
-	r := bufio.NewReader(os.Stdin)
 	fmt.Print(msg + ": ")
-	in, _ := r.ReadString('\n')
+	in, _ := readLine()
 
 	return strings.TrimSpace(in)
 }
@@ -16,20 +16,12 @@ package main
 // You should have received a copy of the GNU Affero General Public License
 // along with this program.  If not, see <http://www.gnu.org/licenses/>.
 
+// Plugins register themselves when imported, so adding
+// a plugin to mindl only requires adding it here.
 import (
-	"github.com/MinoMino/mindl/plugins"
-	"github.com/MinoMino/mindl/plugins/booklive"
-	"github.com/MinoMino/mindl/plugins/bookwalker"
-	"github.com/MinoMino/mindl/plugins/dummy"
-	ebj "github.com/MinoMino/mindl/plugins/ebookjapan"
+	_ "github.com/MinoMino/mindl/plugins/binbreader"
+	_ "github.com/MinoMino/mindl/plugins/booklive"
+	_ "github.com/MinoMino/mindl/plugins/bookwalker"
+	_ "github.com/MinoMino/mindl/plugins/dummy"
+	_ "github.com/MinoMino/mindl/plugins/ebookjapan"
 )
-
-// Global slice of Plugin objects. As much as I'd love
-// to be able to omit this, Go just doesn't let me for now.
-// Could explore using the -X linker flag to set this.
-var Plugins = [...]plugins.Plugin{
-	&dummy.Plugin,
-	&booklive.Plugin,
-	&ebj.Plugin,
-	&bookwalker.Plugin,
-}
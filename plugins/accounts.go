@@ -0,0 +1,210 @@
+package plugins
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+
+	log "github.com/MinoMino/logrus"
+)
+
+/*
+   ==================================================
+                        ACCOUNTS
+     Rotating between multiple accounts for plugins
+     that require logging in.
+   ==================================================
+*/
+
+var ErrNoAccounts = errors.New("The accounts file did not contain any accounts.")
+
+type Account struct {
+	Username, Password string
+}
+
+// The accounts set with SetAccountsFile(), and the index of the
+// account the next CredentialProvider should start with.
+var (
+	accounts     []Account
+	nextAccount  int
+	accountsLock sync.Mutex
+)
+
+// Load accounts from a file with one "username:password" per line.
+// Empty lines and lines starting with # are ignored.
+func SetAccountsFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	res := make([]Account, 0, 2)
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		split := strings.SplitN(line, ":", 2)
+		if len(split) < 2 || split[0] == "" {
+			return fmt.Errorf("Invalid account on line %d of the accounts file. Should be username:password.", n)
+		}
+		res = append(res, Account{split[0], split[1]})
+	}
+	if err := s.Err(); err != nil {
+		return err
+	} else if len(res) == 0 {
+		return ErrNoAccounts
+	}
+
+	accountsLock.Lock()
+	accounts = res
+	nextAccount = 0
+	accountsLock.Unlock()
+	return nil
+}
+
+// Whether or not accounts were loaded with SetAccountsFile().
+func HasAccounts() bool {
+	accountsLock.Lock()
+	defer accountsLock.Unlock()
+	return len(accounts) != 0
+}
+
+// Provides the credentials a plugin logs in with. If an accounts file was
+// loaded, each provider starts at the account after the one the previous
+// provider started at, so that consecutive downloads are spread across them.
+// Otherwise it only ever provides the single account it was made with.
+type CredentialProvider struct {
+	accounts []Account
+	current  int
+	m        sync.Mutex
+}
+
+// Make a provider that falls back to the given credentials if no
+// accounts file was loaded. They would usually be from plugin options.
+func NewCredentialProvider(username, password string) *CredentialProvider {
+	accountsLock.Lock()
+	defer accountsLock.Unlock()
+	if len(accounts) == 0 {
+		return &CredentialProvider{accounts: []Account{{username, password}}}
+	}
+
+	cp := &CredentialProvider{accounts: accounts, current: nextAccount % len(accounts)}
+	nextAccount++
+	return cp
+}
+
+func (cp *CredentialProvider) Current() Account {
+	cp.m.Lock()
+	defer cp.m.Unlock()
+	return cp.accounts[cp.current]
+}
+
+// Switch to the next account. Returns false if there's only one.
+func (cp *CredentialProvider) Rotate() bool {
+	cp.m.Lock()
+	defer cp.m.Unlock()
+	if len(cp.accounts) < 2 {
+		return false
+	}
+
+	cp.current = (cp.current + 1) % len(cp.accounts)
+	return true
+}
+
+// The number of accounts the provider rotates between.
+func (cp *CredentialProvider) Len() int {
+	return len(cp.accounts)
+}
+
+// Where the credentials of plugins come from when they're not given as options,
+// so that passwords never have to appear in the arguments of the process.
+type CredentialSource interface {
+	// The credentials for the plugin with the given name, if there are any.
+	Credentials(plugin string) (Account, bool)
+}
+
+var credentialSource CredentialSource
+
+// Set where GetCredentials() gets credentials from. nil means nowhere.
+func SetCredentialSource(cs CredentialSource) {
+	credentialSource = cs
+}
+
+// Get the credentials for the plugin from the source set with SetCredentialSource().
+func GetCredentials(plugin string) (Account, bool) {
+	if credentialSource == nil {
+		return Account{}, false
+	}
+
+	return credentialSource.Credentials(plugin)
+}
+
+// Credentials loaded from a file with one "plugin:username:password" per line,
+// with plugin names in lowercase.
+type CredentialsFile map[string]Account
+
+// Load a credentials file. Empty lines and lines starting with # are ignored.
+// Since the file has passwords in plain text, a warning is logged if anyone
+// other than its owner can read it.
+func LoadCredentialsFile(path string) (CredentialsFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if fi, err := f.Stat(); err != nil {
+		return nil, err
+	} else if runtime.GOOS != "windows" && fi.Mode().Perm()&0044 != 0 {
+		log.Warnf("The credentials file %s can be read by other users. Consider running: chmod 600 %s", path, path)
+	}
+
+	res := make(CredentialsFile)
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		split := strings.SplitN(line, ":", 3)
+		if len(split) < 3 || split[0] == "" || split[1] == "" {
+			return nil, fmt.Errorf("Invalid credentials on line %d of the credentials file. Should be plugin:username:password.", n)
+		}
+		res[strings.ToLower(split[0])] = Account{split[1], split[2]}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (cf CredentialsFile) Credentials(plugin string) (Account, bool) {
+	acc, ok := cf[strings.ToLower(plugin)]
+	return acc, ok
+}
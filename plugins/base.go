@@ -17,14 +17,23 @@ package plugins
 // along with this program.  If not, see <http://www.gnu.org/licenses/>.
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	log "github.com/MinoMino/logrus"
 )
@@ -52,9 +61,304 @@ func (e *ErrHTTPStatusCode) String() string {
 	return "The HTTP request did not respond with status code 200."
 }
 
-// Panic with an ErrHTTPStatusCode if the status code isn't 200.
+func (e *ErrHTTPStatusCode) Error() string {
+	return fmt.Sprintf("HTTP request returned error code: %d", e.StatusCode)
+}
+
+// Whether or not the error (or recovered panic) is an ErrHTTPStatusCode
+// with a status code that indicates the session is no longer valid.
+func IsAuthFailure(err interface{}) bool {
+	if e, ok := err.(*ErrHTTPStatusCode); ok {
+		return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+	}
+
+	return false
+}
+
+// Re-authenticates when a session expires in the middle of a download,
+// which can happen with long downloads. The number of attempts is capped
+// to avoid looping forever if the site keeps rejecting us.
+type Reauthenticator struct {
+	reauth      func() error
+	max         int
+	attempts    int
+	generation  int
+	lastFailure error
+	m           sync.Mutex
+}
+
+func NewReauthenticator(max int, reauth func() error) *Reauthenticator {
+	return &Reauthenticator{reauth: reauth, max: max}
+}
+
+// Run fn, and if it fails with an authentication error, re-authenticate
+// and run it once more. If multiple workers fail at the same time, only
+// one of them re-authenticates while the others wait and then retry.
+func (ra *Reauthenticator) Do(fn func() error) error {
+	ra.m.Lock()
+	gen := ra.generation
+	ra.m.Unlock()
+
+	err := fn()
+	if !IsAuthFailure(err) {
+		return err
+	}
+
+	ra.m.Lock()
+	if gen == ra.generation {
+		if ra.attempts >= ra.max {
+			ra.m.Unlock()
+			log.Errorf("Session expired, but gave up after %d re-authentication attempt(s).", ra.max)
+			return err
+		}
+
+		ra.attempts++
+		log.Warnf("Session expired. Re-authenticating (attempt %d/%d)...", ra.attempts, ra.max)
+		ra.lastFailure = ra.reauth()
+		ra.generation++
+	}
+	reauthErr := ra.lastFailure
+	ra.m.Unlock()
+
+	if reauthErr != nil {
+		return reauthErr
+	}
+
+	return fn()
+}
+
+// The defaults used by RetryRequest().
+const (
+	DefaultRetryAttempts = 3
+	DefaultRetryBackoff  = time.Second
+)
+
+// Whether or not an error is likely to go away if we try again, which
+// is the case for network errors and some server-side HTTP errors.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	} else if e, ok := err.(*ErrHTTPStatusCode); ok {
+		return isRetryableStatus(e.StatusCode)
+	} else if _, ok := err.(net.Error); ok {
+		// Includes the *url.Error returned by clients.
+		return true
+	}
+
+	return false
+}
+
+func isRetryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// Run fn up to the given number of attempts as long as it returns errors that
+// IsRetryable() considers retryable. See RetryIf().
+func Retry(attempts int, backoff time.Duration, fn func() error) error {
+	return RetryIf(attempts, backoff, IsRetryable, fn)
+}
+
+// Run fn up to the given number of attempts as long as it returns errors the
+// predicate considers retryable. The delay between attempts starts at backoff
+// and doubles for each attempt, with up to ±50% jitter so that multiple workers
+// failing at the same time don't all retry at the same time. Returns the last error.
+func RetryIf(attempts int, backoff time.Duration, retryable func(error) bool, fn func() error) error {
+	var err error
+	delay := backoff
+	for i := 0; i < attempts; i++ {
+		if i != 0 {
+			jittered := time.Duration((0.5 + rand.Float64()) * float64(delay))
+			log.Debugf("Retrying in %.2f seconds (attempt %d/%d): %v", jittered.Seconds(), i+1, attempts, err)
+			if Sleep(jittered) != nil {
+				// Cancelled, so give up with what we got last.
+				return err
+			}
+			delay *= 2
+			atomic.AddInt64(&httpStats.Retries, 1)
+		}
+
+		if err = fn(); err == nil || !retryable(err) {
+			return err
+		}
+	}
+
+	return err
+}
+
+// Send a request, retrying on network errors and status codes that usually mean
+// the server is temporarily overloaded. The request must not have a body. If every
+// attempt got such a status code, the last response is returned without an error
+// so that the caller can deal with the status code like it usually would.
+func RetryRequest(client *http.Client, req *http.Request) (resp *http.Response, err error) {
+	err = Retry(DefaultRetryAttempts, DefaultRetryBackoff, func() error {
+		if resp != nil {
+			resp.Body.Close()
+			resp = nil
+		}
+
+		var err error
+		resp, err = client.Do(req)
+		if err != nil {
+			return err
+		} else if isRetryableStatus(resp.StatusCode) {
+			return &ErrHTTPStatusCode{resp.StatusCode}
+		}
+		return nil
+	})
+	if _, ok := err.(*ErrHTTPStatusCode); ok {
+		return resp, nil
+	}
+
+	return resp, err
+}
+
+// Same as RetryRequest() with a plain GET request.
+func RetryGet(client *http.Client, url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return RetryRequest(client, req)
+}
+
+var ErrBadContentRange = errors.New("The server returned a different range than the one requested.")
+
+// Download a URL into a file through the reporter, resuming from what's already
+// in the file if the server supports range requests, or starting over if not.
+// Meant for large single files, where starting over after an interruption is costly.
+func DownloadResumable(client *http.Client, url string, rep Reporter, dst string) (int64, error) {
+	size, err := rep.PartialSize(dst)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return 0, err
+	}
+	if size > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", size))
+	}
+
+	resp, err := RetryRequest(client, req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var offset int64
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if size > 0 {
+			log.Debugf("The server doesn't support resuming. Downloading %s from the start.", dst)
+		}
+	case http.StatusPartialContent:
+		if size == 0 || contentRangeStart(resp) != size {
+			return 0, ErrBadContentRange
+		}
+		log.Debugf("Resuming %s from byte %d.", dst, size)
+		offset = size
+	case http.StatusRequestedRangeNotSatisfiable:
+		if size == 0 {
+			return 0, &ErrHTTPStatusCode{resp.StatusCode}
+		}
+		// There's nothing past what we have, so the file was already complete.
+		w, err := rep.ResumeWriter(dst, size, false)
+		if err != nil {
+			return 0, err
+		}
+		return 0, w.Close()
+	default:
+		if err := CheckGeoRestriction(resp); err != nil {
+			return 0, err
+		}
+		return 0, &ErrHTTPStatusCode{resp.StatusCode}
+	}
+
+	w, err := rep.ResumeWriter(dst, offset, false)
+	if err != nil {
+		return 0, err
+	}
+	n, err := rep.CopySized(w, resp.Body, resp.ContentLength)
+	if err != nil {
+		// Keeps what we got on disk to resume from, without saving it as complete.
+		AbortWriter(w)
+		return n, err
+	}
+
+	return n, w.Close()
+}
+
+// The first byte of the range in a Content-Range header, or -1 if it's missing or malformed.
+func contentRangeStart(resp *http.Response) int64 {
+	var start int64
+	if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil {
+		return -1
+	}
+
+	return start
+}
+
+// Get the JSON out of a JSONP-style response that passes it to a function, like
+// `DataGet_Content({...});`. If name isn't empty, the function has to have that name.
+// Surrounding whitespace and a trailing semicolon are allowed, but nothing else.
+func StripJSONP(data []byte, name string) ([]byte, error) {
+	s := strings.TrimSpace(string(data))
+	s = strings.TrimSpace(strings.TrimSuffix(s, ";"))
+	start, end := strings.IndexByte(s, '('), strings.LastIndexByte(s, ')')
+	if start == -1 || end != len(s)-1 {
+		return nil, fmt.Errorf("Expected a function call wrapping the JSON, but got: %.40q", s)
+	}
+	if fn := strings.TrimSpace(s[:start]); name != "" && fn != name {
+		return nil, fmt.Errorf("Expected the JSON to be wrapped in %s(), but got %s().", name, fn)
+	}
+
+	// Anything else around the call ends up in what's between the parentheses.
+	res := []byte(strings.TrimSpace(s[start+1 : end]))
+	if !json.Valid(res) {
+		return nil, fmt.Errorf("Expected JSON in the function call, but got: %.40q", res)
+	}
+
+	return res, nil
+}
+
+// Replace characters that aren't allowed in file names on at least
+// one of the platforms we support, and trim what Windows doesn't like.
+func SanitizeFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < ' ' || strings.ContainsRune(`<>:"/\|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.TrimRight(strings.TrimSpace(name), ".")
+	if name == "" {
+		return "_"
+	}
+
+	return name
+}
+
+// Cut the string down to at most max bytes without splitting a multi-byte rune.
+func truncateString(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+
+	return s[:max]
+}
+
+// Panic with an ErrHTTPStatusCode if the status code isn't 200,
+// or with an ErrGeoRestricted if it's due to a geo restriction.
 func PanicForStatus(resp *http.Response, msg string) {
 	if resp.StatusCode != http.StatusOK {
+		if err := CheckGeoRestriction(resp); err != nil {
+			log.Errorf("Status code: %s", resp.Status)
+			panic(err)
+		}
 		if msg != "" {
 			msg = " | " + msg
 		}
@@ -73,11 +377,40 @@ func OptionsToMap(opts []Option) map[string]interface{} {
 	return res
 }
 
-// Create an HTTP client with a proper timeout timer.
+// The timeout in seconds plugins should pass to NewHTTPClient(). Set by --timeout.
+var HTTPTimeout = 20
+
+// Make a Timeout option, for plugins whose files take a different time to
+// download than what --timeout is meant for, e.g. large single files.
+func NewTimeoutOption() *IntOption {
+	return &IntOption{K: "Timeout", V: -1, Min: -1, Max: math.MaxInt32,
+		C: "The timeout in seconds for this plugin's HTTP requests, overriding --timeout. 0 means no timeout and -1 uses --timeout."}
+}
+
+// Get the timeout to pass to NewHTTPClient(), which is the Timeout
+// option if it's set and HTTPTimeout otherwise.
+func PluginTimeout(opts map[string]interface{}) int {
+	if timeout, ok := opts["Timeout"].(int); ok && timeout >= 0 {
+		return timeout
+	}
+
+	return HTTPTimeout
+}
+
+// Create an HTTP client with a proper timeout timer. The timeout is in seconds and
+// covers the whole request, including reading the body, so it has to be long enough
+// for the largest files. 0 means no timeout.
+//
+// The timeout and the context of a request are independent of each other: a request
+// with a context of its own is cancelled when the context is done or when the timeout
+// expires, whichever happens first, so a context can't extend the timeout. Interrupts
+// don't cancel requests, only sleeps (see Sleep()), so the timeout is also what stops
+// a request that's still waiting for the server when the download is interrupted.
 func NewHTTPClient(timeout int) *http.Client {
 	jar, _ := cookiejar.New(nil)
+	loadDomainUserCookies(jar)
 	return &http.Client{
-		Timeout: time.Second * 20,
+		Timeout: time.Second * time.Duration(timeout),
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			last := via[len(via)-1]
 			log.WithField("url", last.URL.String()).Debug("Following HTTP redirect...")
@@ -88,7 +421,8 @@ func NewHTTPClient(timeout int) *http.Client {
 
 			return nil
 		},
-		Jar: jar,
+		Jar:       jar,
+		Transport: newTransport(),
 	}
 }
 
@@ -139,6 +473,9 @@ func NewPostFormRequestUA(url, userAgent string, data url.Values) *http.Request
 // to control the flow of downloads (e.g. pausing, aborting), track download
 // speeds, stay aware of downloaded files for further processing, and so on.
 //
+// A Reporter is safe for concurrent use by the goroutines of the downloader
+// it's passed to, e.g. to download the parts of a page at once.
+//
 // All paths used to save files with must relative and be in a directory.
 // If the user wants to have the files zipped, all the top-level directories
 // will be zipped.
@@ -152,11 +489,17 @@ type Reporter interface {
 	// to go wrong in another downloader, it can detect that and stop the downloader
 	// from keeping the application from exiting.
 	Copy(dst io.Writer, src io.Reader) (written int64, err error)
+	// Same as Copy(), but with the expected size of the data (e.g. from the
+	// Content-Length header), which allows the manager to show the progress
+	// of the file itself. A size <= 0 means it's unknown.
+	CopySized(dst io.Writer, src io.Reader, size int64) (written int64, err error)
 	// Saves the data/file into a file as a successful download.
 	// The path must be relative, as the downloader will take care of where to save files.
 	// The report bool determines whether or not it should report download speeds.
 	// In other words, whether or not src is getting its data straight from the network.
 	SaveData(dst string, src io.Reader, report bool) (written int64, err error)
+	// Same as SaveData(), but with the expected size like with CopySized().
+	SaveDataSized(dst string, src io.Reader, size int64, report bool) (written int64, err error)
 	// Saves the file as a successful download. The destination path must be relative,
 	// as the downloader will take care of where to save files. The file is renamed (moved)
 	// to the final destination rather than copied. This only works if the file resides on
@@ -167,8 +510,32 @@ type Reporter interface {
 	// disk drive as the download directory, allowing for use with SaveFile().
 	TempFile() (*os.File, error)
 	// Returns a writer to the destination file. The caller must close it.
-	// Download completion is reported on close.
+	// Download completion is reported on close. If writing fails, close it
+	// with AbortWriter() instead so that the incomplete file isn't saved.
 	FileWriter(dst string, report bool) (io.WriteCloser, error)
+	// The size of what's already in the destination file, or 0 if it doesn't exist.
+	// Used to resume interrupted downloads. See DownloadResumable().
+	PartialSize(dst string) (int64, error)
+	// Same as FileWriter(), but keeps the first offset bytes of the file if it
+	// already exists and writes after them, discarding anything past them.
+	ResumeWriter(dst string, offset int64, report bool) (io.WriteCloser, error)
+}
+
+// Implemented by writers that can discard what was written to them instead
+// of saving it when closed. See AbortWriter().
+type Aborter interface {
+	Abort() error
+}
+
+// Close a writer from FileWriter() after writing to it failed. If it's an
+// Aborter, it's aborted so that the incomplete file isn't saved, e.g. into
+// an archive it can't be removed from later.
+func AbortWriter(w io.WriteCloser) error {
+	if a, ok := w.(Aborter); ok {
+		return a.Abort()
+	}
+
+	return w.Close()
 }
 
 /*
@@ -223,6 +590,25 @@ func (opt *StringOption) Comment() string {
 	return opt.C
 }
 
+// A StringOption for secrets such as passwords, which
+// should never be displayed as is.
+type PasswordOption struct {
+	StringOption
+}
+
+func NewPasswordOption(key string, required bool) *PasswordOption {
+	return &PasswordOption{StringOption{K: key, Required: required}}
+}
+
+// The value masked, or an empty string if not set.
+func (opt *PasswordOption) Masked() string {
+	if opt.V == "" {
+		return ""
+	}
+
+	return "********"
+}
+
 // An implementation of Option that tries to convert
 // the user input into an integer.
 type IntOption struct {
@@ -230,6 +616,8 @@ type IntOption struct {
 	V                int
 	Required, Hidden bool
 	C                string
+	// If Min < Max, Validate() makes sure V is within them (inclusive).
+	Min, Max int
 }
 
 func (opt *IntOption) Key() string {
@@ -245,6 +633,14 @@ func (opt *IntOption) Set(v string) (err error) {
 	return err
 }
 
+func (opt *IntOption) Validate() error {
+	if opt.Min < opt.Max && (opt.V < opt.Min || opt.V > opt.Max) {
+		return fmt.Errorf("%d is out of range. Should be between %d and %d.", opt.V, opt.Min, opt.Max)
+	}
+
+	return nil
+}
+
 func (opt *IntOption) IsRequired() bool {
 	return opt.Required
 }
@@ -465,3 +861,138 @@ type Plugin interface {
 	// to abort, it is passed. Otherwise nil is passed.
 	Cleanup(error)
 }
+
+// Optionally implemented by plugins that require authentication for some
+// URLs, but not all of them (e.g. free volumes). If RequiresAuth() returns
+// false, the user won't be prompted for the options returned by AuthOptions(),
+// nor will it be an error to leave them unset.
+type AuthChecker interface {
+	// Whether or not credentials are needed to download from the URL.
+	RequiresAuth(url string) bool
+	// The keys of the options that are only needed for authentication. The first
+	// two, if any, are the username and password, which can come from GetCredentials().
+	AuthOptions() []string
+}
+
+// Optional interface for options and plugins with values that can be valid
+// as far as Set() is concerned, but still not make sense. Called after all
+// options are set, so plugins can use it to check options against each other.
+type Validator interface {
+	Validate() error
+}
+
+// Optional interface for plugins that can validate a URL CanHandle() accepts
+// and extract the IDs and such from it. This lets the user know about malformed
+// URLs right away, rather than when we get to downloading from them.
+type URLParser interface {
+	// Returns the parts of the URL the plugin needs, or an error if it's malformed.
+	Parse(url string) (map[string]string, error)
+}
+
+// Optional interface for plugins that can recognize their reader in a page whose
+// URL CanHandle() doesn't accept, e.g. after a site changes its URL format. Used
+// as a fallback when no plugin can handle a URL and --deep-detect is on.
+type PageDetector interface {
+	// Look for a signature of the reader in the HTML of the page. If one is found,
+	// return a short description of it and a URL that CanHandle() accepts.
+	DetectPage(url string, page []byte) (signature, handled string, ok bool)
+}
+
+// Optional interface for plugins that can download the free preview pages stores
+// offer for content the user doesn't own. While Preview is set, they download the
+// preview instead of the full content and don't need to log in.
+type Previewer interface {
+	// Whether or not a preview can be downloaded from the URL.
+	HasPreview(url string) bool
+}
+
+// Whether or not plugins should download previews. See Previewer.
+var Preview bool
+
+// The maximum number of pages of a preview, in case a store serves more than a sample.
+// Samples are the first chapter or so, which is well under this for a typical volume.
+// What it guards against is a store serving the whole volume as the "preview", e.g.
+// to a session that owns it, which would otherwise be saved as a preview that isn't one.
+const MaxPreviewPages = 50
+
+// Appended to the directories of previews so they aren't mistaken for the full content.
+const PreviewSuffix = " (Preview)"
+
+// Limit the number of pages to download to MaxPreviewPages if Preview is set.
+func PreviewLength(pages int) int {
+	if Preview && pages > MaxPreviewPages {
+		return MaxPreviewPages
+	}
+
+	return pages
+}
+
+// Optional interface for plugins that can check if their site is up before a
+// download starts, so that a site that's down or blocking us fails right away
+// with a clear message rather than somewhere in the middle. Used with --preflight.
+type Preflighter interface {
+	// Check that the site the URL is downloaded from responds. Should be lightweight,
+	// ideally a single request. See CheckReachable().
+	Preflight(url string) error
+}
+
+// Send a single request to the URL and return an error if we can't connect, are
+// geo-restricted, or get a server error. Any other response, even a 404, means
+// the site is up, so the URL can be any page on it, like the login screen.
+func CheckReachable(url string) error {
+	client := NewHTTPClient(HTTPTimeout)
+	resp, err := client.Get(url)
+	if err != nil {
+		return fmt.Errorf("Could not reach %s: %s", url, err)
+	}
+	defer resp.Body.Close()
+
+	if err := CheckGeoRestriction(resp); err != nil {
+		return err
+	} else if resp.StatusCode >= 500 {
+		return fmt.Errorf("%s seems to be down: %s", url, &ErrHTTPStatusCode{StatusCode: resp.StatusCode})
+	}
+
+	return nil
+}
+
+// Whether or not the user owns a volume.
+type Ownership int
+
+const (
+	OwnershipUnknown Ownership = iota
+	Owned
+	NotOwned
+)
+
+func (o Ownership) String() string {
+	switch o {
+	case Owned:
+		return "yes"
+	case NotOwned:
+		return "no"
+	}
+
+	return "?"
+}
+
+func (o Ownership) MarshalText() ([]byte, error) {
+	return []byte(o.String()), nil
+}
+
+// A volume in a series, as returned by VolumeLister.
+type Volume struct {
+	// The volume number as the service presents it. Can be empty.
+	Number string `json:"number"`
+	Title  string `json:"title"`
+	// A URL that can be passed to mindl to download the volume, if known.
+	URL   string    `json:"url"`
+	Owned Ownership `json:"owned"`
+}
+
+// Optional interface for plugins that can list the volumes in the series
+// a URL belongs to, for --list-volumes. Like DownloadGenerator(), it's called
+// after the options are set.
+type VolumeLister interface {
+	ListVolumes(url string) ([]Volume, error)
+}
@@ -0,0 +1,166 @@
+package plugins
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// A Sleeper that returns right away and records what it was asked to sleep for.
+type recordingSleeper struct {
+	slept []time.Duration
+	err   error
+}
+
+func (rs *recordingSleeper) Sleep(ctx context.Context, d time.Duration) error {
+	rs.slept = append(rs.slept, d)
+	return rs.err
+}
+
+func withSleeper(t *testing.T, s Sleeper) {
+	old := DefaultSleeper
+	DefaultSleeper = s
+	t.Cleanup(func() { DefaultSleeper = old })
+}
+
+var (
+	errRetryable = errors.New("retryable")
+	errFatal     = errors.New("fatal")
+)
+
+func isTestRetryable(err error) bool {
+	return err == errRetryable
+}
+
+func TestRetryIfAttempts(t *testing.T) {
+	tests := []struct {
+		name     string
+		attempts int
+		errs     []error
+		calls    int
+		err      error
+	}{
+		{"success", 3, []error{nil}, 1, nil},
+		{"success after retries", 3, []error{errRetryable, errRetryable, nil}, 3, nil},
+		{"gives up", 3, []error{errRetryable, errRetryable, errRetryable, nil}, 3, errRetryable},
+		{"not retryable", 3, []error{errRetryable, errFatal, nil}, 2, errFatal},
+		{"single attempt", 1, []error{errRetryable, nil}, 1, errRetryable},
+	}
+
+	for _, test := range tests {
+		rs := &recordingSleeper{}
+		withSleeper(t, rs)
+		before := GetHTTPStats()
+		calls := 0
+		err := RetryIf(test.attempts, time.Second, isTestRetryable, func() error {
+			calls++
+			return test.errs[calls-1]
+		})
+		if err != test.err {
+			t.Errorf("%s: expected error %v, got %v.", test.name, test.err, err)
+		}
+		if calls != test.calls {
+			t.Errorf("%s: expected %d calls, got %d.", test.name, test.calls, calls)
+		}
+		if len(rs.slept) != calls-1 {
+			t.Errorf("%s: expected %d sleeps, got %d.", test.name, calls-1, len(rs.slept))
+		}
+		if retries := GetHTTPStats().Sub(before).Retries; retries != int64(calls-1) {
+			t.Errorf("%s: expected %d retries in the stats, got %d.", test.name, calls-1, retries)
+		}
+	}
+}
+
+func TestRetryIfBackoff(t *testing.T) {
+	rs := &recordingSleeper{}
+	withSleeper(t, rs)
+	const backoff = 100 * time.Millisecond
+	RetryIf(5, backoff, isTestRetryable, func() error {
+		return errRetryable
+	})
+
+	if len(rs.slept) != 4 {
+		t.Fatalf("Expected 4 sleeps, got %d.", len(rs.slept))
+	}
+	// Doubles every time, with up to ±50% jitter.
+	delay := backoff
+	for i, d := range rs.slept {
+		if d < delay/2 || d > delay*3/2 {
+			t.Errorf("Sleep #%d was %s, expected between %s and %s.", i+1, d, delay/2, delay*3/2)
+		}
+		delay *= 2
+	}
+}
+
+func TestRetryIfCancelled(t *testing.T) {
+	withSleeper(t, &recordingSleeper{err: context.Canceled})
+	calls := 0
+	err := RetryIf(5, time.Second, isTestRetryable, func() error {
+		calls++
+		return errRetryable
+	})
+	if err != errRetryable {
+		t.Errorf("Expected the last error of fn, got %v.", err)
+	} else if calls != 1 {
+		t.Errorf("Expected no attempts after the sleep was cancelled, got %d calls.", calls)
+	}
+}
+
+func TestStripJSONP(t *testing.T) {
+	tests := []struct {
+		data, name, expected string
+		ok                   bool
+	}{
+		{`DataGet_Content({"a":1})`, "DataGet_Content", `{"a":1}`, true},
+		{`DataGet_Content({"a":1});`, "DataGet_Content", `{"a":1}`, true},
+		{"\r\n  DataGet_Content( {\"a\":1} ) ;\n", "DataGet_Content", `{"a":1}`, true},
+		{`DataGet_Content ({"a":1}) ;`, "DataGet_Content", `{"a":1}`, true},
+		{`DataGet_Content({"a":"(x)"})`, "DataGet_Content", `{"a":"(x)"}`, true},
+		{`callback([1,2])`, "", `[1,2]`, true},
+		// Wrong wrappers.
+		{`DataGet_Contents({"a":1})`, "DataGet_Content", "", false},
+		{`({"a":1})`, "DataGet_Content", "", false},
+		{`{"a":1}`, "DataGet_Content", "", false},
+		{`{"a":1}`, "", "", false},
+		{`DataGet_Content({"a":1}`, "DataGet_Content", "", false},
+		{`DataGet_Content({"a":1});;`, "DataGet_Content", "", false},
+		{`DataGet_Content({"a":1}); other()`, "DataGet_Content", "", false},
+		{`DataGet_Content({"a":1}) + 1`, "DataGet_Content", "", false},
+		{``, "DataGet_Content", "", false},
+	}
+
+	for _, test := range tests {
+		res, err := StripJSONP([]byte(test.data), test.name)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("StripJSONP(%q, %q) = %q, expected an error.", test.data, test.name, res)
+			}
+		} else if err != nil {
+			t.Errorf("StripJSONP(%q, %q): %s", test.data, test.name, err)
+		} else if string(res) != test.expected {
+			t.Errorf("StripJSONP(%q, %q) = %q, expected %q.", test.data, test.name, res, test.expected)
+		}
+	}
+}
+
+func TestPluginTimeout(t *testing.T) {
+	defer func(timeout int) { HTTPTimeout = timeout }(HTTPTimeout)
+	HTTPTimeout = 20
+
+	tests := []struct {
+		opts     map[string]interface{}
+		expected int
+	}{
+		{map[string]interface{}{}, 20},
+		{map[string]interface{}{"Timeout": -1}, 20},
+		{map[string]interface{}{"Timeout": 0}, 0},
+		{map[string]interface{}{"Timeout": 300}, 300},
+	}
+
+	for _, test := range tests {
+		if res := PluginTimeout(test.opts); res != test.expected {
+			t.Errorf("PluginTimeout(%v) = %d, expected %d.", test.opts, res, test.expected)
+		}
+	}
+}
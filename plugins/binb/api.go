@@ -24,23 +24,25 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"image"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"net/url"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"time"
 
 	"github.com/MinoMino/mindl/logger"
+	"github.com/MinoMino/mindl/plugins"
 )
 
 var log = logger.GetLog("BinB")
 
 const userAgent = "Mozilla/5.0 (compatible; MSIE 9.0; Windows NT 6.1; Trident/5.0)"
 
-var reTtxImagePath = regexp.MustCompile(`t-img src="(.+?)"`)
 var reDataUri = regexp.MustCompile(`^(?:data:)?(?P<mime>[\w/\-\.]+);(?P<encoding>\w+),(?P<data>.*)$`)
 
 // For k generation. Doesn't really need to be implemented like the JS, but we don't
@@ -107,6 +109,14 @@ type Api struct {
 	ServerType              ContentServerType
 	Session                 *http.Client
 	Params                  ParamsGetter
+	// If set, used instead of what get_content_info returns. See SetKeys().
+	OverrideCtbl, OverridePtbl []string
+	OverrideP                  string
+	// Everything the Ttx says about each image, in the same order as Pages.
+	Images []TtxImage
+	// What get_request_info returned, if the handshake was needed.
+	RequestInfo []json.RawMessage
+	handshaken  bool
 }
 
 type Response struct {
@@ -126,6 +136,12 @@ type ContentInfoResponse struct {
 	P, Ctbl, Ptbl, Atbl, Ttbl              string
 }
 
+// An entry in the list returned by get_bibliography, which lists the
+// content in the same series as the current one.
+type BibliographyItem struct {
+	ContentID, Title, TitleRuby string
+}
+
 type ContentResponse struct {
 	ContentDate, ConverterType, ConverterVersion string
 	SmlImageCnt, NecImageSize, NecImageCnt       int
@@ -173,10 +189,14 @@ func (binb *Api) GetContentInfo() error {
 	r, err := binb.Session.Get(url)
 	if err != nil {
 		return err
-	} else if r.StatusCode != http.StatusOK {
-		return fmt.Errorf("HTTP request returned error code: %d", r.StatusCode)
 	}
 	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		if err := plugins.CheckGeoRestriction(r); err != nil {
+			return err
+		}
+		return fmt.Errorf("HTTP request returned error code: %d", r.StatusCode)
+	}
 
 	// Unmarshal into a Response struct.
 	var res Response
@@ -197,40 +217,262 @@ func (binb *Api) GetContentInfo() error {
 		return err
 	}
 	binb.ContentInfo = &info
+	if binb.OverrideP != "" {
+		log.Debug("Using the supplied p value.")
+		binb.ContentInfo.P = binb.OverrideP
+	}
+
+	var c, p []string
+	if binb.OverrideCtbl != nil {
+		log.Debug("Using the supplied ctbl and ptbl.")
+		c, p = binb.OverrideCtbl, binb.OverridePtbl
+	} else if binb.ContentInfo.Ctbl == "" && binb.ContentInfo.Ptbl == "" {
+		log.Debug("No scramble data, so the images aren't scrambled.")
+	} else {
+		// Get encrypted scramble data if present and process it.
+		// Get the decrypted bytes.
+		cRaw, err := binb.decryptData(binb.ContentInfo.Ctbl)
+		if err != nil {
+			return err
+		}
+		pRaw, err := binb.decryptData(binb.ContentInfo.Ptbl)
+		if err != nil {
+			return err
+		}
 
-	// Get encrypted scramble data if present and process it.
-	// Get the decrypted bytes.
-	cRaw, err := binb.decryptData(binb.ContentInfo.Ctbl)
+		// The decrypted bytes should be JSON, so we unmarshal them.
+		if err := json.Unmarshal(cRaw, &c); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(pRaw, &p); err != nil {
+			return err
+		}
+	}
+
+	// Create a descrambler with the decrypted data.
+	binb.Descrambler = nil
+	if c != nil {
+		binb.Descrambler, err = NewDescrambler(c, p)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Get the content server.
+	binb.ContentServer = strings.TrimSuffix(binb.ContentInfo.ContentsServer, "/")
+	binb.ServerType = binb.ContentInfo.ServerType
+
+	return nil
+}
+
+// Get the content in the same series as the current content.
+func (binb *Api) GetBibliography() ([]BibliographyItem, error) {
+	method := "get_bibliography"
+	params := url.Values{}
+	params.Set("cid", binb.Cid)
+	params.Set("k", binb.K)
+	extraParams := binb.Params(binb, method)
+	for k, v := range extraParams {
+		params[k] = v
+	}
+	url := fmt.Sprintf(bibApi[method], binb.Bib, params.Encode())
+	log.WithField("url", url).Debugf("Calling %s...", method)
+
+	r, err := binb.Session.Get(url)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		if err := plugins.CheckGeoRestriction(r); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("HTTP request returned error code: %d", r.StatusCode)
 	}
-	pRaw, err := binb.decryptData(binb.ContentInfo.Ptbl)
+
+	var res Response
+	if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+		return nil, err
+	} else if res.Result != 1 {
+		return nil, fmt.Errorf("%s returned result: %d", method, res.Result)
+	}
+
+	items := make([]BibliographyItem, 0, len(res.Items))
+	for _, raw := range res.Items {
+		var item BibliographyItem
+		if err := json.Unmarshal(raw, &item); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// Whether or not the images need to be descrambled. Only
+// valid after the content info has been retrieved.
+func (binb *Api) Scrambled() bool {
+	return binb.Descrambler != nil
+}
+
+// Whether or not the image of a page needs to be descrambled, going by its
+// size in the Ttx if it's there. Only valid after the content has been retrieved.
+// Decode() checks the actual size either way, so this is for deciding whether
+// or not the image can be saved as is without decoding it.
+func (binb *Api) PageScrambled(page int) bool {
+	if !binb.Scrambled() {
+		return false
+	} else if page < len(binb.Images) && binb.Images[page].Width > 0 && binb.Images[page].Height > 0 {
+		return binb.Descrambler.Scrambles(binb.Images[page].Width, binb.Images[page].Height)
+	}
+
+	return true
+}
+
+// Decode the image of a page, descrambling it if need be.
+func (binb *Api) Decode(page int, r io.Reader) (image.Image, error) {
+	if !binb.Scrambled() {
+		img, _, err := image.Decode(r)
+		return img, err
+	}
+
+	return binb.Descrambler.Descramble(binb.Pages[page], r)
+}
+
+// Let the descrambler reuse the memory of an image returned by Decode()
+// once it's been saved. The image must not be used afterwards.
+func (binb *Api) Release(img image.Image) {
+	if binb.Scrambled() {
+		binb.Descrambler.Release(img)
+	}
+}
+
+// Decode the image of a page read from src and save it in dir, along with
+// the cover if it's the first page and covers are to be saved.
+func (binb *Api) SaveImage(rep plugins.Reporter, dir string, n int, src io.Reader, encOpts plugins.EncodeOptions) error {
+	img, err := binb.Decode(n, src)
 	if err != nil {
 		return err
 	}
+	defer binb.Release(img)
+	if plugins.SaveCovers && n == 0 {
+		if err := plugins.SaveCover(rep, dir, img, encOpts); err != nil {
+			return err
+		}
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%04d.%s", n+1, encOpts.Ext()))
+	return plugins.SaveImage(rep, path, img, encOpts)
+}
 
-	// The decrypted bytes should be JSON, so we unmarshal them.
-	var c, p []string
-	if err := json.Unmarshal(cRaw, &c); err != nil {
+// Save a page downloaded into buf in dir. It's saved as is if descrambling
+// is off, if it isn't an image, or if passThrough is set and it's a JPEG that
+// isn't scrambled. Otherwise it's descrambled through plugins.Descramble().
+func (binb *Api) SavePage(rep plugins.Reporter, dir string, n int, buf *bytes.Buffer,
+	encOpts plugins.EncodeOptions, passThrough bool) error {
+	// Save the image as is for debugging if descrambling is off.
+	if plugins.NoDescramble {
+		path := filepath.Join(dir, fmt.Sprintf("%04d.jpg", n+1)+plugins.ScrambledSuffix)
+		_, err := rep.SaveData(path, buf, false)
 		return err
 	}
-	if err := json.Unmarshal(pRaw, &p); err != nil {
+
+	// Nothing to descramble, so the original file can be saved as is.
+	if passThrough && !binb.PageScrambled(n) && plugins.IsJPEG(buf.Bytes()) {
+		// The first page is the cover.
+		if plugins.SaveCovers && n == 0 {
+			path := filepath.Join(dir, plugins.CoverFilename)
+			if _, err := rep.SaveData(path, bytes.NewReader(buf.Bytes()), false); err != nil {
+				return err
+			}
+		}
+		path := filepath.Join(dir, fmt.Sprintf("%04d.jpg", n+1))
+		_, err := rep.SaveData(path, buf, false)
 		return err
 	}
+	// Not everything in a book is necessarily an image.
+	if plugins.IsContent(buf.Bytes()) {
+		path := filepath.Join(dir, fmt.Sprintf("%04d", n+1))
+		return plugins.SaveContent(rep, path, buf.Bytes(), encOpts)
+	}
 
-	// Create a descrambler with the decrypted data.
-	binb.Descrambler, err = NewDescrambler(c, p)
+	return plugins.Descramble(func() error {
+		return binb.SaveImage(rep, dir, n, buf, encOpts)
+	})
+}
+
+// Use the given descrambling keys and p value instead of the ones from
+// get_content_info, for when those can't be fetched or decrypted. ctbl and
+// ptbl are the decrypted tables as JSON arrays and have to be set together.
+// Empty strings are ignored.
+func (binb *Api) SetKeys(ctbl, ptbl, p string) error {
+	c, pt, err := ParseKeys(ctbl, ptbl)
 	if err != nil {
 		return err
 	}
 
-	// Get the content server.
-	binb.ContentServer = strings.TrimSuffix(binb.ContentInfo.ContentsServer, "/")
-	binb.ServerType = binb.ContentInfo.ServerType
-
+	binb.OverrideP = p
+	binb.OverrideCtbl, binb.OverridePtbl = c, pt
 	return nil
 }
 
+// Parse decrypted ctbl and ptbl tables given as JSON arrays. Returns
+// nil tables if both are empty. See SetKeys().
+func ParseKeys(ctbl, ptbl string) (c, p []string, err error) {
+	if ctbl == "" && ptbl == "" {
+		return nil, nil, nil
+	} else if ctbl == "" || ptbl == "" {
+		return nil, nil, errors.New("ctbl and ptbl have to be supplied together.")
+	}
+
+	if err := json.Unmarshal([]byte(ctbl), &c); err != nil {
+		return nil, nil, fmt.Errorf("Invalid ctbl. Should be a JSON array of strings: %s", err)
+	} else if err := json.Unmarshal([]byte(ptbl), &p); err != nil {
+		return nil, nil, fmt.Errorf("Invalid ptbl. Should be a JSON array of strings: %s", err)
+	} else if len(c) == 0 || len(c) != len(p) {
+		return nil, nil, fmt.Errorf("ctbl and ptbl need to be non-empty and of the same size, but got %d and %d.", len(c), len(p))
+	}
+
+	return c, p, nil
+}
+
+// Parse parameters for get_image given in a query string format, e.g. "w=4096&q=0",
+// which are added to or replace the ones we send by default. Only used with
+// ServerTypeSbc, since the CDN serves fixed sizes. The ones known to us are h, the
+// maximum height (we send 9999 to get the largest image), w, the maximum width,
+// which some deployments honor instead of h, and q, the quality, where 0 is the
+// highest and what we send. Deployments are free to ignore any of them, so this
+// is mostly for experimenting.
+func ParseImageParams(s string) (url.Values, error) {
+	params, err := url.ParseQuery(strings.TrimPrefix(strings.TrimSpace(s), "?"))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid image parameters. Should be like w=4096&q=0: %s", err)
+	}
+	// These identify the image, so overriding them would just break things.
+	for _, key := range []string{"cid", "p", "src"} {
+		if _, ok := params[key]; ok {
+			return nil, fmt.Errorf("The image parameter %q cannot be overridden.", key)
+		}
+	}
+
+	return params, nil
+}
+
+// Make a ParamsGetter that adds the parameters to get_image calls.
+func ImageParams(params url.Values) ParamsGetter {
+	return func(binb *Api, method string) map[string][]string {
+		if method != "get_image" {
+			return nil
+		}
+		return params
+	}
+}
+
+// Make an ImageParams option for plugins using the API. See ParseImageParams().
+func NewImageParamsOption() *plugins.StringOption {
+	return &plugins.StringOption{K: "ImageParams", Hidden: true,
+		C: "Parameters for get_image in a query string format, e.g. w=4096&q=0, that replace or add to the default h=9999&q=0. For experimenting with getting higher resolutions."}
+}
+
 // ====================================================================
 //                             SBC METHODS
 // ====================================================================
@@ -246,51 +488,21 @@ func (binb *Api) GetContent() error {
 		if !binb.assertP() {
 			return errors.New("Tried to use SBC without a p value set.")
 		}
-		// Start constructing the URL.
-		params := url.Values{}
-		params.Set("cid", binb.Cid)
-		params.Set("p", binb.ContentInfo.P)
-		extraParams := binb.Params(binb, method)
-		for k, v := range extraParams {
-			params[k] = v
-		}
-		url := fmt.Sprintf(sbcApi[method], binb.ContentServer, params.Encode())
-		log.WithField("url", url).Debugf("Calling %s...", method)
-
-		r, err := binb.Session.Get(url)
-		if err != nil {
-			return err
-		}
-		defer r.Body.Close()
-
-		if r.StatusCode != http.StatusOK {
-			return fmt.Errorf("HTTP request returned error code: %d", r.StatusCode)
+		content, err := binb.getSbcContent()
+		if err == errHandshakeRequired {
+			// Some deployments only serve the content after the reader has gone
+			// through content_check and get_request_info, so do it and try again.
+			log.Debug("get_content was refused. Trying again after the handshake...")
+			if err := binb.Handshake(); err != nil {
+				return err
+			}
+			content, err = binb.getSbcContent()
 		}
-
-		s, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			return err
 		}
-		var content ContentResponse
-		if err := json.Unmarshal(s, &content); err != nil {
-			return err
-		}
-		binb.Content = &content
-		paths := reTtxImagePath.FindAllStringSubmatch(content.Ttx, -1)
-		if paths == nil {
-			return errors.New("No image listing found.")
-		}
-		// Populate the Pages and FullPages members.
-		binb.Pages = make([]string, content.SmlImageCnt)
-		binb.FullPages = make([]string, content.SmlImageCnt)
-		for i := 0; i < content.SmlImageCnt; i++ {
-			full := paths[i][1]
-			binb.FullPages[i] = full
-			// For Pages, only keep the base filename.
-			binb.Pages[i] = full[strings.LastIndex(full, "/")+1:]
-		}
-
-		return nil
+		binb.Content = content
+		return binb.setPages(content)
 	case ServerTypeStatic:
 		url := fmt.Sprintf(staticContentUrlFmt, binb.ContentServer)
 		log.WithField("url", url).Debug("Getting content from CDN...")
@@ -298,51 +510,192 @@ func (binb *Api) GetContent() error {
 		r, err := binb.Session.Get(url)
 		if err != nil {
 			return err
-		} else if r.StatusCode != http.StatusOK {
-			return fmt.Errorf("HTTP request returned error code: %d", r.StatusCode)
 		}
 		defer r.Body.Close()
+		if r.StatusCode != http.StatusOK {
+			if err := plugins.CheckGeoRestriction(r); err != nil {
+				return err
+			}
+			return fmt.Errorf("HTTP request returned error code: %d", r.StatusCode)
+		}
 
 		// Data is JS ran through eval().
 		// Format: DataGet_Content(<JSON_GOES_HERE>)
 		s, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			return err
-		} else if len(s) < 17 { // len("DataGet_Content()")
-			return fmt.Errorf("content.js length shorter than expected: %d", len(s))
 		}
 		// Strip the JS and only leave the JSON.
-		s = s[16 : len(s)-1]
+		if s, err = plugins.StripJSONP(s, "DataGet_Content"); err != nil {
+			return err
+		}
 		// Go ahead and unmarshal it.
 		var content ContentResponse
 		if err := json.Unmarshal(s, &content); err != nil {
 			return err
 		}
 		binb.Content = &content
-		paths := reTtxImagePath.FindAllStringSubmatch(content.Ttx, -1)
-		if paths == nil {
-			return errors.New("No image listing found.")
+		return binb.setPages(&content)
+	}
+
+	return fmt.Errorf("Unknown content server type: %d", binb.ServerType)
+}
+
+// Returned by getSbcContent() if the server wants the handshake done first.
+var errHandshakeRequired = errors.New("The content server requires a handshake.")
+
+func (binb *Api) getSbcContent() (*ContentResponse, error) {
+	method := "get_content"
+	params := url.Values{}
+	params.Set("cid", binb.Cid)
+	params.Set("p", binb.ContentInfo.P)
+	extraParams := binb.Params(binb, method)
+	for k, v := range extraParams {
+		params[k] = v
+	}
+	url := fmt.Sprintf(sbcApi[method], binb.ContentServer, params.Encode())
+	log.WithField("url", url).Debugf("Calling %s...", method)
+
+	r, err := binb.Session.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		if err := plugins.CheckGeoRestriction(r); err != nil {
+			return nil, err
+		} else if r.StatusCode == http.StatusForbidden && !binb.handshaken {
+			return nil, errHandshakeRequired
 		}
-		// Populate the Pages and FullPages members.
-		binb.Pages = make([]string, content.SmlImageCnt)
-		binb.FullPages = make([]string, content.SmlImageCnt)
-		for i := 0; i < content.SmlImageCnt; i++ {
-			full := paths[i][1]
-			binb.FullPages[i] = full
-			// For Pages, only keep the base filename.
-			binb.Pages[i] = full[strings.LastIndex(full, "/")+1:]
+		return nil, fmt.Errorf("HTTP request returned error code: %d", r.StatusCode)
+	}
+
+	s, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	var content ContentResponse
+	if err := json.Unmarshal(s, &content); err != nil {
+		return nil, err
+	}
+	// Refusals come back as a bare result without any content.
+	if content.Ttx == "" && !binb.handshaken {
+		return nil, errHandshakeRequired
+	}
+
+	return &content, nil
+}
+
+// Call content_check and get_request_info, which the reader does before getting
+// the content. Most servers don't care, but some refuse get_content without them.
+func (binb *Api) Handshake() error {
+	if err := binb.ContentCheck(); err != nil {
+		return err
+	}
+	if err := binb.GetRequestInfo(); err != nil {
+		return err
+	}
+	binb.handshaken = true
+
+	return nil
+}
+
+// Tell the content server we're about to read the content.
+func (binb *Api) ContentCheck() error {
+	_, err := binb.callSbc("content_check")
+	return err
+}
+
+// Get the request info, which is kept in RequestInfo.
+func (binb *Api) GetRequestInfo() error {
+	res, err := binb.callSbc("get_request_info")
+	if err != nil {
+		return err
+	}
+	binb.RequestInfo = res.Items
+
+	return nil
+}
+
+// Call an SBC method that returns a Response, failing unless the result is 1.
+func (binb *Api) callSbc(method string) (*Response, error) {
+	if !binb.assertP() {
+		return nil, errors.New("Tried to use SBC without a p value set.")
+	}
+	params := url.Values{}
+	params.Set("cid", binb.Cid)
+	params.Set("p", binb.ContentInfo.P)
+	params.Set("k", binb.K)
+	extraParams := binb.Params(binb, method)
+	for k, v := range extraParams {
+		params[k] = v
+	}
+	url := fmt.Sprintf(sbcApi[method], binb.ContentServer, params.Encode())
+	log.WithField("url", url).Debugf("Calling %s...", method)
+
+	r, err := binb.Session.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		if err := plugins.CheckGeoRestriction(r); err != nil {
+			return nil, err
 		}
+		return nil, fmt.Errorf("HTTP request returned error code: %d", r.StatusCode)
+	}
 
-		return nil
+	var res Response
+	if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	if res.Result != 1 {
+		return nil, fmt.Errorf("%s returned result: %d", method, res.Result)
 	}
 
-	return fmt.Errorf("Unknown content server type: %d", binb.ServerType)
+	return &res, nil
+}
+
+// Populate the Images, Pages and FullPages members from the Ttx of the content.
+func (binb *Api) setPages(content *ContentResponse) error {
+	images, err := ParseTtx(content.Ttx)
+	if err != nil {
+		return err
+	}
+
+	// Partial or malformed content can list fewer images than it claims to have.
+	count := content.SmlImageCnt
+	if len(images) < count {
+		log.WithFields(logger.Fields{
+			"count": content.SmlImageCnt,
+			"ttx":   len(images),
+		}).Warn("The image listing has fewer images than the content claims. Only getting the ones listed.")
+		count = len(images)
+	}
+
+	binb.Images = images[:count]
+	binb.Pages = make([]string, count)
+	binb.FullPages = make([]string, count)
+	for i := 0; i < count; i++ {
+		binb.FullPages[i] = images[i].Src
+		// For Pages, only keep the base filename.
+		binb.Pages[i] = images[i].Name()
+	}
+
+	return nil
 }
 
 func (binb *Api) GetImage(page int) (io.ReadCloser, error) {
+	r, _, err := binb.GetImageSized(page)
+	return r, err
+}
+
+// Same as GetImage(), but also returns the size of the image, or -1 if unknown.
+func (binb *Api) GetImageSized(page int) (io.ReadCloser, int64, error) {
 	method := "get_image"
 	if err := binb.ensureContent(method); err != nil {
-		return nil, err
+		return nil, -1, err
 	}
 
 	switch binb.ServerType {
@@ -353,6 +706,7 @@ func (binb *Api) GetImage(page int) (io.ReadCloser, error) {
 		params.Set("p", binb.ContentInfo.P)
 		params.Set("src", binb.FullPages[page])
 		// Some parameters to make the API return the largest image.
+		// Can be overridden through Params. See ParseImageParams().
 		params.Set("h", "9999")
 		params.Set("q", "0")
 		extraParams := binb.Params(binb, method)
@@ -362,40 +716,59 @@ func (binb *Api) GetImage(page int) (io.ReadCloser, error) {
 		url := fmt.Sprintf(sbcApi[method], binb.ContentServer, params.Encode())
 		log.WithField("url", url).Debugf("Calling %s...", method)
 
-		r, err := binb.Session.Get(url)
+		r, err := plugins.RetryGet(binb.Session, url)
 		if err != nil {
-			return nil, err
+			return nil, -1, err
 		} else if r.StatusCode != http.StatusOK {
-			return nil, fmt.Errorf("HTTP request returned error code: %d", r.StatusCode)
+			r.Body.Close()
+			return nil, -1, &plugins.ErrHTTPStatusCode{StatusCode: r.StatusCode}
 		}
 
-		return r.Body, nil
+		body, err := plugins.CheckImageBody(r.Body)
+		if err != nil {
+			return nil, -1, err
+		}
+		return body, r.ContentLength, nil
 	case ServerTypeStatic:
+		var authErr error
 		for _, size := range StaticImageSizes {
 			url := fmt.Sprintf(staticImageUrlFmt, binb.ContentServer, binb.FullPages[page], size)
 			log.WithField("url", url).Debug("Getting image from CDN...")
 
-			r, err := binb.Session.Get(url)
+			r, err := plugins.RetryGet(binb.Session, url)
 			if err != nil {
-				return nil, err
+				return nil, -1, err
 			} else if r.StatusCode == http.StatusNotFound {
+				r.Body.Close()
 				log.WithField("size", size).Debug("Image not found.")
 				continue
 			} else if r.StatusCode != http.StatusOK {
 				// Some servers might return something other than 404 even if
 				// the directory exists but perhaps not that particular image
 				// size, so we do not return an error right away.
+				r.Body.Close()
 				log.Debugf("HTTP request returned error code: %d", r.StatusCode)
+				if err := (&plugins.ErrHTTPStatusCode{StatusCode: r.StatusCode}); plugins.IsAuthFailure(err) {
+					authErr = err
+				}
 				continue
 			}
-			return r.Body, nil
+			body, err := plugins.CheckImageBody(r.Body)
+			if err != nil {
+				return nil, -1, err
+			}
+			return body, r.ContentLength, nil
 		}
 
-		// Tried all image sizes but never got an image.
-		return nil, errors.New("Unable to get image from the CDN.")
+		// Tried all image sizes but never got an image. If we were denied access,
+		// return that so that the caller can tell the session might've expired.
+		if authErr != nil {
+			return nil, -1, authErr
+		}
+		return nil, -1, errors.New("Unable to get image from the CDN.")
 	}
 
-	return nil, fmt.Errorf("Unknown content server type: %d", binb.ServerType)
+	return nil, -1, fmt.Errorf("Unknown content server type: %d", binb.ServerType)
 }
 
 // ====================================================================
@@ -0,0 +1,190 @@
+package binb
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/MinoMino/mindl/plugins"
+)
+
+type sbcResponse struct {
+	status int
+	body   string
+}
+
+// Replays the responses for each SBC method in order, repeating the last one,
+// and records the methods called.
+type sbcServer struct {
+	*httptest.Server
+	responses map[string][]sbcResponse
+	calls     []string
+	m         sync.Mutex
+}
+
+var sbcMethods = map[string]string{
+	"sbcContentCheck.php":   "content_check",
+	"sbcGetRequestInfo.php": "get_request_info",
+	"sbcGetCntnt.php":       "get_content",
+}
+
+func newSbcServer(responses map[string][]sbcResponse) *sbcServer {
+	srv := &sbcServer{responses: responses}
+	srv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method := sbcMethods[path.Base(r.URL.Path)]
+		srv.m.Lock()
+		srv.calls = append(srv.calls, method)
+		res := srv.responses[method]
+		if len(res) == 0 {
+			srv.m.Unlock()
+			http.NotFound(w, r)
+			return
+		}
+		next := res[0]
+		if len(res) > 1 {
+			srv.responses[method] = res[1:]
+		}
+		srv.m.Unlock()
+
+		w.WriteHeader(next.status)
+		w.Write([]byte(next.body))
+	}))
+
+	return srv
+}
+
+func newSbcApi(srv *sbcServer) *Api {
+	api := NewApi("http://bib.invalid", "0001", srv.Client(), nil)
+	api.ContentInfo = &ContentInfoResponse{P: "p"}
+	api.ContentServer = srv.URL
+	api.ServerType = ServerTypeSbc
+	return api
+}
+
+func TestGetContentHandshake(t *testing.T) {
+	data, _ := json.Marshal(ContentResponse{SmlImageCnt: 3, Ttx: ttxSample})
+	content := string(data)
+	ok := sbcResponse{http.StatusOK, `{"result": 1, "items": [{"ContentID": "0001"}]}`}
+	handshake := []string{"get_content", "content_check", "get_request_info", "get_content"}
+
+	tests := []struct {
+		name      string
+		content   []sbcResponse
+		check     sbcResponse
+		calls     []string
+		errSubstr string
+	}{
+		{"not needed", []sbcResponse{{http.StatusOK, content}}, ok, []string{"get_content"}, ""},
+		{"forbidden", []sbcResponse{{http.StatusForbidden, ""}, {http.StatusOK, content}}, ok, handshake, ""},
+		{"empty ttx", []sbcResponse{{http.StatusOK, `{"Ttx": ""}`}, {http.StatusOK, content}}, ok, handshake, ""},
+		{"still forbidden", []sbcResponse{{http.StatusForbidden, ""}}, ok, handshake, "403"},
+		{"refused check", []sbcResponse{{http.StatusForbidden, ""}}, sbcResponse{http.StatusOK, `{"result": 0}`},
+			[]string{"get_content", "content_check"}, "content_check returned result: 0"},
+	}
+
+	for _, test := range tests {
+		srv := newSbcServer(map[string][]sbcResponse{
+			"get_content":      test.content,
+			"content_check":    {test.check},
+			"get_request_info": {ok},
+		})
+		api := newSbcApi(srv)
+		err := api.GetContent()
+		srv.Close()
+
+		if test.errSubstr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.errSubstr) {
+				t.Errorf("%s: expected an error containing %q, got: %v", test.name, test.errSubstr, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if len(api.Pages) != 3 {
+			t.Errorf("%s: expected 3 pages, got %v.", test.name, api.Pages)
+		}
+		if !reflect.DeepEqual(srv.calls, test.calls) {
+			t.Errorf("%s: expected the calls %v, got %v.", test.name, test.calls, srv.calls)
+		}
+		if handshaken := len(test.calls) == len(handshake); handshaken && err == nil && len(api.RequestInfo) != 1 {
+			t.Errorf("%s: expected the request info to be kept, got %v.", test.name, api.RequestInfo)
+		}
+	}
+}
+
+func TestSetPages(t *testing.T) {
+	tests := []struct {
+		count int
+		pages []string
+	}{
+		{3, []string{"cover.jpg", "0001.jpg", "0002.jpg"}},
+		{2, []string{"cover.jpg", "0001.jpg"}},
+		// More than the Ttx lists, e.g. for partial content.
+		{5, []string{"cover.jpg", "0001.jpg", "0002.jpg"}},
+		{0, []string{}},
+	}
+
+	for _, test := range tests {
+		api := NewApi("http://bib.invalid", "0001", nil, nil)
+		if err := api.setPages(&ContentResponse{SmlImageCnt: test.count, Ttx: ttxSample}); err != nil {
+			t.Errorf("SmlImageCnt %d: %s", test.count, err)
+			continue
+		}
+		if !reflect.DeepEqual(api.Pages, test.pages) {
+			t.Errorf("SmlImageCnt %d: expected the pages %v, got %v.", test.count, test.pages, api.Pages)
+		}
+		if len(api.FullPages) != len(test.pages) || len(api.Images) != len(test.pages) {
+			t.Errorf("SmlImageCnt %d: expected %d full pages and images, got %d and %d.",
+				test.count, len(test.pages), len(api.FullPages), len(api.Images))
+		}
+	}
+}
+
+func TestSavePage(t *testing.T) {
+	var img bytes.Buffer
+	if err := jpeg.Encode(&img, image.NewGray(image.Rect(0, 0, 16, 16)), nil); err != nil {
+		t.Fatal(err)
+	}
+	pdf := []byte("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n1 0 obj")
+	encOpts := plugins.EncodeOptions{Lossless: true}
+
+	tests := []struct {
+		name         string
+		data         []byte
+		n            int
+		passThrough  bool
+		noDescramble bool
+		expected     []string
+	}{
+		{"decoded", img.Bytes(), 1, false, false, []string{"Title/0002.png"}},
+		{"passed through", img.Bytes(), 1, true, false, []string{"Title/0002.jpg"}},
+		{"cover", img.Bytes(), 0, false, false, []string{"Title/0001.png", "Title/" + plugins.CoverFilename}},
+		{"passed through cover", img.Bytes(), 0, true, false, []string{"Title/0001.jpg", "Title/" + plugins.CoverFilename}},
+		{"content", pdf, 1, true, false, []string{"Title/0002.pdf"}},
+		{"no descrambling", img.Bytes(), 1, false, true, []string{"Title/0002.jpg" + plugins.ScrambledSuffix}},
+	}
+
+	plugins.SaveCovers = true
+	defer func() {
+		plugins.SaveCovers = false
+		plugins.NoDescramble = false
+	}()
+	for _, test := range tests {
+		plugins.NoDescramble = test.noDescramble
+		api := NewApi("http://bib.invalid", "0001", nil, nil)
+		rep := plugins.NewMemReporter()
+		if err := api.SavePage(rep, "Title", test.n, bytes.NewBuffer(test.data), encOpts, test.passThrough); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if names := rep.Names(); !reflect.DeepEqual(names, test.expected) {
+			t.Errorf("%s: saved %v, expected %v.", test.name, names, test.expected)
+		}
+	}
+}
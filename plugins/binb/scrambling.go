@@ -18,16 +18,19 @@ package binb
 
 import (
 	"errors"
+	"fmt"
 	"image"
 	"io"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 
 	_ "image/jpeg"
 	_ "image/png"
 
 	"github.com/MinoMino/mindl/logger"
+	"github.com/MinoMino/mindl/plugins"
 )
 
 var reType1Key = regexp.MustCompile("^=([0-9]+)-([0-9]+)([-+])([0-9]+)-([-_0-9A-Za-z]+)$")
@@ -53,6 +56,13 @@ const (
 
 const scrambleAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
 
+// Images smaller than this aren't scrambled with type 2 keys,
+// so descrambling them would only mess them up.
+const (
+	minScrambledSide = 64
+	minScrambledArea = 320 * 320
+)
+
 // A single rectangle in a scrambled image.
 type scrambleRectangle struct {
 	src, dst      image.Point
@@ -66,6 +76,27 @@ type scrambleRectanglesCollection struct {
 	dstWidth, dstHeight int
 }
 
+// Get the rectangles in a form that can be exported, with a page they're used for.
+func (col *scrambleRectanglesCollection) rectMap(sample string) *plugins.RectMap {
+	res := &plugins.RectMap{
+		Sample:     sample,
+		SrcWidth:   col.srcWidth,
+		SrcHeight:  col.srcHeight,
+		DstWidth:   col.dstWidth,
+		DstHeight:  col.dstHeight,
+		Rectangles: make([]plugins.DescrambleRect, 0, len(col.rectangles)),
+	}
+	for _, rect := range col.rectangles {
+		res.Rectangles = append(res.Rectangles, plugins.DescrambleRect{
+			SrcX: rect.src.X, SrcY: rect.src.Y,
+			DstX: rect.dst.X, DstY: rect.dst.Y,
+			Width: rect.width, Height: rect.height,
+		})
+	}
+
+	return res
+}
+
 type scrambleDataType1 struct {
 	h, v, padding int
 	src, dst      string
@@ -90,6 +121,16 @@ type Descrambler struct {
 	keyType              scrambleKeyType
 	data                 []interface{}
 	rectangleCollections [][]*scrambleRectanglesCollection
+	pool                 plugins.RGBAPool
+	reported             sync.Once
+}
+
+// How an image gets descrambled, for diagnostics.
+type Layout struct {
+	// The number of rectangles moved around.
+	Rectangles          int
+	SrcWidth, SrcHeight int
+	DstWidth, DstHeight int
 }
 
 func NewDescrambler(ctbl, ptbl []string) (*Descrambler, error) {
@@ -130,7 +171,14 @@ func (ds *Descrambler) init() error {
 	var err error
 
 	for i := 0; i < len(ds.Ctbl); i++ {
-		if ds.Ctbl[i][0] == '=' && ds.Ptbl[i][0] == '=' {
+		if ds.Ctbl[i] == "" || ds.Ptbl[i] == "" {
+			log.WithFields(logger.Fields{
+				"index": i,
+				"ctbl":  ds.Ctbl[i],
+				"ptbl":  ds.Ptbl[i],
+			}).Debug("Got an empty key.")
+			return fmt.Errorf("Scramble key %d is empty.", i)
+		} else if ds.Ctbl[i][0] == '=' && ds.Ptbl[i][0] == '=' {
 			newType = type1
 			data, err = ds.processType1(i)
 		} else if startsWithDigit(ds.Ctbl[i]) && startsWithDigit(ds.Ptbl[i]) {
@@ -363,7 +411,7 @@ func (ds *Descrambler) rectanglesType1(cIndex, pIndex, srcWidth, srcHeight int)
 }
 
 func (ds *Descrambler) rectanglesType2(cIndex, pIndex, srcWidth, srcHeight int) (*scrambleRectanglesCollection, error) {
-	if !(srcWidth >= 64 && srcHeight >= 64 && srcWidth*srcHeight >= 320*320) {
+	if !ds.Scrambles(srcWidth, srcHeight) {
 		log.WithFields(logger.Fields{
 			"srcWidth":  srcWidth,
 			"srcHeight": srcHeight,
@@ -437,6 +485,14 @@ func (ds *Descrambler) Descramble(filename string, reader io.Reader) (image.Imag
 	bounds := img.Bounds()
 	srcWidth := bounds.Dx()
 	srcHeight := bounds.Dy()
+	if !ds.Scrambles(srcWidth, srcHeight) {
+		log.WithFields(logger.Fields{
+			"filename": filename,
+			"width":    srcWidth,
+			"height":   srcHeight,
+		}).Debug("Image is too small to be scrambled. Leaving it as is.")
+		return img, nil
+	}
 
 	c, p := cpIndex(filename)
 
@@ -451,22 +507,30 @@ func (ds *Descrambler) Descramble(filename string, reader io.Reader) (image.Imag
 	*/
 	col := &ds.rectangleCollections[c][p]
 	if *col == nil || (*col != nil && (srcWidth != (*col).srcWidth || srcHeight != (*col).srcHeight)) {
-		switch ds.keyType {
-		case type1:
-			*col, err = ds.rectanglesType1(c, p, srcWidth, srcHeight)
-		case type2:
-			*col, err = ds.rectanglesType2(c, p, srcWidth, srcHeight)
-		default:
-			log.WithField("type", ds.keyType).Debug("Found unknown key type while descrambling.")
-			return nil, errors.New("Tried to descramble with unknown key type.")
+		*col, err = ds.rectangles(c, p, srcWidth, srcHeight)
+		if err == nil {
+			if err := plugins.ExportRects("binb", (*col).rectMap(filename)); err != nil {
+				log.Warnf("Failed to export the rectangles: %s", err)
+			}
 		}
 	}
 
 	if err != nil {
 		return nil, err
 	}
-
-	res := image.NewRGBA(image.Rect(0, 0, (*col).dstWidth, (*col).dstHeight))
+	ds.reported.Do(func() {
+		l, _ := ds.Layout(filename, srcWidth, srcHeight)
+		plugins.ReportDescrambling(log.WithFields(logger.Fields{
+			"key_type":   ds.KeyType(),
+			"keys":       len(ds.Ctbl),
+			"sample":     filename,
+			"rectangles": l.Rectangles,
+			"src":        fmt.Sprintf("%dx%d", l.SrcWidth, l.SrcHeight),
+			"dst":        fmt.Sprintf("%dx%d", l.DstWidth, l.DstHeight),
+		}))
+	})
+
+	res := ds.pool.Get((*col).dstWidth, (*col).dstHeight)
 	for _, rect := range (*col).rectangles {
 		for x := 0; x < rect.width; x++ {
 			for y := 0; y < rect.height; y++ {
@@ -478,6 +542,75 @@ func (ds *Descrambler) Descramble(filename string, reader io.Reader) (image.Imag
 	return res, nil
 }
 
+// The type of the keys, either "type1" or "type2".
+func (ds *Descrambler) KeyType() string {
+	switch ds.keyType {
+	case type1:
+		return "type1"
+	case type2:
+		return "type2"
+	}
+
+	return "unknown"
+}
+
+// Whether or not images of the given size are actually scrambled. Type 2 keys
+// leave small images alone, while type 1 keys scramble images of any size.
+func (ds *Descrambler) Scrambles(width, height int) bool {
+	if ds.keyType != type2 {
+		return true
+	}
+
+	return width >= minScrambledSide && height >= minScrambledSide && width*height >= minScrambledArea
+}
+
+// Get how an image with the given filename and size would be descrambled,
+// without touching the rectangles cached for Descramble().
+func (ds *Descrambler) Layout(filename string, srcWidth, srcHeight int) (*Layout, error) {
+	c, p := cpIndex(filename)
+	col, err := ds.rectangles(c, p, srcWidth, srcHeight)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Layout{
+		Rectangles: len(col.rectangles),
+		SrcWidth:   col.srcWidth,
+		SrcHeight:  col.srcHeight,
+		DstWidth:   col.dstWidth,
+		DstHeight:  col.dstHeight,
+	}, nil
+}
+
+// Get the rectangles an image with the given filename and size would be
+// descrambled with, so that it can be done elsewhere.
+func (ds *Descrambler) RectMap(filename string, srcWidth, srcHeight int) (*plugins.RectMap, error) {
+	c, p := cpIndex(filename)
+	col, err := ds.rectangles(c, p, srcWidth, srcHeight)
+	if err != nil {
+		return nil, err
+	}
+
+	return col.rectMap(filename), nil
+}
+
+func (ds *Descrambler) rectangles(c, p, srcWidth, srcHeight int) (*scrambleRectanglesCollection, error) {
+	switch ds.keyType {
+	case type1:
+		return ds.rectanglesType1(c, p, srcWidth, srcHeight)
+	case type2:
+		return ds.rectanglesType2(c, p, srcWidth, srcHeight)
+	}
+
+	log.WithField("type", ds.keyType).Debug("Found unknown key type while descrambling.")
+	return nil, errors.New("Tried to descramble with unknown key type.")
+}
+
+// Let the descrambler reuse the memory of an image it returned once it's been saved.
+func (ds *Descrambler) Release(img image.Image) {
+	ds.pool.Put(img)
+}
+
 // Helpers.
 
 func tnp(data string, h, v int) ([]int, []int, []int) {
@@ -515,5 +648,5 @@ func cpIndex(filename string) (int, int) {
 }
 
 func startsWithDigit(s string) bool {
-	return '0' <= s[0] && s[0] <= '9'
+	return s != "" && '0' <= s[0] && s[0] <= '9'
 }
@@ -0,0 +1,133 @@
+package binb
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// Type 2 keys for a 2x2 grid, the same for every index.
+func type2Keys() []string {
+	res := make([]string, 8)
+	for i := range res {
+		res[i] = "2-2-AbBaabBA"
+	}
+	return res
+}
+
+func TestNewDescramblerBadKeys(t *testing.T) {
+	tests := []struct {
+		name       string
+		ctbl, ptbl []string
+		// Part of the error message, if it should say something specific.
+		message string
+	}{
+		{"empty ctbl entry", []string{"2-2-AbBaabBA", ""}, []string{"2-2-AbBaabBA", "2-2-AbBaabBA"}, "Scramble key 1 is empty."},
+		{"empty ptbl entry", []string{"2-2-AbBaabBA"}, []string{""}, "Scramble key 0 is empty."},
+		{"single character type 1", []string{"="}, []string{"="}, ""},
+		{"single character type 2", []string{"2"}, []string{"2"}, ""},
+		{"single character unknown", []string{"x"}, []string{"x"}, ""},
+		{"mismatched sizes", []string{"2-2-AbBaabBA"}, nil, ""},
+		{"no keys", nil, nil, ""},
+	}
+
+	for _, test := range tests {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("%s: panicked: %v", test.name, r)
+				}
+			}()
+			_, err := NewDescrambler(test.ctbl, test.ptbl)
+			if err == nil {
+				t.Errorf("%s: expected an error.", test.name)
+			} else if test.message != "" && !strings.Contains(err.Error(), test.message) {
+				t.Errorf("%s: expected an error saying %q, got %q.", test.name, test.message, err)
+			}
+		}()
+	}
+
+	if _, err := NewDescrambler(type2Keys(), type2Keys()); err != nil {
+		t.Errorf("Valid keys: %s", err)
+	}
+}
+
+// Encode a grayscale image of the given size as a PNG.
+func grayPNG(t *testing.T, width, height int) []byte {
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestPageScrambled(t *testing.T) {
+	ds, err := NewDescrambler(type2Keys(), type2Keys())
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &Api{
+		Descrambler: ds,
+		Images: []TtxImage{
+			{Src: "0001.jpg", Width: 1200, Height: 1700},
+			{Src: "0002.jpg", Width: 200, Height: 300},
+			{Src: "0003.jpg", Width: 1200, Height: 40},
+			{Src: "0004.jpg"},
+		},
+	}
+
+	for page, expected := range []bool{true, false, false, true} {
+		if got := api.PageScrambled(page); got != expected {
+			t.Errorf("Page %d: expected PageScrambled() to be %v.", page, expected)
+		}
+	}
+	// Pages missing from the Ttx are assumed to be scrambled.
+	if !api.PageScrambled(10) {
+		t.Error("Expected a page without a size to be considered scrambled.")
+	}
+	// Nothing is scrambled without a descrambler.
+	if (&Api{Images: api.Images}).PageScrambled(0) {
+		t.Error("Expected no page to be scrambled without a descrambler.")
+	}
+}
+
+func TestDescrambleUnscrambled(t *testing.T) {
+	ds, err := NewDescrambler(type2Keys(), type2Keys())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Too small for type 2 keys, so it has to come back untouched.
+	img, err := ds.Descramble("0002.jpg", bytes.NewReader(grayPNG(t, 200, 300)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gray, ok := img.(*image.Gray)
+	if !ok {
+		t.Fatalf("Expected the decoded image as is, got a %T.", img)
+	}
+	if gray.Bounds() != image.Rect(0, 0, 200, 300) {
+		t.Errorf("Expected a 200x300 image, got %v.", gray.Bounds())
+	} else if gray.GrayAt(10, 1) != (color.Gray{Y: 210}) {
+		t.Errorf("The pixels were changed: %v", gray.GrayAt(10, 1))
+	}
+
+	// Large enough to be scrambled, so it goes through the descrambler.
+	img, err = ds.Descramble("0001.jpg", bytes.NewReader(grayPNG(t, 640, 960)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := img.(*image.RGBA); !ok {
+		t.Errorf("Expected a descrambled image, got a %T.", img)
+	} else if img.Bounds() != image.Rect(0, 0, 640, 960) {
+		t.Errorf("Expected a 640x960 image, got %v.", img.Bounds())
+	}
+	ds.Release(img)
+}
@@ -0,0 +1,90 @@
+package binb
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"errors"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var ErrNoTtxImages = errors.New("No image listing found.")
+
+var (
+	reTtxImage     = regexp.MustCompile(`(?is)<t-img\b([^>]*)>`)
+	reTtxAttribute = regexp.MustCompile(`([\w:.-]+)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>/]+))`)
+)
+
+// An image listed in the Ttx of the content, which is markup with a
+// t-img element for each page.
+type TtxImage struct {
+	// The path of the image as used for get_image and the CDN.
+	Src string
+	// The original size of the image, or 0 if the Ttx doesn't say.
+	Width, Height int
+	// The type of page if the Ttx says, otherwise empty.
+	Type string
+	// Every attribute of the element in lowercase, including the above.
+	Attributes map[string]string
+}
+
+// The base filename of the image, which is what the descrambler keys are for.
+func (ti TtxImage) Name() string {
+	return ti.Src[strings.LastIndex(ti.Src, "/")+1:]
+}
+
+// Get the images listed in the Ttx in order. Attributes can be in any order
+// and quoted either way, and the ones we don't know about are ignored.
+func ParseTtx(ttx string) ([]TtxImage, error) {
+	res := make([]TtxImage, 0, 32)
+	for _, tag := range reTtxImage.FindAllStringSubmatch(ttx, -1) {
+		attrs := make(map[string]string)
+		for _, attr := range reTtxAttribute.FindAllStringSubmatch(tag[1], -1) {
+			attrs[strings.ToLower(attr[1])] = html.UnescapeString(attr[2] + attr[3] + attr[4])
+		}
+		src := attrs["src"]
+		if src == "" {
+			continue
+		}
+
+		res = append(res, TtxImage{
+			Src:        src,
+			Width:      ttxSize(attrs, "orgwidth", "width"),
+			Height:     ttxSize(attrs, "orgheight", "height"),
+			Type:       attrs["type"],
+			Attributes: attrs,
+		})
+	}
+
+	if len(res) == 0 {
+		return nil, ErrNoTtxImages
+	}
+	return res, nil
+}
+
+// Get the first of the attributes that's a valid size, or 0 if none are.
+func ttxSize(attrs map[string]string, keys ...string) int {
+	for _, key := range keys {
+		if n, err := strconv.Atoi(strings.TrimSuffix(attrs[key], "px")); err == nil && n > 0 {
+			return n
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,79 @@
+package binb
+
+import (
+	"testing"
+)
+
+// Trimmed down Ttx in the format served by BookLive's content server.
+const ttxSample = `<t-case id="content"><t-cont><t-pb></t-pb><t-img src="pages/cover.jpg" orgwidth="1200" orgheight="1706" type="cover"/></t-cont>` +
+	`<t-cont><t-pb></t-pb><t-img src="pages/0001.jpg" orgwidth="1200" orgheight="1706"/></t-cont>` +
+	`<t-cont><t-pb></t-pb><t-img orgheight="1706" src="pages/0002.jpg" orgwidth="1200" alt="2"/></t-cont></t-case>`
+
+func TestParseTtx(t *testing.T) {
+	images, err := ParseTtx(ttxSample)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []TtxImage{
+		{Src: "pages/cover.jpg", Width: 1200, Height: 1706, Type: "cover"},
+		{Src: "pages/0001.jpg", Width: 1200, Height: 1706},
+		{Src: "pages/0002.jpg", Width: 1200, Height: 1706},
+	}
+	if len(images) != len(expected) {
+		t.Fatalf("Expected %d images, got %d.", len(expected), len(images))
+	}
+	for i, img := range images {
+		e := expected[i]
+		if img.Src != e.Src || img.Width != e.Width || img.Height != e.Height || img.Type != e.Type {
+			t.Errorf("Image #%d: expected %+v, got %+v.", i, e, img)
+		}
+	}
+	if images[2].Attributes["alt"] != "2" {
+		t.Errorf("Expected unknown attributes to be kept, got %v.", images[2].Attributes)
+	}
+	if name := images[1].Name(); name != "0001.jpg" {
+		t.Errorf("Expected the name 0001.jpg, got %s.", name)
+	}
+}
+
+func TestParseTtxVariations(t *testing.T) {
+	tests := []struct {
+		ttx           string
+		src           string
+		width, height int
+	}{
+		// Single quotes, uppercase and escaped entities.
+		{`<T-IMG SRC='a/b&amp;c.jpg' ORGWIDTH='800' ORGHEIGHT='600'>`, "a/b&c.jpg", 800, 600},
+		// Unquoted values and sizes with units, falling back on width and height.
+		{`<t-img src=x.jpg width=640px height=480px />`, "x.jpg", 640, 480},
+		// Spread over several lines with no size.
+		{"<t-img\n\tsrc=\"y.jpg\"\n>", "y.jpg", 0, 0},
+		// Invalid sizes are ignored.
+		{`<t-img src="z.jpg" orgwidth="-1" width="100" orgheight="?">`, "z.jpg", 100, 0},
+	}
+
+	for _, test := range tests {
+		images, err := ParseTtx(test.ttx)
+		if err != nil {
+			t.Errorf("%q: %s", test.ttx, err)
+			continue
+		} else if len(images) != 1 {
+			t.Errorf("%q: expected 1 image, got %d.", test.ttx, len(images))
+			continue
+		}
+		img := images[0]
+		if img.Src != test.src || img.Width != test.width || img.Height != test.height {
+			t.Errorf("%q: expected %s %dx%d, got %s %dx%d.", test.ttx,
+				test.src, test.width, test.height, img.Src, img.Width, img.Height)
+		}
+	}
+}
+
+func TestParseTtxNoImages(t *testing.T) {
+	for _, ttx := range []string{"", `<t-case></t-case>`, `<t-img alt="no source">`} {
+		if _, err := ParseTtx(ttx); err != ErrNoTtxImages {
+			t.Errorf("%q: expected ErrNoTtxImages, got %v.", ttx, err)
+		}
+	}
+}
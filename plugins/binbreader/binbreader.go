@@ -0,0 +1,229 @@
+package binbreader
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Plugin for sites using BinB Reader that don't have a plugin of their own.
+// It talks to the API directly without logging in, so it's mostly useful for
+// free content or sites that don't require a session to read.
+//
+// Usage: mindl -o Api=https://example.com/bib-api/ binb://<cid>
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	neturl "net/url"
+	"regexp"
+	"strings"
+
+	"github.com/MinoMino/mindl/logger"
+	"github.com/MinoMino/mindl/plugins"
+	"github.com/MinoMino/mindl/plugins/binb"
+)
+
+const name = "BinB Reader"
+
+var log = logger.GetLog(name)
+
+var (
+	ErrBinBNoCid      = errors.New("No CID given. Use binb://<cid> or the Cid option.")
+	ErrBinBInvalidApi = errors.New("The Api option should be the URL of the BinB API, e.g. https://example.com/bib-api/")
+)
+
+var Plugin = BinBReader{
+	[]plugins.Option{
+		&plugins.StringOption{K: "Api", Required: true,
+			C: "The base URL of the BinB API, i.e. the URL bibGetCntntInfo.php is under."},
+		&plugins.StringOption{K: "Cid",
+			C: "The content ID. Overrides the one in the URL if set."},
+		&plugins.BoolOption{K: "Lossless", V: false,
+			C: "If set to true, save as PNG. Original images are in JPEG, so you can't escape some artifacts even with this on."},
+		&plugins.IntOption{K: "JPEGQuality", V: 95, Min: 1, Max: 100,
+			C: "Does nothing if Lossless is on. >95 not adviced, as it increases file size a ton with little improvement."},
+		plugins.NewChromaSubsamplingOption(),
+		plugins.NewPNGCompressionOption(),
+		plugins.NewDualOutputOption(),
+		plugins.NewPassThroughJPEGOption(),
+		&plugins.StringOption{K: "Ctbl", Hidden: true,
+			C: "The decrypted ctbl as a JSON array, for when it can't be fetched. Requires Ptbl."},
+		&plugins.StringOption{K: "Ptbl", Hidden: true,
+			C: "The decrypted ptbl as a JSON array, for when it can't be fetched. Requires Ctbl."},
+		&plugins.StringOption{K: "P", Hidden: true,
+			C: "The p value used by the SBC API, for when it can't be fetched."},
+		binb.NewImageParamsOption(),
+		plugins.NewTimeoutOption(),
+	},
+}
+
+var reBinB = regexp.MustCompile(`^binb://(?P<cid>.*)$`)
+
+// For DetectPage().
+var (
+	reBinBInPage = regexp.MustCompile(`(?i)bibGetCntntInfo|bib-api/|binb[\w.-]*\.js`)
+	reCidInUrl   = regexp.MustCompile(`[?&]cid=([\w-]+)`)
+)
+
+func init() {
+	plugins.Register(&Plugin)
+}
+
+type BinBReader struct {
+	options []plugins.Option
+}
+
+func (br *BinBReader) Name() string {
+	return name
+}
+
+func (br *BinBReader) Version() string {
+	return ""
+}
+
+func (br *BinBReader) CanHandle(url string) bool {
+	return reBinB.MatchString(url)
+}
+
+func (br *BinBReader) Options() []plugins.Option {
+	return br.options
+}
+
+func (br *BinBReader) DownloadGenerator(url string) (dlgen func() plugins.Downloader, length int) {
+	// Initialization.
+	opts := plugins.OptionsToMap(br.options)
+	encOpts := plugins.EncodeOptionsFromMap(opts)
+	passThrough := opts["PassThroughJPEG"].(bool) && !encOpts.Lossless
+	cid, err := getCid(url, opts)
+	if err != nil {
+		panic(err)
+	}
+
+	imageParams, err := binb.ParseImageParams(opts["ImageParams"].(string))
+	if err != nil {
+		panic(err)
+	}
+	api := binb.NewApi(opts["Api"].(string), cid, plugins.NewHTTPClient(plugins.PluginTimeout(opts)), binb.ImageParams(imageParams))
+	if err := api.SetKeys(opts["Ctbl"].(string), opts["Ptbl"].(string), opts["P"].(string)); err != nil {
+		panic(err)
+	}
+	if err := api.GetContent(); err != nil {
+		panic(err)
+	}
+	length = len(api.Pages)
+
+	dir := plugins.NormalizeTitle(api.ContentInfo.Title)
+	if dir == "" {
+		dir = cid
+	}
+	log.Infof("Downloading \"%s\" with %d pages...", dir, length)
+
+	i := 0
+	// Generator.
+	dlgen = func() plugins.Downloader {
+		if i >= length {
+			return nil
+		}
+
+		i++
+		// Downloader
+		return func(n int, rep plugins.Reporter) error {
+			r, size, err := api.GetImageSized(n)
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+
+			buf := &bytes.Buffer{}
+			// Download through the reporter.
+			if _, err := rep.CopySized(buf, r, size); err != nil {
+				return err
+			}
+
+			return api.SavePage(rep, dir, n, buf, encOpts, passThrough)
+		}
+	}
+	return
+}
+
+func (br *BinBReader) Validate() error {
+	opts := plugins.OptionsToMap(br.options)
+	if u, err := neturl.ParseRequestURI(opts["Api"].(string)); err != nil || u.Host == "" {
+		return ErrBinBInvalidApi
+	}
+	if _, err := binb.ParseImageParams(opts["ImageParams"].(string)); err != nil {
+		return err
+	}
+	_, _, err := binb.ParseKeys(opts["Ctbl"].(string), opts["Ptbl"].(string))
+	return err
+}
+
+// Lists the content in the same series through BinB's bibliography.
+func (br *BinBReader) ListVolumes(url string) ([]plugins.Volume, error) {
+	opts := plugins.OptionsToMap(br.options)
+	cid, err := getCid(url, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	api := binb.NewApi(opts["Api"].(string), cid, plugins.NewHTTPClient(plugins.PluginTimeout(opts)), nil)
+	items, err := api.GetBibliography()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]plugins.Volume, 0, len(items))
+	for _, item := range items {
+		res = append(res, plugins.Volume{
+			Title: plugins.NormalizeTitle(item.Title),
+			URL:   "binb://" + item.ContentID,
+		})
+	}
+
+	return res, nil
+}
+
+// Get the CID from the Cid option, or from the URL if it's not set.
+func getCid(url string, opts map[string]interface{}) (string, error) {
+	cid := opts["Cid"].(string)
+	if cid == "" {
+		cid = strings.TrimSuffix(reBinB.FindStringSubmatch(url)[1], "/")
+	}
+	if cid == "" {
+		return "", ErrBinBNoCid
+	}
+
+	return cid, nil
+}
+
+// There's no site to check, only the API the user pointed us to.
+func (br *BinBReader) Preflight(url string) error {
+	return plugins.CheckReachable(plugins.OptionsToMap(br.options)["Api"].(string))
+}
+
+// Readers on unknown sites are recognized by the BinB API or scripts they reference.
+// The content ID is taken from the cid parameter of the URL, like BinB readers use.
+func (br *BinBReader) DetectPage(url string, page []byte) (string, string, bool) {
+	sig := reBinBInPage.Find(page)
+	cid := reCidInUrl.FindStringSubmatch(url)
+	if sig == nil || cid == nil {
+		return "", "", false
+	}
+
+	return fmt.Sprintf("reference to %q (set the Api option to the URL of the BinB API)", sig), "binb://" + cid[1], true
+}
+
+func (br *BinBReader) Cleanup(err error) {
+
+}
@@ -17,11 +17,11 @@ package booklive
 // along with this program.  If not, see <http://www.gnu.org/licenses/>.
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
-	"image/jpeg"
-	"image/png"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -29,11 +29,11 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/MinoMino/mindl/logger"
 	"github.com/MinoMino/mindl/plugins"
 	"github.com/MinoMino/mindl/plugins/binb"
-	"golang.org/x/text/unicode/norm"
 )
 
 const name = "BookLive"
@@ -45,24 +45,46 @@ var (
 	ErrBookLiveUnknownUrl  = errors.New("URL could not be parsed.")
 	ErrBookLiveFailedLogin = errors.New("Failed to login. Wrong credentials?")
 	ErrBookLiveLoginScreen = errors.New("Error while getting login token.")
+	ErrBookLiveBadSession  = errors.New("The session from the supplied cookies is not valid.")
+	ErrBookLiveNoPreview   = errors.New("No preview is available for this content.")
 )
 
 var Plugin = BookLive{
-	[]plugins.Option{
+	options: []plugins.Option{
 		&plugins.StringOption{K: "Username", Required: true},
-		&plugins.StringOption{K: "Password", Required: true},
+		plugins.NewPasswordOption("Password", true),
 		&plugins.BoolOption{K: "Lossless", V: false,
 			C: "If set to true, save as PNG. Original images are in JPEG, so you can't escape some artifacts even with this on."},
-		&plugins.IntOption{K: "JPEGQuality", V: 95,
+		&plugins.IntOption{K: "JPEGQuality", V: 95, Min: 1, Max: 100,
 			C: "Does nothing if Lossless is on. >95 not adviced, as it increases file size a ton with little improvement."},
-		&plugins.BoolOption{K: "Metadata", V: true},
+		plugins.NewChromaSubsamplingOption(),
+		plugins.NewPNGCompressionOption(),
+		plugins.NewDualOutputOption(),
+		plugins.NewPassThroughJPEGOption(),
+		plugins.NewDirectoryOption(),
+		plugins.NewTimeoutOption(),
+		&plugins.StringOption{K: "Ctbl", Hidden: true,
+			C: "The decrypted ctbl as a JSON array, for when it can't be fetched. Requires Ptbl."},
+		&plugins.StringOption{K: "Ptbl", Hidden: true,
+			C: "The decrypted ptbl as a JSON array, for when it can't be fetched. Requires Ctbl."},
+		&plugins.StringOption{K: "P", Hidden: true,
+			C: "The p value used by the SBC API, for when it can't be fetched."},
+		binb.NewImageParamsOption(),
+		&plugins.BoolOption{K: "SaveScrambled", V: false,
+			C: "If set to true, also save the images as they were before descrambling, with a .scrambled suffix. Useful for reporting descrambling bugs."},
+		&plugins.BoolOption{K: "Metadata", V: true,
+			C: "If set to true, write the title, series and volume to a ComicInfo.xml file in the download directory."},
 	},
 }
 
+// How many times we can log in again if the session expires mid-download.
+const maxReauths = 2
+
 const (
 	urlApi         = "https://booklive.jp/bib-api/"
 	urlLoginScreen = "https://booklive.jp/login"
 	urlLogin       = "https://booklive.jp/login/index"
+	urlBookFmt     = "https://booklive.jp/product/index/title_id/%s/vol_no/%s"
 )
 
 var urlBookLive, _ = url.ParseRequestURI("https://booklive.jp/")
@@ -71,11 +93,24 @@ var (
 	reBook        = regexp.MustCompile(`^https?://booklive.jp/product/index/title_id/(?P<title_id>[0-9]+?)/vol_no/(?P<volume>[0-9]+?)$`)
 	reReader      = regexp.MustCompile(`^https?://booklive.jp/bviewer/\?cid=(?P<cid>[_0-9]+)`)
 	reTokenSearch = regexp.MustCompile(`input type="hidden" name="token" value="(.+?)">`)
-	reTitleClean  = regexp.MustCompile(`.+?( ?\([0-9]+\)| ?[0-9]+巻)$`)
+	// Titles are matched before normalization, so full-width forms are matched too.
+	reTitleClean = regexp.MustCompile(`.+?([ 　]?[(（][0-9０-９]+[)）]|[ 　]?[0-9０-９]+巻)$`)
+	// For DetectPage().
+	reBookInPage   = regexp.MustCompile(`booklive\.jp/product/index/title_id/([0-9]+)/vol_no/([0-9]+)`)
+	reReaderInPage = regexp.MustCompile(`booklive\.jp/bviewer/(?:s/)?\?cid=([0-9]+_[0-9]+)`)
 )
 
+func init() {
+	plugins.Register(&Plugin)
+}
+
 type BookLive struct {
-	options []plugins.Option
+	options  []plugins.Option
+	metadata *plugins.Metadata
+	// RequiresAuth() results by cid, so that it doesn't ask BinB again
+	// whenever the same URL comes up, e.g. for every volume of a series.
+	authRequired map[string]bool
+	authM        sync.Mutex
 }
 
 func (bl *BookLive) Name() string {
@@ -94,31 +129,178 @@ func (bl *BookLive) Options() []plugins.Option {
 	return bl.options
 }
 
+// BinB serves the content info of free titles without a session, so we
+// check if we can get it before asking the user for credentials. The result
+// is cached per cid.
+func (bl *BookLive) RequiresAuth(url string) bool {
+	client := plugins.NewHTTPClient(plugins.PluginTimeout(plugins.OptionsToMap(bl.options)))
+	plugins.LoadUserCookies(client.Jar, urlBookLive)
+	if bl.hasSession(client) {
+		return false
+	}
+
+	cid, _ := bl.getCidAndVolume(url)
+	bl.authM.Lock()
+	defer bl.authM.Unlock()
+	if res, ok := bl.authRequired[cid]; ok {
+		return res
+	}
+
+	res := false
+	api := binb.NewApi(urlApi, cid, client, nil)
+	if err := api.GetContentInfo(); err != nil {
+		log.WithField("error", err).Debug("Content info not available without logging in.")
+		res = true
+	}
+	if bl.authRequired == nil {
+		bl.authRequired = make(map[string]bool)
+	}
+	bl.authRequired[cid] = res
+
+	return res
+}
+
+// Lists the volumes through BinB's bibliography, which works with the URL of any
+// volume in the series. BinB doesn't tell us what the user owns, though.
+func (bl *BookLive) ListVolumes(url string) ([]plugins.Volume, error) {
+	cid, _, err := parseCidAndVolume(url)
+	if err != nil {
+		return nil, err
+	}
+	client := plugins.NewHTTPClient(plugins.PluginTimeout(plugins.OptionsToMap(bl.options)))
+	plugins.LoadUserCookies(client.Jar, urlBookLive)
+
+	items, err := binb.NewApi(urlApi, cid, client, nil).GetBibliography()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]plugins.Volume, 0, len(items))
+	for _, item := range items {
+		vol := plugins.Volume{Title: plugins.NormalizeTitle(item.Title)}
+		if split := strings.Split(item.ContentID, "_"); len(split) == 2 {
+			vol.URL = fmt.Sprintf(urlBookFmt, split[0], split[1])
+			if n, err := strconv.Atoi(split[1]); err == nil {
+				vol.Number = strconv.Itoa(n)
+			}
+		}
+		res = append(res, vol)
+	}
+
+	return res, nil
+}
+
+// The API is on the same site, so the login screen being up is good enough.
+func (bl *BookLive) Preflight(url string) error {
+	return plugins.CheckReachable(urlLoginScreen)
+}
+
+// Pages that embed or link to the reader have the content ID in the reader's URL.
+func (bl *BookLive) DetectPage(url string, page []byte) (string, string, bool) {
+	if m := reBookInPage.FindSubmatch(page); m != nil {
+		return "link to a BookLive product page", fmt.Sprintf(urlBookFmt, m[1], m[2]), true
+	} else if m := reReaderInPage.FindSubmatch(page); m != nil {
+		return "link to the BookLive reader", "https://booklive.jp/bviewer/?cid=" + string(m[1]), true
+	}
+
+	return "", "", false
+}
+
+// Whether BinB serves any pages of the content without a session can only be told
+// once we ask it for the content, so any content URL is accepted here, and the
+// download fails with ErrBookLiveNoPreview if it has none.
+func (bl *BookLive) HasPreview(url string) bool {
+	_, _, err := parseCidAndVolume(url)
+	return err == nil
+}
+
+// Catch bad keys before we start downloading rather than after logging in.
+func (bl *BookLive) Validate() error {
+	opts := plugins.OptionsToMap(bl.options)
+	if _, err := binb.ParseImageParams(opts["ImageParams"].(string)); err != nil {
+		return err
+	}
+	_, _, err := binb.ParseKeys(opts["Ctbl"].(string), opts["Ptbl"].(string))
+	return err
+}
+
+func (bl *BookLive) AuthOptions() []string {
+	return []string{"Username", "Password"}
+}
+
 func (bl *BookLive) DownloadGenerator(url string) (dlgen func() plugins.Downloader, length int) {
 	// Initialization.
-	var ext string
 	cid, volume := bl.getCidAndVolume(url)
 	opts := plugins.OptionsToMap(bl.options)
-	if opts["Lossless"].(bool) {
-		ext = "png"
+	encOpts := plugins.EncodeOptionsFromMap(opts)
+	passThrough := opts["PassThroughJPEG"].(bool) && !encOpts.Lossless
+	// With descrambling off, SavePage() saves the scrambled images by itself.
+	saveScrambled := opts["SaveScrambled"].(bool) && !plugins.NoDescramble
+	client := plugins.NewHTTPClient(plugins.PluginTimeout(opts))
+	var session bool
+	creds := plugins.NewCredentialProvider(opts["Username"].(string), opts["Password"].(string))
+	if plugins.Preview {
+		// BinB only serves the preview of content we don't own without a session.
+		log.Info("Downloading the preview without logging in...")
 	} else {
-		ext = "jpg"
+		plugins.LoadUserCookies(client.Jar, urlBookLive)
+		if session = bl.hasSession(client); session {
+			log.Info("Using the session from the supplied cookies...")
+		} else if creds.Current().Username == "" {
+			log.Info("No credentials given. Downloading without logging in...")
+		} else {
+			acc := creds.Current()
+			bl.login(client, acc.Username, acc.Password)
+		}
+	}
+	// Long downloads can outlive the session, so log in again if need be.
+	// A session from cookies can't be renewed without credentials, though.
+	// With multiple accounts, the next one is used instead in case we hit a limit.
+	reauth := plugins.NewReauthenticator(maxReauths*creds.Len(), func() (err error) {
+		if session {
+			return ErrBookLiveBadSession
+		} else if plugins.Preview {
+			return ErrBookLiveNoPreview
+		}
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("Failed to re-authenticate: %v", r)
+			}
+		}()
+		if creds.Rotate() {
+			log.Infof("Switching to account: %s", creds.Current().Username)
+		}
+		acc := creds.Current()
+		bl.login(client, acc.Username, acc.Password)
+		return
+	})
+	imageParams, err := binb.ParseImageParams(opts["ImageParams"].(string))
+	if err != nil {
+		panic(err)
+	}
+	api := binb.NewApi(urlApi, cid, client, binb.ImageParams(imageParams))
+	if err := api.SetKeys(opts["Ctbl"].(string), opts["Ptbl"].(string), opts["P"].(string)); err != nil {
+		panic(err)
 	}
-	client := plugins.NewHTTPClient(20)
-	bl.login(client, opts["Username"].(string), opts["Password"].(string))
-	api := binb.NewApi(urlApi, cid, client, nil)
 	if err := api.GetContent(); err != nil {
+		// The API is the first thing that'll fail with an expired or invalid session.
+		if _, geo := err.(*plugins.ErrGeoRestricted); session && !geo {
+			log.Error(err)
+			panic(ErrBookLiveBadSession)
+		}
 		panic(err)
 	}
-	length = len(api.Pages)
-
-	// Clean up the title from the volume inserted by them, then apply it ourselves.
-	title := norm.NFKC.String(api.ContentInfo.Title)
-	re := reTitleClean.FindStringSubmatch(title)
-	if re != nil {
-		title = title[:len(title)-len(re[1])]
+	if plugins.Preview && len(api.Pages) == 0 {
+		panic(ErrBookLiveNoPreview)
 	}
+	length = plugins.PreviewLength(len(api.Pages))
+
+	title := plugins.NormalizeTitle(cleanTitle(api.ContentInfo.Title))
 	dir := fmt.Sprintf("%s 第%02d巻", title, volume)
+	if plugins.Preview {
+		dir += plugins.PreviewSuffix
+	}
+	bl.metadata = &plugins.Metadata{Title: dir, Series: title, Volume: strconv.Itoa(volume)}
+	dir = plugins.DirectoryName(opts, dir)
 
 	i := 0
 	// Generator.
@@ -130,44 +312,71 @@ func (bl *BookLive) DownloadGenerator(url string) (dlgen func() plugins.Download
 		i++
 		// Downloader
 		return func(n int, rep plugins.Reporter) error {
-			r, err := api.GetImage(n)
+			var r io.ReadCloser
+			var size int64
+			err := reauth.Do(func() (err error) {
+				r, size, err = api.GetImageSized(n)
+				return
+			})
 			if err != nil {
 				return err
 			}
 			defer r.Close()
 
+			// If we don't need the original file, decode it as it comes in
+			// rather than keeping a copy of it around while decoding.
+			if plugins.CanStream() && !saveScrambled && !passThrough && !plugins.NoDescramble {
+				stream := plugins.StreamSized(rep, r, size)
+				defer stream.Close()
+				br := bufio.NewReader(stream)
+				// Not everything in a book is necessarily an image.
+				if head, _ := br.Peek(512); plugins.IsContent(head) {
+					data, err := ioutil.ReadAll(br)
+					if err != nil {
+						return err
+					}
+					path := filepath.Join(dir, fmt.Sprintf("%04d", n+1))
+					return plugins.SaveContent(rep, path, data, encOpts)
+				}
+				return api.SaveImage(rep, dir, n, br, encOpts)
+			}
+
 			buf := &bytes.Buffer{}
 			// Download through the reporter.
-			if _, err := rep.Copy(buf, r); err != nil {
+			if _, err := rep.CopySized(buf, r, size); err != nil {
 				return err
 			}
 
-			img, err := api.Descrambler.Descramble(api.Pages[n], buf)
-			path := filepath.Join(dir, fmt.Sprintf("%04d.%s", n+1, ext))
-			if opts["Lossless"].(bool) {
-				// Save as PNG.
-				w, err := rep.FileWriter(path, false)
-				if err != nil {
-					panic(err)
-				}
-				defer w.Close()
-
-				enc := png.Encoder{}
-				return enc.Encode(w, img)
-			} else {
-				// Save as JPEG.
-				w, err := rep.FileWriter(path, false)
-				if err != nil {
-					panic(err)
+			if saveScrambled {
+				scrambled := filepath.Join(dir, fmt.Sprintf("%04d.jpg", n+1)+plugins.ScrambledSuffix)
+				if _, err := rep.SaveData(scrambled, bytes.NewReader(buf.Bytes()), false); err != nil {
+					return err
 				}
-				defer w.Close()
-				return jpeg.Encode(w, img, &jpeg.Options{Quality: opts["JPEGQuality"].(int)})
 			}
+
+			return api.SavePage(rep, dir, n, buf, encOpts, passThrough)
 		}
 	}
 	return
 }
 
+// Clean up the title from the volume inserted by them, so that we can apply it ourselves.
+func cleanTitle(title string) string {
+	if re := reTitleClean.FindStringSubmatch(title); re != nil {
+		return title[:len(title)-len(re[1])]
+	}
+
+	return title
+}
+
+func (bl *BookLive) Metadata() *plugins.Metadata {
+	if !plugins.OptionsToMap(bl.options)["Metadata"].(bool) {
+		return nil
+	}
+
+	return bl.metadata
+}
+
 func (bl *BookLive) Cleanup(err error) {
 
 }
@@ -213,41 +422,57 @@ func (bl *BookLive) login(client *http.Client, username, password string) {
 	}
 
 	// Confirm we logged in by checking cookies.
-	var logged bool
+	if !bl.hasSession(client) {
+		panic(ErrBookLiveFailedLogin)
+	}
+	log.Debug("Logged in!")
+}
+
+// Whether or not the client has a session cookie, either from logging
+// in or from cookies supplied by the user.
+func (bl *BookLive) hasSession(client *http.Client) bool {
 	for _, cookie := range client.Jar.Cookies(urlBookLive) {
 		if cookie.Name == "BL_LI" {
-			log.WithField("session", cookie.Value).Debug("Logged in!")
-			logged = true
-			break
+			log.WithField("session", cookie.Value).Debug("Found session cookie.")
+			return true
 		}
 	}
-	if !logged {
-		panic(ErrBookLiveFailedLogin)
+
+	return false
+}
+
+func (bl *BookLive) Parse(url string) (map[string]string, error) {
+	cid, volume, err := parseCidAndVolume(url)
+	if err != nil {
+		return nil, err
 	}
+
+	return map[string]string{"cid": cid, "volume": strconv.Itoa(volume)}, nil
 }
 
 func (bl *BookLive) getCidAndVolume(url string) (cid string, volume int) {
-	var err error
+	cid, volume, err := parseCidAndVolume(url)
+	if err != nil {
+		panic(err)
+	}
+
+	return
+}
+
+func parseCidAndVolume(url string) (cid string, volume int, err error) {
 	if re := reBook.FindStringSubmatch(url); re != nil {
 		cid = re[1] + "_" + re[2]
 		volume, err = strconv.Atoi(re[2])
-		if err != nil {
-			panic(err)
-		}
 	} else if re := reReader.FindStringSubmatch(url); re != nil {
 		cid = re[1]
 		split := strings.Split(cid, "_")
-		if len(split) < 2 {
-			panic(ErrBookLiveUnknownCid)
+		if len(split) < 2 || split[0] == "" || split[1] == "" {
+			return "", 0, ErrBookLiveUnknownCid
 		}
 
 		volume, err = strconv.Atoi(split[1])
-		if err != nil {
-			panic(err)
-		}
 	} else {
-		// Should never happen.
-		panic(ErrBookLiveUnknownUrl)
+		err = ErrBookLiveUnknownUrl
 	}
 
 	return
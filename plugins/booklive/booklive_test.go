@@ -0,0 +1,25 @@
+package booklive
+
+import "testing"
+
+func TestCleanTitle(t *testing.T) {
+	tests := []struct {
+		title, expected string
+	}{
+		{"ワンパンマン", "ワンパンマン"},
+		{"ワンパンマン 12巻", "ワンパンマン"},
+		{"ワンパンマン12巻", "ワンパンマン"},
+		{"ワンパンマン (12)", "ワンパンマン"},
+		{"ワンパンマン(12)", "ワンパンマン"},
+		// What the site actually returns, before any normalization.
+		{"ワンパンマン　１２巻", "ワンパンマン"},
+		{"ワンパンマン　（１２）", "ワンパンマン"},
+		{"ワンパンマン（12）", "ワンパンマン"},
+	}
+
+	for _, test := range tests {
+		if res := cleanTitle(test.title); res != test.expected {
+			t.Errorf("cleanTitle(%q) = %q, expected %q.", test.title, res, test.expected)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"math/rand"
+	"net/http"
 	"net/url"
 	"strconv"
 	"time"
@@ -21,6 +22,7 @@ var (
 	ErrBookWalkerNoContent     = errors.New("Failed to get book content info.")
 	ErrBookWalkerFailedContent = errors.New("Failed to process content info.")
 	ErrBookWalkerNoConfig      = errors.New("Content info had no configuration key.")
+	ErrBookWalkerUnknownUrl    = errors.New("Only book pages (https://bookwalker.jp/de...) are supported.")
 )
 
 func (bw *BookWalker) login(username, password string) {
@@ -71,7 +73,10 @@ func (bw *BookWalker) getBookSession(cid string) (*BookSession, error) {
 	plugins.PanicForStatus(r, "Did the API change?")
 
 	bookparams.Set("BID", bid)
-	myurl = urlApi + "/c?" + bookparams.Encode()
+	return bw.requestBookSession(urlApi + "/c?" + bookparams.Encode())
+}
+
+func (bw *BookWalker) requestBookSession(myurl string) (*BookSession, error) {
 	log.WithField("url", myurl).Debug("Getting book session...")
 	r2, err := bw.client.Do(plugins.NewGetRequestUA(myurl, plugins.IE11UserAgent))
 	if err != nil {
@@ -96,13 +101,8 @@ func (bw *BookWalker) getBookSession(cid string) (*BookSession, error) {
 }
 
 func (bw *BookWalker) getContentInfo() (*BookConfig, []*BookContent, error) {
-	params := url.Values{}
-	params.Set("hti", bw.session.AuthInfo.Hti)
-	params.Set("cfg", strconv.Itoa(bw.session.AuthInfo.Config))
-	params.Set("Policy", bw.session.AuthInfo.Policy)
-	params.Set("Signature", bw.session.AuthInfo.Signature)
-	params.Set("Key-Pair-Id", bw.session.AuthInfo.KeyPairId)
-	myurl := bw.session.Url + "configuration_pack.json" + "?" + params.Encode()
+	session := bw.currentSession()
+	myurl := session.Url + "configuration_pack.json" + "?" + session.authParams().Encode()
 	log.WithField("url", myurl).Debug("Getting content info...")
 	r, err := bw.client.Do(plugins.NewGetRequestUA(myurl, plugins.IE11UserAgent))
 	if err != nil {
@@ -140,23 +140,38 @@ func (bw *BookWalker) getContentInfo() (*BookConfig, []*BookContent, error) {
 	return &config, pages, nil
 }
 
-func (bw *BookWalker) getImage(page, subpage int) (io.ReadCloser, error) {
-	baseurl := bw.session.Url + bw.content[page-1].FilePath + "/" + strconv.Itoa(subpage) + ".jpeg"
-	params := url.Values{}
-	params.Set("hti", bw.session.AuthInfo.Hti)
-	params.Set("cfg", strconv.Itoa(bw.session.AuthInfo.Config))
-	params.Set("Policy", bw.session.AuthInfo.Policy)
-	params.Set("Signature", bw.session.AuthInfo.Signature)
-	params.Set("Key-Pair-Id", bw.session.AuthInfo.KeyPairId)
-	myurl := baseurl + "?" + params.Encode()
+// Returns the image and its size, which is -1 if unknown.
+func (bw *BookWalker) getImage(page, subpage int) (io.ReadCloser, int64, error) {
+	session := bw.currentSession()
+	baseurl := session.Url + bw.content[page-1].FilePath + "/" + strconv.Itoa(subpage) + ".jpeg"
+	myurl := baseurl + "?" + session.authParams().Encode()
 	//log.WithField("url", myurl).Debug("Getting image...")
-	r, err := bw.client.Do(plugins.NewGetRequestUA(myurl, plugins.IE11UserAgent))
+	r, err := plugins.RetryRequest(bw.client, plugins.NewGetRequestUA(myurl, plugins.IE11UserAgent))
 	if err != nil {
-		return nil, err
+		return nil, -1, err
+	} else if r.StatusCode != http.StatusOK {
+		// Return rather than panic so that the caller can re-authenticate if need be.
+		r.Body.Close()
+		log.Errorf("Status code: %s | Failed to get image.", r.Status)
+		return nil, -1, &plugins.ErrHTTPStatusCode{StatusCode: r.StatusCode}
 	}
-	plugins.PanicForStatus(r, "Failed to get image.")
 
-	return r.Body, nil
+	body, err := plugins.CheckImageBody(r.Body)
+	if err != nil {
+		return nil, -1, err
+	}
+	return body, r.ContentLength, nil
+}
+
+// The query parameters that authenticate requests for the content of the session.
+func (bs *BookSession) authParams() url.Values {
+	params := url.Values{}
+	params.Set("hti", bs.AuthInfo.Hti)
+	params.Set("cfg", strconv.Itoa(bs.AuthInfo.Config))
+	params.Set("Policy", bs.AuthInfo.Policy)
+	params.Set("Signature", bs.AuthInfo.Signature)
+	params.Set("Key-Pair-Id", bs.AuthInfo.KeyPairId)
+	return params
 }
 
 func getBrowserId(suffix string) string {
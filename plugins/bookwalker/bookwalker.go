@@ -19,19 +19,18 @@ package bookwalker
 import (
 	"bytes"
 	"fmt"
-	"image/jpeg"
-	"image/png"
+	"io"
 	"math/rand"
 	"net/http"
 	"net/url"
 	"path/filepath"
 	"regexp"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/MinoMino/mindl/logger"
 	"github.com/MinoMino/mindl/plugins"
-	"golang.org/x/text/unicode/norm"
 )
 
 const name = "BookWalker"
@@ -41,11 +40,18 @@ var log = logger.GetLog(name)
 var Plugin = BookWalker{
 	options: []plugins.Option{
 		&plugins.StringOption{K: "Username", Required: true},
-		&plugins.StringOption{K: "Password", Required: true},
+		plugins.NewPasswordOption("Password", true),
 		&plugins.BoolOption{K: "Lossless", V: false,
 			C: "If set to true, save as PNG. Original images are in JPEG, so you can't escape some artifacts even with this on."},
-		&plugins.IntOption{K: "JPEGQuality", V: 95,
+		&plugins.IntOption{K: "JPEGQuality", V: 95, Min: 1, Max: 100,
 			C: "Does nothing if Lossless is on. >95 not adviced, as it increases file size a ton with little improvement."},
+		plugins.NewChromaSubsamplingOption(),
+		plugins.NewPNGCompressionOption(),
+		plugins.NewDualOutputOption(),
+		plugins.NewDirectoryOption(),
+		plugins.NewTimeoutOption(),
+		&plugins.BoolOption{K: "SaveScrambled", V: false,
+			C: "If set to true, also save the images as they were before descrambling, with a .scrambled suffix. Useful for reporting descrambling bugs."},
 		//&plugins.BoolOption{K: "Metadata", V: true},
 
 		// Temporarily disable the plugin.
@@ -64,6 +70,9 @@ const (
 	urlLogout      = "https://member.bookwalker.jp/app/03/logout"
 
 	browserIdSuffix = "NFBR"
+
+	// How many times we can log in again if the session expires mid-download.
+	maxReauths = 2
 )
 
 var urlBookLive, _ = url.ParseRequestURI("https://member.bookwalker.jp/")
@@ -73,7 +82,12 @@ var reReader = regexp.MustCompile(`^https?://booklive.jp/bviewer/\?cid=(?P<cid>[
 var reTokenSearch = regexp.MustCompile(`input type="hidden" name="token" value="(.+?)">`)
 var reProfile = regexp.MustCompile(`^https?://member.bookwalker.jp/app/03/my/profile`)
 
+// For DetectPage(). The viewer takes the same content ID as book pages have.
+var reViewerInPage = regexp.MustCompile(`viewer(?:-trial)?\.bookwalker\.jp/[^"'\s]*?[?&]cid=([a-zA-Z0-9]+-[a-zA-Z0-9]+-[a-zA-Z0-9]+-[a-zA-Z0-9]+-[a-zA-Z0-9]+)`)
+var reBookInPage = regexp.MustCompile(`bookwalker\.jp/de([a-zA-Z0-9]+-[a-zA-Z0-9]+-[a-zA-Z0-9]+-[a-zA-Z0-9]+-[a-zA-Z0-9]+)`)
+
 func init() {
+	plugins.Register(&Plugin)
 	// Otherwise we have deterministic generation of the browser ID.
 	rand.Seed(time.Now().UnixNano())
 }
@@ -84,6 +98,10 @@ type BookWalker struct {
 	session *BookSession
 	config  *BookConfig
 	content []*BookContent
+	reauth  *plugins.Reauthenticator
+	// Guards session, which is replaced by whichever worker re-authenticates
+	// while the others are still reading it.
+	sessionm sync.RWMutex
 }
 
 func (bw *BookWalker) Name() string {
@@ -102,47 +120,121 @@ func (bw *BookWalker) Options() []plugins.Option {
 	return bw.options
 }
 
+func (bw *BookWalker) Parse(url string) (map[string]string, error) {
+	re := reBook.FindStringSubmatch(url)
+	if re == nil {
+		return nil, ErrBookWalkerUnknownUrl
+	}
+
+	return map[string]string{"cid": re[1]}, nil
+}
+
+// BookWalker doesn't implement plugins.Previewer. Its trial viewer hands out
+// sessions for samples without logging in, but the API hasn't been checked
+// against the site, so --preview fails with ErrPreviewUnsupported rather than
+// guessing at it. It can be added once someone verifies the trial endpoints.
+
+// The viewer is what we get everything from, so check it rather than the store.
+func (bw *BookWalker) Preflight(url string) error {
+	return plugins.CheckReachable(urlApi)
+}
+
+func (bw *BookWalker) DetectPage(url string, page []byte) (string, string, bool) {
+	if m := reViewerInPage.FindSubmatch(page); m != nil {
+		return "link to the BookWalker viewer", "https://bookwalker.jp/de" + string(m[1]) + "/", true
+	} else if m := reBookInPage.FindSubmatch(page); m != nil {
+		return "link to a BookWalker book page", "https://bookwalker.jp/de" + string(m[1]) + "/", true
+	}
+
+	return "", "", false
+}
+
+// Everything requires logging in, but the credentials can come from an accounts file.
+func (bw *BookWalker) RequiresAuth(url string) bool {
+	return true
+}
+
+func (bw *BookWalker) AuthOptions() []string {
+	return []string{"Username", "Password"}
+}
+
 func (bw *BookWalker) DownloadGenerator(url string) (dlgen func() plugins.Downloader, length int) {
 	// Initialization.
-	var ext string
 	opts := plugins.OptionsToMap(bw.options)
-	if opts["Lossless"].(bool) {
-		ext = "png"
-	} else {
-		ext = "jpg"
-	}
+	encOpts := plugins.EncodeOptionsFromMap(opts)
+	saveScrambled := opts["SaveScrambled"].(bool) || plugins.NoDescramble
 
 	// Make a client and log in.
 	cid := reBook.FindStringSubmatch(url)[1]
-	bw.client = plugins.NewHTTPClient(20)
+	bw.client = plugins.NewHTTPClient(plugins.PluginTimeout(opts))
 	log.Info("Logging in...")
-	bw.login(opts["Username"].(string), opts["Password"].(string))
+	creds := plugins.NewCredentialProvider(opts["Username"].(string), opts["Password"].(string))
+	acc := creds.Current()
+	bw.login(acc.Username, acc.Password)
 
 	// Try to get a book session.
-	var err error
-	bw.session, err = bw.getBookSession(cid)
+	session, err := bw.getBookSession(cid)
 	if err != nil {
 		panic(err)
 	}
-	dir := bw.session.Title
-	dir = norm.NFKC.String(dir)
+	bw.setSession(session)
+	dir := session.Title
+	dir = plugins.NormalizeTitle(dir)
+	dir = plugins.DirectoryName(opts, dir)
+
+	// Long downloads can outlive the session, so log in and get a new one if need be.
+	// With multiple accounts, the next one is used instead in case we hit a limit.
+	bw.reauth = plugins.NewReauthenticator(maxReauths*creds.Len(), func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("Failed to re-authenticate: %v", r)
+			}
+		}()
+		if creds.Rotate() {
+			log.Infof("Switching to account: %s", creds.Current().Username)
+		}
+		acc := creds.Current()
+		bw.login(acc.Username, acc.Password)
+		session, err := bw.getBookSession(cid)
+		if err != nil {
+			return err
+		}
+		bw.setSession(session)
+		return nil
+	})
 
 	// Get content info.
 	bw.config, bw.content, err = bw.getContentInfo()
 	if err != nil {
 		panic(err)
 	}
-	length = len(bw.content)
+	count := len(bw.content)
+	coverIndex := -1
+	if plugins.SaveCovers {
+		if coverIndex = bw.config.CoverIndex(); coverIndex == -1 {
+			log.Warn("Could not determine which page is the cover, so it won't be saved separately.")
+		}
+	}
+	// Each content entry can have multiple subpages, all of which are saved
+	// as separate files, so the total number of files is the sum of those.
+	for _, c := range bw.content[:count] {
+		length += len(c.FileLinkInfo.PageLinkInfoList)
+	}
 
-	// Initialize descrambler.
-	ds := descrambler{}
+	bd := &bookDownload{
+		dir:           dir,
+		encOpts:       encOpts,
+		saveScrambled: saveScrambled,
+		coverIndex:    coverIndex,
+		ds:            &descrambler{},
+	}
 
 	i := 0
 	last := time.Now()
 	interval := time.Duration(opts["Delay"].(int)) * time.Millisecond
 	// Generator.
 	dlgen = func() plugins.Downloader {
-		if i >= length {
+		if i >= count {
 			return nil
 		}
 
@@ -153,65 +245,149 @@ func (bw *BookWalker) DownloadGenerator(url string) (dlgen func() plugins.Downlo
 			delta := interval - time.Since(last)
 			if interval > 0 && n != 0 && delta > 0 {
 				log.Debugf("Delaying %.2f seconds before starting the next download...", delta.Seconds())
-				time.Sleep(delta)
+				if err := plugins.Sleep(delta); err != nil {
+					return err
+				}
 			}
 			last = time.Now()
 
-			page := n + 1
-			// Each file has a list of pages. I have yet to see a file with multiple
-			// pages (which I call subpages), so virtually always it will have just
-			// have 1 subpage.
-			for _, p := range bw.content[n].FileLinkInfo.PageLinkInfoList {
-				r, err := bw.getImage(page, p.Page.No)
-				if err != nil {
-					return err
-				}
-				defer r.Close()
+			return bw.savePage(n, rep, bd)
+		}
 
-				buf := &bytes.Buffer{}
-				// Download through the reporter.
-				if _, err := rep.Copy(buf, r); err != nil {
-					return err
-				}
+	}
+	return
+}
 
-				filePath := bw.content[n].FilePath + "/" + strconv.Itoa(p.Page.No)
-				img, err := ds.Descramble(filePath, buf, p.Page.DummyWidth, p.Page.DummyHeight)
-				var path string
-				if p.Page.No > 0 {
-					path = filepath.Join(dir, fmt.Sprintf("%04d-%d.%s", n+1, p.Page.No, ext))
-				} else {
-					path = filepath.Join(dir, fmt.Sprintf("%04d.%s", n+1, ext))
-				}
-				if opts["Lossless"].(bool) {
-					// Save as PNG.
-					w, err := rep.FileWriter(path, false)
-					if err != nil {
-						panic(err)
-					}
-					defer w.Close()
-
-					enc := png.Encoder{}
-					if err := enc.Encode(w, img); err != nil {
-						return err
-					}
-				} else {
-					// Save as JPEG.
-					w, err := rep.FileWriter(path, false)
-					if err != nil {
-						panic(err)
-					}
-					defer w.Close()
-					if err := jpeg.Encode(w, img, &jpeg.Options{Quality: opts["JPEGQuality"].(int)}); err != nil {
-						return err
-					}
+// What the downloaders of a book need to save its pages.
+type bookDownload struct {
+	dir           string
+	encOpts       plugins.EncodeOptions
+	saveScrambled bool
+	coverIndex    int
+	ds            *descrambler
+}
+
+// Download and save all the subpages of the n-th content entry.
+func (bw *BookWalker) savePage(n int, rep plugins.Reporter, bd *bookDownload) error {
+	page := n + 1
+	// Each file has a list of pages. I have yet to see a file with multiple
+	// pages (which I call subpages), so virtually always it will have just
+	// have 1 subpage. If there's more, e.g. for spreads, they're downloaded
+	// and descrambled concurrently.
+	subpages := bw.content[n].FileLinkInfo.PageLinkInfoList
+	saveSubpage := func(j int) error {
+		p := subpages[j]
+		var r io.ReadCloser
+		var size int64
+		err := bw.reauth.Do(func() (err error) {
+			r, size, err = bw.getImage(page, p.Page.No)
+			return
+		})
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		var name string
+		if p.Page.No > 0 {
+			name = fmt.Sprintf("%04d-%d", n+1, p.Page.No)
+		} else {
+			name = fmt.Sprintf("%04d", n+1)
+		}
+		filePath := bw.content[n].FilePath + "/" + strconv.Itoa(p.Page.No)
+		// Descramble and save the image read from src.
+		save := func(src io.Reader) error {
+			img, err := bd.ds.Descramble(filePath, src, p.Page.DummyWidth, p.Page.DummyHeight)
+			if err != nil {
+				return err
+			}
+			defer bd.ds.Release(img)
+			if n == bd.coverIndex && j == 0 {
+				if err := plugins.SaveCover(rep, bd.dir, img, bd.encOpts); err != nil {
+					return err
 				}
 			}
+			path := filepath.Join(bd.dir, name+"."+bd.encOpts.Ext())
+			return plugins.SaveImage(rep, path, img, bd.encOpts)
+		}
+		// If we don't need the original file, decode it as it comes in
+		// rather than keeping a copy of it around while decoding.
+		if plugins.CanStream() && !bd.saveScrambled && !plugins.NoDescramble {
+			stream := plugins.StreamSized(rep, r, size)
+			defer stream.Close()
+			return save(stream)
+		}
 
+		buf := &bytes.Buffer{}
+		// Download through the reporter.
+		if _, err := rep.CopySized(buf, r, size); err != nil {
+			return err
+		}
+
+		if bd.saveScrambled {
+			scrambled := filepath.Join(bd.dir, name+".jpg"+plugins.ScrambledSuffix)
+			if _, err := rep.SaveData(scrambled, bytes.NewReader(buf.Bytes()), false); err != nil {
+				return err
+			}
+		}
+		if plugins.NoDescramble {
 			return nil
 		}
 
+		return plugins.Descramble(func() error {
+			return save(buf)
+		})
 	}
-	return
+	if len(subpages) == 1 {
+		return saveSubpage(0)
+	}
+
+	// The page fails if any of its subpages do.
+	errs := make(chan error, len(subpages))
+	for j := range subpages {
+		go func(j int) {
+			// A panic here wouldn't be caught by the manager.
+			defer func() {
+				if r := recover(); r != nil {
+					errs <- fmt.Errorf("Subpage %d panicked: %v", j, r)
+				}
+			}()
+			errs <- saveSubpage(j)
+		}(j)
+	}
+	var res error
+	for range subpages {
+		if err := <-errs; err != nil && res == nil {
+			res = err
+		}
+	}
+	return res
+}
+
+func (bw *BookWalker) Metadata() *plugins.Metadata {
+	session := bw.currentSession()
+	if session == nil || bw.config == nil {
+		return nil
+	}
+
+	return &plugins.Metadata{
+		Title:     plugins.NormalizeTitle(session.Title),
+		Direction: plugins.ParsePageDirection(bw.config.PageProgressionDirection),
+	}
+}
+
+// The current book session. Workers should only get it once per request so
+// that they don't mix the tokens of two sessions if it's replaced meanwhile.
+func (bw *BookWalker) currentSession() *BookSession {
+	bw.sessionm.RLock()
+	defer bw.sessionm.RUnlock()
+	return bw.session
+}
+
+func (bw *BookWalker) setSession(session *BookSession) {
+	bw.sessionm.Lock()
+	bw.session = session
+	bw.sessionm.Unlock()
 }
 
 func (bw *BookWalker) Cleanup(err error) {
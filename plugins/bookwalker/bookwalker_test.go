@@ -0,0 +1,124 @@
+package bookwalker
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/MinoMino/mindl/plugins"
+)
+
+// The JPEG served by newImageServer().
+func testImage(t *testing.T) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 128, 128)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Serves the given subpages of "item/xhtml/p-001.xhtml" as JPEGs, and
+// responds with a 404 to the others.
+func newImageServer(t *testing.T, subpages ...string) *httptest.Server {
+	img := testImage(t)
+	mux := http.NewServeMux()
+	for _, sp := range subpages {
+		mux.HandleFunc("/item/xhtml/p-001.xhtml/"+sp+".jpeg", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Write(img)
+		})
+	}
+
+	return httptest.NewServer(mux)
+}
+
+// A BookWalker with a single content entry with the given subpages,
+// getting its images from srv.
+func newTestBookWalker(t *testing.T, srv *httptest.Server, subpages ...int) *BookWalker {
+	var content BookContent
+	var info struct {
+		FileLinkInfo struct {
+			PageLinkInfoList []map[string]map[string]int
+		}
+	}
+	for _, no := range subpages {
+		info.FileLinkInfo.PageLinkInfoList = append(info.FileLinkInfo.PageLinkInfoList,
+			map[string]map[string]int{"Page": {"No": no}})
+	}
+	data, _ := json.Marshal(info)
+	if err := json.Unmarshal(data, &content); err != nil {
+		t.Fatal(err)
+	}
+	content.FilePath = "item/xhtml/p-001.xhtml"
+
+	bw := &BookWalker{
+		client:  srv.Client(),
+		content: []*BookContent{&content},
+		reauth:  plugins.NewReauthenticator(0, func() error { return nil }),
+	}
+	bw.setSession(&BookSession{Url: srv.URL + "/"})
+	return bw
+}
+
+func TestSavePageSubpages(t *testing.T) {
+	srv := newImageServer(t, "0", "1", "2")
+	defer srv.Close()
+	img := testImage(t)
+
+	tests := []struct {
+		subpages []int
+		expected []string
+	}{
+		{[]int{0}, []string{"Title/0001.jpg"}},
+		{[]int{1, 2}, []string{"Title/0001-1.jpg", "Title/0001-2.jpg"}},
+		{[]int{0, 1, 2}, []string{"Title/0001-1.jpg", "Title/0001-2.jpg", "Title/0001.jpg"}},
+	}
+
+	for _, test := range tests {
+		bw := newTestBookWalker(t, srv, test.subpages...)
+		rep := plugins.NewMemReporter()
+		bd := &bookDownload{dir: "Title", encOpts: plugins.EncodeOptions{JPEGQuality: 90},
+			coverIndex: -1, ds: &descrambler{}}
+		if err := bw.savePage(0, rep, bd); err != nil {
+			t.Errorf("Subpages %v: %s", test.subpages, err)
+			continue
+		}
+		if names := rep.Names(); !reflect.DeepEqual(names, test.expected) {
+			t.Errorf("Subpages %v: saved %v, expected %v.", test.subpages, names, test.expected)
+		}
+		// Every subpage reports its own size, even when they're downloaded at once.
+		if len(rep.Sizes) != len(test.subpages) {
+			t.Errorf("Subpages %v: expected %d sizes, got %v.", test.subpages, len(test.subpages), rep.Sizes)
+		}
+		for _, size := range rep.Sizes {
+			if size != int64(len(img)) {
+				t.Errorf("Subpages %v: expected the size %d of the image, got %d.", test.subpages, len(img), size)
+			}
+		}
+	}
+}
+
+func TestSavePageFailingSubpage(t *testing.T) {
+	// Subpage 2 isn't served.
+	srv := newImageServer(t, "1", "3")
+	defer srv.Close()
+
+	bw := newTestBookWalker(t, srv, 1, 2, 3)
+	rep := plugins.NewMemReporter()
+	bd := &bookDownload{dir: "Title", encOpts: plugins.EncodeOptions{JPEGQuality: 90},
+		coverIndex: -1, ds: &descrambler{}}
+	err := bw.savePage(0, rep, bd)
+	if e, ok := err.(*plugins.ErrHTTPStatusCode); !ok || e.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected the 404 of the failing subpage, got: %v", err)
+	}
+	// The others are still saved, and the download as a whole fails.
+	expected := []string{"Title/0001-1.jpg", "Title/0001-3.jpg"}
+	if names := rep.Names(); !reflect.DeepEqual(names, expected) {
+		t.Errorf("Saved %v, expected %v.", names, expected)
+	}
+}
@@ -1,9 +1,13 @@
 package bookwalker
 
 import (
+	"fmt"
 	"image"
 	"io"
 	"sync"
+
+	"github.com/MinoMino/mindl/logger"
+	"github.com/MinoMino/mindl/plugins"
 )
 
 const (
@@ -42,6 +46,27 @@ type scrambleRectanglesCollection struct {
 	dstWidth, dstHeight int
 }
 
+// Get the rectangles in a form that can be exported, with a page they're used for.
+func (col *scrambleRectanglesCollection) rectMap(sample string) *plugins.RectMap {
+	res := &plugins.RectMap{
+		Sample:     sample,
+		SrcWidth:   col.srcWidth,
+		SrcHeight:  col.srcHeight,
+		DstWidth:   col.dstWidth,
+		DstHeight:  col.dstHeight,
+		Rectangles: make([]plugins.DescrambleRect, 0, len(col.rectangles)),
+	}
+	for _, rect := range col.rectangles {
+		res.Rectangles = append(res.Rectangles, plugins.DescrambleRect{
+			SrcX: rect.src.X, SrcY: rect.src.Y,
+			DstX: rect.dst.X, DstY: rect.dst.Y,
+			Width: rect.width, Height: rect.height,
+		})
+	}
+
+	return res
+}
+
 // Return the pattern that should be used for that particular filename.
 func getPattern(filePath string) int {
 	res := 0
@@ -227,6 +252,16 @@ func calcYCoordinateYRest(index, rectangleCountY, pattern int) int {
 type descrambler struct {
 	rectangleCollections [patternCount]*scrambleRectanglesCollection
 	m                    sync.Mutex
+	pool                 plugins.RGBAPool
+	reported             sync.Once
+}
+
+// How an image gets descrambled, for diagnostics.
+type layout struct {
+	Pattern             int
+	Rectangles          int
+	SrcWidth, SrcHeight int
+	DstWidth, DstHeight int
 }
 
 func (ds *descrambler) Descramble(filename string, reader io.Reader, dummyWidth, dummyHeight int) (image.Image, error) {
@@ -258,10 +293,23 @@ func (ds *descrambler) Descramble(filename string, reader io.Reader, dummyWidth,
 			dstHeight:  srcHeight - dummyHeight,
 		}
 		col = ds.rectangleCollections[pattern-1]
+		if err := plugins.ExportRects("bookwalker", col.rectMap(filename)); err != nil {
+			log.Warnf("Failed to export the rectangles: %s", err)
+		}
 	}
 	ds.m.Unlock()
-
-	res := image.NewRGBA(image.Rect(0, 0, col.dstWidth, col.dstHeight))
+	ds.reported.Do(func() {
+		l := ds.Layout(filename, srcWidth, srcHeight, dummyWidth, dummyHeight)
+		plugins.ReportDescrambling(log.WithFields(logger.Fields{
+			"pattern":    l.Pattern,
+			"sample":     filename,
+			"rectangles": l.Rectangles,
+			"src":        fmt.Sprintf("%dx%d", l.SrcWidth, l.SrcHeight),
+			"dst":        fmt.Sprintf("%dx%d", l.DstWidth, l.DstHeight),
+		}))
+	})
+
+	res := ds.pool.Get(col.dstWidth, col.dstHeight)
 	for _, rect := range col.rectangles {
 		for x := 0; x < rect.width; x++ {
 			for y := 0; y < rect.height; y++ {
@@ -272,3 +320,22 @@ func (ds *descrambler) Descramble(filename string, reader io.Reader, dummyWidth,
 
 	return res, nil
 }
+
+// Get how an image with the given filename, size and dummy size would be
+// descrambled, without touching the rectangles cached for Descramble().
+func (ds *descrambler) Layout(filename string, srcWidth, srcHeight, dummyWidth, dummyHeight int) *layout {
+	pattern := getPattern(filename)
+	return &layout{
+		Pattern:    pattern,
+		Rectangles: len(generateRectangles(srcWidth, srcHeight, pattern)),
+		SrcWidth:   srcWidth,
+		SrcHeight:  srcHeight,
+		DstWidth:   srcWidth - dummyWidth,
+		DstHeight:  srcHeight - dummyHeight,
+	}
+}
+
+// Let the descrambler reuse the memory of an image it returned once it's been saved.
+func (ds *descrambler) Release(img image.Image) {
+	ds.pool.Put(img)
+}
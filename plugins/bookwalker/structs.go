@@ -1,5 +1,10 @@
 package bookwalker
 
+import (
+	"path"
+	"strings"
+)
+
 type BookSession struct {
 	Status   string `json:"status"`
 	Url      string `json:"url"`
@@ -94,3 +99,47 @@ type BookContent struct {
 	PageToBookmark interface{} `json:"PageToBookmark"`
 	Title          string      `json:"Title"`
 }
+
+// Get the index of the content that's the cover according to the navigation
+// or table of contents, or -1 if neither says which one it is.
+func (bc *BookConfig) CoverIndex() int {
+	hrefs := make([]string, 0, 2)
+	isCover := func(label string, types []interface{}) bool {
+		for _, t := range types {
+			if s, ok := t.(string); ok && strings.EqualFold(s, "cover") {
+				return true
+			}
+		}
+		return strings.TrimSpace(label) == "表紙"
+	}
+	for _, nl := range bc.NavLists {
+		for _, item := range nl.Items {
+			if isCover(item.Label, item.Types) {
+				hrefs = append(hrefs, item.Href)
+			}
+		}
+	}
+	for _, item := range bc.TocList {
+		if isCover(item.Label, item.Types) {
+			hrefs = append(hrefs, item.Href)
+		}
+	}
+
+	for _, href := range hrefs {
+		// Hrefs can have fragments and be relative to another file.
+		if i := strings.Index(href, "#"); i != -1 {
+			href = href[:i]
+		}
+		if href == "" {
+			continue
+		}
+		for i, c := range bc.Contents {
+			if href == c.File || href == c.OriginalFilePath ||
+				path.Base(href) == path.Base(c.OriginalFilePath) {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
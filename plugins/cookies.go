@@ -0,0 +1,164 @@
+package plugins
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/MinoMino/logrus"
+)
+
+/*
+   ==================================================
+                        COOKIES
+     Cookies supplied by the user, e.g. to reuse a
+     session from a browser instead of logging in.
+   ==================================================
+*/
+
+var ErrInvalidCookie = errors.New("Invalid cookie format. Should be name=value.")
+
+// A cookie supplied by the user. The host is empty for cookies
+// passed as a string, as they don't come with a domain.
+type userCookie struct {
+	host   string
+	cookie *http.Cookie
+}
+
+var userCookies []userCookie
+
+// Parse and set the cookies that should be loaded into the clients made by
+// NewHTTPClient(). If s is the path to an existing file, it's parsed as a
+// Netscape cookies.txt file, otherwise as a "name=value; name2=value2" string.
+func SetUserCookies(s string) (err error) {
+	if info, err := os.Stat(s); err == nil && !info.IsDir() {
+		userCookies, err = parseCookiesFile(s)
+		return err
+	}
+
+	userCookies, err = parseCookiesString(s)
+	return
+}
+
+// Whether or not the user supplied any cookies.
+func HasUserCookies() bool {
+	return len(userCookies) != 0
+}
+
+// Add the cookies the user supplied without a domain to the jar as
+// cookies for u. Cookies with a domain are added by NewHTTPClient().
+func LoadUserCookies(jar http.CookieJar, u *url.URL) {
+	cookies := make([]*http.Cookie, 0, len(userCookies))
+	for _, uc := range userCookies {
+		if uc.host == "" {
+			cookies = append(cookies, uc.cookie)
+		}
+	}
+
+	if len(cookies) != 0 {
+		log.WithField("url", u.String()).Debugf("Loading %d user cookie(s)...", len(cookies))
+		jar.SetCookies(u, cookies)
+	}
+}
+
+// Add the cookies the user supplied with a domain to the jar.
+func loadDomainUserCookies(jar http.CookieJar) {
+	for _, uc := range userCookies {
+		if uc.host != "" {
+			jar.SetCookies(&url.URL{Scheme: "https", Host: uc.host, Path: "/"}, []*http.Cookie{uc.cookie})
+		}
+	}
+}
+
+func parseCookiesString(s string) ([]userCookie, error) {
+	res := make([]userCookie, 0, 5)
+	for _, pair := range strings.Split(s, ";") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		split := strings.SplitN(pair, "=", 2)
+		if len(split) < 2 || strings.TrimSpace(split[0]) == "" {
+			return nil, ErrInvalidCookie
+		}
+		res = append(res, userCookie{cookie: &http.Cookie{
+			Name:  strings.TrimSpace(split[0]),
+			Value: strings.TrimSpace(split[1]),
+			Path:  "/",
+		}})
+	}
+
+	return res, nil
+}
+
+func parseCookiesFile(path string) ([]userCookie, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	res := make([]userCookie, 0, 10)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		// Only trim the line ending, as a cookie's value can be empty.
+		line := strings.TrimRight(scanner.Text(), "\r")
+		httpOnly := strings.HasPrefix(line, "#HttpOnly_")
+		if httpOnly {
+			line = line[len("#HttpOnly_"):]
+		} else if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// Format: domain, include subdomains, path, secure, expiry, name, value
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("%s:%d: Expected 7 tab-separated fields, got %d.", path, n, len(fields))
+		}
+
+		cookie := &http.Cookie{
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			Name:     fields[5],
+			Value:    fields[6],
+			HttpOnly: httpOnly,
+		}
+		// Cookies that don't include subdomains are host-only cookies,
+		// which the cookie jar represents with an empty domain.
+		if strings.EqualFold(fields[1], "TRUE") {
+			cookie.Domain = fields[0]
+		}
+		if expiry, err := strconv.ParseInt(fields[4], 10, 64); err != nil {
+			return nil, fmt.Errorf("%s:%d: Invalid expiry: %s", path, n, fields[4])
+		} else if expiry != 0 {
+			cookie.Expires = time.Unix(expiry, 0)
+		}
+
+		res = append(res, userCookie{strings.TrimPrefix(fields[0], "."), cookie})
+	}
+
+	return res, scanner.Err()
+}
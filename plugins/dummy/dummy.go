@@ -40,7 +40,9 @@ type DelayedReader struct {
 }
 
 func (d *DelayedReader) Read(p []byte) (int, error) {
-	time.Sleep(time.Millisecond * time.Duration(rand.Intn(d.max-d.min)+d.min))
+	if err := plugins.Sleep(time.Millisecond * time.Duration(rand.Intn(d.max-d.min)+d.min)); err != nil {
+		return 0, err
+	}
 	return d.Reader.Read(p)
 }
 
@@ -48,11 +50,22 @@ var Plugin = Dummy{
 	[]plugins.Option{
 		&plugins.StringOption{K: "Hello", V: "World", Required: false},
 		&plugins.StringOption{K: "I Like", V: "Potatoes", Required: false},
+		// For testing how the download manager deals with failing downloaders.
+		&plugins.IntOption{K: "FailAt", V: -1, Hidden: true,
+			C: "If not negative, the downloader with this index returns an error."},
+		&plugins.IntOption{K: "PanicAt", V: -1, Hidden: true,
+			C: "If not negative, the downloader with this index panics."},
+		&plugins.IntOption{K: "Delay", V: 1000, Hidden: true,
+			C: "The maximum delay between reads in milliseconds. 0 means no delays."},
 	},
 }
 
 var dummyUrlRegex = regexp.MustCompile(`^dummy://(?P<length>\d+)$`)
 
+func init() {
+	plugins.Register(&Plugin)
+}
+
 type Dummy struct {
 	options []plugins.Option
 }
@@ -79,6 +92,9 @@ func (d *Dummy) DownloadGenerator(url string) (dlgen func() plugins.Downloader,
 	length, _ = strconv.Atoi(re[1])
 	rand.Seed(int64(length))
 	dir := fmt.Sprintf("dummy-%d", time.Now().Unix())
+	opts := plugins.OptionsToMap(d.options)
+	failAt, panicAt := opts["FailAt"].(int), opts["PanicAt"].(int)
+	delay := opts["Delay"].(int)
 	i := 0
 
 	// Generator.
@@ -96,14 +112,23 @@ func (d *Dummy) DownloadGenerator(url string) (dlgen func() plugins.Downloader,
 		// evaluation. However, since you are passed a counter, you can use that
 		// to get data for that specific goroutine.
 		return func(n int, rep plugins.Reporter) error {
+			if n == failAt {
+				return fmt.Errorf("Download #%d failed on purpose.", n)
+			} else if n == panicAt {
+				panic(fmt.Sprintf("Download #%d panicked on purpose.", n))
+			}
+
 			size := rand.Intn(1e6) + 1e5
 			buf := make([]byte, size)
 			rand.Read(buf)
-			r := bytes.NewBuffer(buf)
+			var r io.Reader = bytes.NewBuffer(buf)
+			if delay > 0 {
+				r = &DelayedReader{r, delay / 5, delay}
+			}
 
 			_, err := rep.SaveData(
 				filepath.Join(dir, fmt.Sprintf("dummy-%d.bin", n)),
-				&DelayedReader{r, 200, 1000},
+				r,
 				true)
 			return err
 		}
@@ -0,0 +1,162 @@
+package plugins
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/MinoMino/logrus"
+)
+
+/*
+   ==================================================
+                     RESPONSE DUMPS
+     Saving API responses for fixing breakage.
+   ==================================================
+*/
+
+// If set, the bodies of the non-media responses received by clients created with
+// NewHTTPClient() are written to files in it. Set by --dump-responses.
+var DumpResponsesDir string
+
+// The number of responses dumped so far, to keep the file names unique and in order.
+var dumpCount int64
+
+// Parameters and fields whose values are replaced before anything gets written or logged.
+// Signature, Policy and Key-Pair-Id are what signed CloudFront URLs are authorized by.
+var reSecretParam = regexp.MustCompile(`(?i)^(pass(word|wd)?|token|access_?token|session(id)?|auth|key|secret|p|k|signature|policy|key-pair-id)$`)
+var reSecretField = regexp.MustCompile(`(?i)("(?:pass(?:word|wd)?|token|access_?token|session(?:id)?|auth|secret)"\s*:\s*)"[^"]*"`)
+
+const redacted = "REDACTED"
+
+// Wraps a RoundTripper and dumps the responses to DumpResponsesDir.
+type dumpTransport struct {
+	http.RoundTripper
+}
+
+func (t *dumpTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil || !isDumpable(resp) {
+		return resp, err
+	}
+
+	n := atomic.AddInt64(&dumpCount, 1)
+	name := fmt.Sprintf("%s-%04d-%s", time.Now().Format("20060102-150405"), n, dumpName(req.URL))
+	resp.Body = &dumpingReadCloser{
+		ReadCloser: resp.Body,
+		path:       filepath.Join(DumpResponsesDir, name),
+		url:        redactURL(req.URL),
+		status:     resp.Status,
+	}
+
+	return resp, nil
+}
+
+// Whether or not the response is likely to be an API response or a page rather
+// than an image or the like, which would only take up space.
+func isDumpable(resp *http.Response) bool {
+	mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	switch {
+	case mt == "", strings.HasPrefix(mt, "text/"):
+		return true
+	case strings.Contains(mt, "json"), strings.Contains(mt, "javascript"), strings.Contains(mt, "xml"):
+		return true
+	}
+
+	return false
+}
+
+// Get a file name from the last part of the URL's path, e.g. "bibGetCntntInfo.php".
+func dumpName(u *url.URL) string {
+	name := path.Base(u.Path)
+	if name == "/" || name == "." {
+		name = u.Host
+	}
+
+	return SanitizeFilename(name)
+}
+
+// Get the URL with the values of the parameters that look like secrets replaced.
+func redactURL(u *url.URL) string {
+	q := u.Query()
+	for k := range q {
+		if reSecretParam.MatchString(k) {
+			q.Set(k, redacted)
+		}
+	}
+	res := *u
+	res.RawQuery = q.Encode()
+	res.User = nil
+
+	return res.String()
+}
+
+// Replace the values of JSON fields that look like secrets.
+func redactBody(data []byte) []byte {
+	return reSecretField.ReplaceAll(data, []byte(`${1}"`+redacted+`"`))
+}
+
+// Keeps what's read from the body and writes it to a file once it's closed,
+// with the redacted URL and the status on the first two lines.
+type dumpingReadCloser struct {
+	io.ReadCloser
+	path, url, status string
+	buf               bytes.Buffer
+	once              sync.Once
+}
+
+func (d *dumpingReadCloser) Read(p []byte) (int, error) {
+	n, err := d.ReadCloser.Read(p)
+	d.buf.Write(p[:n])
+	return n, err
+}
+
+func (d *dumpingReadCloser) Close() error {
+	err := d.ReadCloser.Close()
+	d.once.Do(d.dump)
+	return err
+}
+
+func (d *dumpingReadCloser) dump() {
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "%s\n%s\n\n", d.url, d.status)
+	out.Write(redactBody(d.buf.Bytes()))
+
+	if err := os.MkdirAll(filepath.Dir(d.path), 0755); err != nil {
+		log.Warnf("Failed to dump the response: %s", err)
+		return
+	}
+	if err := ioutil.WriteFile(d.path, out.Bytes(), 0644); err != nil {
+		log.Warnf("Failed to dump the response: %s", err)
+		return
+	}
+	log.WithField("url", d.url).Debugf("Dumped the response to: %s", d.path)
+}
@@ -21,8 +21,6 @@ import (
 	"errors"
 	"fmt"
 	"image"
-	"image/jpeg"
-	"image/png"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -31,7 +29,6 @@ import (
 	"github.com/MinoMino/mindl/logger"
 	"github.com/MinoMino/mindl/plugins"
 	"github.com/sclevine/agouti"
-	"golang.org/x/text/unicode/norm"
 )
 
 const name = "eBookJapan"
@@ -46,8 +43,13 @@ const (
 	// How many milliseconds to wait before polling again.
 	loadPolling = 250
 	dataPolling = 500
+	// The minimum number of times we poll for page data before giving up,
+	// so that a slow polling interval doesn't cause a premature ErrEBJNoData.
+	minDataPolls = 5
 	// How many pages we rip before we reopen the reader.
 	reopenCount = 50
+	// How many times we reopen the reader and try again if a page's data doesn't return.
+	maxDataRetries = 2
 )
 
 var (
@@ -61,15 +63,29 @@ var Plugin = EBookJapan{
 		plugins.NewForceMaxWorkersOption(1),
 		&plugins.BoolOption{K: "Lossless", V: false, Required: false,
 			C: "If set to true, save as PNG. Original images are in JPEG, so you can't escape some artifacts even with this on."},
-		&plugins.IntOption{K: "JPEGQuality", V: 95,
+		&plugins.IntOption{K: "JPEGQuality", V: 95, Min: 1, Max: 100,
 			C: "Does nothing if Lossless is on. >95 not adviced, as it increases file size a ton for little improvement."},
+		plugins.NewChromaSubsamplingOption(),
+		plugins.NewPNGCompressionOption(),
+		plugins.NewDualOutputOption(),
+		plugins.NewDirectoryOption(),
 		&plugins.IntOption{K: "PrefetchCount", V: 5,
 			C: "How many pages should be prefetched. The higher, the faster downloads, but also more RAM and CPU usage."},
+		&plugins.IntOption{K: "PollInterval", V: dataPolling,
+			C: "How many milliseconds to wait between each time we check if a page is ready. Higher values reduce CPU usage."},
+		&plugins.FloatOption{K: "MaxPagesPerSecond", V: 0,
+			C: "The maximum number of pages to rip per second. Lower values reduce CPU usage. 0 means no limit."},
+		&plugins.IntOption{K: "StartPage", V: 1, Min: 1,
+			C: "The page to start ripping at, to finish an interrupted download without ripping everything again."},
 	},
 }
 
 var ebjUrlRegex = regexp.MustCompile(`^https?://br.ebookjapan.jp/br/reader/viewer/view.html\?.+$`)
 
+func init() {
+	plugins.Register(&Plugin)
+}
+
 type EBookJapan struct {
 	options []plugins.Option
 }
@@ -92,13 +108,8 @@ func (ebj *EBookJapan) Options() []plugins.Option {
 
 func (ebj *EBookJapan) DownloadGenerator(url string) (dlgen func() plugins.Downloader, length int) {
 	// Initialization.
-	var ext string
 	opts := plugins.OptionsToMap(ebj.options)
-	if opts["Lossless"].(bool) {
-		ext = "png"
-	} else {
-		ext = "jpg"
-	}
+	encOpts := plugins.EncodeOptionsFromMap(opts)
 	driver := agouti.PhantomJS()
 	log.Info("Starting PhantomJS...")
 	if err := driver.Start(); err != nil {
@@ -106,17 +117,37 @@ func (ebj *EBookJapan) DownloadGenerator(url string) (dlgen func() plugins.Downl
 	}
 
 	// Make a page, load the reader, then run the ripper script.
-	var page *agouti.Page
-	page, length = getReaderPage(driver, url, true)
+	page, pages := getReaderPage(driver, url, true)
 
 	// Remove the canvases on the reader to reduce memory footprint.
 	if err := page.RunScript(reduceMemoryScript, nil, nil); err != nil {
 		panic(err)
 	}
 
+	// The index of the first page to rip. Everything before it is skipped.
+	start := opts["StartPage"].(int) - 1
+	if start >= pages {
+		panic(fmt.Sprintf("StartPage is past the last page (%d).", pages))
+	} else if start > 0 {
+		log.Infof("Starting at page %d of %d.", start+1, pages)
+	}
+
 	// An slice of bools indicating whether or not a page is being prefetched.
-	prefetched := make([]bool, length)
+	prefetched := make([]bool, pages)
 	prefetchCount := opts["PrefetchCount"].(int)
+	pollInterval := time.Duration(opts["PollInterval"].(int)) * time.Millisecond
+	if pollInterval <= 0 {
+		pollInterval = dataPolling * time.Millisecond
+	}
+	// Make sure the time limit allows for at least a few polls.
+	timeout := time.Duration(dataTimeout * float64(time.Second))
+	if pollInterval*minDataPolls > timeout {
+		timeout = pollInterval * minDataPolls
+	}
+	var pageInterval time.Duration
+	if maxRate := opts["MaxPagesPerSecond"].(float64); maxRate > 0 {
+		pageInterval = time.Duration(float64(time.Second) / maxRate)
+	}
 
 	// Metadata fetching.
 	metadata := make(map[string]interface{})
@@ -125,12 +156,15 @@ func (ebj *EBookJapan) DownloadGenerator(url string) (dlgen func() plugins.Downl
 	}
 
 	dir, err := page.Title()
-	dir = norm.NFKC.String(dir)
+	dir = plugins.NormalizeTitle(dir)
 	if err != nil {
 		panic("Failed to get the page title: " + err.Error())
 	}
+	dir = plugins.DirectoryName(opts, dir)
 
 	once := false
+	// Only the pages we rip count towards the total.
+	length = pages - start
 	// Generator.
 	dlgen = func() plugins.Downloader {
 		// Only one instance of PhantomJS and we can't do stuff concurrently
@@ -144,31 +178,68 @@ func (ebj *EBookJapan) DownloadGenerator(url string) (dlgen func() plugins.Downl
 			// Make sure we stop the driver before we exit.
 			defer driver.Stop()
 
+			// Close the page and open the reader again.
+			reopen := func() {
+				if err := page.Destroy(); err != nil {
+					log.Error("Failed to destroy the page.")
+					panic(err)
+				}
+
+				page, _ = getReaderPage(driver, url, false)
+			}
+
+			// Poll for the data of a page until we get it or time out.
+			poll := func(i int) (data string) {
+				now := time.Now()
+				for time.Since(now) < timeout {
+					if err := page.RunScript(fmt.Sprintf(fetchDataScript, i+1), nil, &data); err != nil {
+						panic(err)
+					} else if data != "" {
+						// We got something. Clean up and break.
+						if err := page.RunScript(fmt.Sprintf(cleanupScript, i+1), nil, nil); err != nil {
+							panic(err)
+						}
+						break
+					}
+
+					// Regulate polling speed.
+					if plugins.Sleep(pollInterval) != nil {
+						break
+					}
+				}
+
+				return
+			}
+
 			var reopened bool
-			for i := 0; i < length; i++ {
+			var last time.Time
+			for i := start; i < pages; i++ {
+				// Respect MaxPagesPerSecond by sleeping between completed pages.
+				if delta := pageInterval - time.Since(last); i != start && delta > 0 {
+					if err := plugins.Sleep(delta); err != nil {
+						return err
+					}
+				}
+				last = time.Now()
+
 				// PhantomJS sucks and forces us to reopen the page every now and then
 				// or else it'll like 1.5 GB memory and eventually crash.
-				if i != 0 && i%reopenCount == 0 {
+				if i != start && (i-start)%reopenCount == 0 {
 					log.Info("Closing and reopening reader...")
 					// PhantomJS is shit and doesn't GC unless you close the page,
 					// so to reduce memory usage and prevent it from crashing we
 					// close the page and reopen it, run scripts again, etc. etc.
-					if err := page.Destroy(); err != nil {
-						log.Error("Failed to destroy the page.")
-						panic(err)
-					}
-
-					page, _ = getReaderPage(driver, url, false)
+					reopen()
 					reopened = true
 				}
 
 				// Prefetch pages before we start polling.
-				for j := 0; j < prefetchCount && j+i < length; j++ {
+				for j := 0; j < prefetchCount && j+i < pages; j++ {
 					// Skip if already prefetched and make sure we don't prefetch if we're
 					// reopening the reader soon.
 					if prefetched[i+j] {
 						continue
-					} else if !reopened && i != 0 && (i+j)%reopenCount == 0 {
+					} else if !reopened && i != start && (i+j-start)%reopenCount == 0 {
 						break
 					} else if reopened {
 						reopened = false
@@ -181,22 +252,22 @@ func (ebj *EBookJapan) DownloadGenerator(url string) (dlgen func() plugins.Downl
 					prefetched[i+j] = true
 				}
 
-				// Start polling for the data.
-				var data string
-				now := time.Now()
-				for time.Since(now).Seconds() < dataTimeout {
-					if err := page.RunScript(fmt.Sprintf(fetchDataScript, i+1), nil, &data); err != nil {
+				// Start polling for the data. The canvas sometimes gets stuck, in which
+				// case reopening the reader and asking for the page again usually works.
+				data := poll(i)
+				for retry := 0; len(data) < 22 && retry < maxDataRetries; retry++ {
+					log.Warnf("Page %d did not return. Reopening the reader and retrying (%d/%d)...",
+						i+1, retry+1, maxDataRetries)
+					reopen()
+					// Anything we prefetched is gone with the old page.
+					for j := i; j < pages; j++ {
+						prefetched[j] = false
+					}
+					if err := page.RunScript(fmt.Sprintf(futureScript, i+1), nil, nil); err != nil {
 						panic(err)
-					} else if data != "" {
-						// We got something. Clean up and break.
-						if err := page.RunScript(fmt.Sprintf(cleanupScript, i+1), nil, nil); err != nil {
-							panic(err)
-						}
-						break
 					}
-
-					// Regulate polling speed.
-					time.Sleep(time.Millisecond * dataPolling)
+					prefetched[i] = true
+					data = poll(i)
 				}
 
 				// Check if we got data, or for whatever reason got malformed data.
@@ -207,39 +278,20 @@ func (ebj *EBookJapan) DownloadGenerator(url string) (dlgen func() plugins.Downl
 				// We have the page in base64, so all we need to do is decode it.
 				dataReader := strings.NewReader(data[strings.Index(data, ",")+1:])
 				dec := base64.NewDecoder(base64.StdEncoding, dataReader)
-				path := filepath.Join(dir, fmt.Sprintf("%04d.%s", i+1, ext))
+				path := filepath.Join(dir, fmt.Sprintf("%04d.%s", i+1, encOpts.Ext()))
 				// Further decode the decoded data as an image.
 				img, _, err := image.Decode(dec)
 				if err != nil {
 					return err
 				}
-				// Prepare to write a file.
-				w, err := rep.FileWriter(path, false)
-				if err != nil {
-					panic(err)
-				}
-
-				if opts["Lossless"].(bool) {
-					// The data we got from the canvas is already a PNG file, but it doesn't
-					// use compression at all from the looks of it. Re-encoding it massively
-					// reduces file size, so it's worth the trouble.
-					enc := png.Encoder{}
-					if enc.Encode(w, img); err != nil {
-						panic(err)
-					}
-				} else {
-					// Save as JPEG. We could theoretically just get the file as a
-					// JPEG from the canvas, but I trust this encoder more in every
-					// aspect. Could still be worth to compare speeds, though.
-					w, err := rep.FileWriter(path, false)
-					if err != nil {
-						panic(err)
-					}
-					if jpeg.Encode(w, img, &jpeg.Options{Quality: opts["JPEGQuality"].(int)}); err != nil {
-						panic(err)
-					}
+				// When lossless, note that the data we got from the canvas is already a PNG
+				// file, but it doesn't use compression at all from the looks of it. Re-encoding
+				// it massively reduces file size, so it's worth the trouble. As for JPEG, we
+				// could theoretically just get the file as a JPEG from the canvas, but I trust
+				// this encoder more in every aspect. Could still be worth to compare speeds, though.
+				if err := plugins.SaveImage(rep, path, img, encOpts); err != nil {
+					return err
 				}
-				w.Close()
 			}
 
 			return nil
@@ -267,7 +319,9 @@ func waitForLoad(page *agouti.Page) error {
 		}
 
 		// Regulate polling speed.
-		time.Sleep(time.Millisecond * loadPolling)
+		if err := plugins.Sleep(time.Millisecond * loadPolling); err != nil {
+			return err
+		}
 	}
 
 	return ErrEBJNoLoad
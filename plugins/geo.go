@@ -0,0 +1,86 @@
+package plugins
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Returned when a service refuses to serve content to the user's region.
+type ErrGeoRestricted struct {
+	StatusCode int
+	// The message the server returned, if any.
+	Message string
+}
+
+func (e *ErrGeoRestricted) Error() string {
+	msg := "The content is not available in your region. Try using a proxy or VPN in the country of the service"
+	if e.Message != "" {
+		return fmt.Sprintf("%s. The server said: %s", msg, e.Message)
+	}
+
+	return msg + "."
+}
+
+var (
+	// CloudFront, which is used by several of the services, returns a 403 with this in
+	// the body when a distribution has geo restrictions and the request is from outside.
+	reCloudFrontGeo = regexp.MustCompile(`(?i)configured to block access from your country`)
+	reHTMLTag       = regexp.MustCompile(`<[^>]*>`)
+	reWhitespace    = regexp.MustCompile(`\s+`)
+)
+
+// How much of the body we read to look for a geo restriction message.
+const geoBodyLimit = 4096
+
+// Check if a response with a non-200 status code is due to a geo restriction,
+// and return an ErrGeoRestricted if so. Consumes the body if it has to look at it,
+// so it should only be used when the response is about to be treated as an error.
+func CheckGeoRestriction(resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusUnavailableForLegalReasons:
+		return &ErrGeoRestricted{resp.StatusCode, readErrorMessage(resp.Body)}
+	case http.StatusForbidden:
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, geoBodyLimit))
+		if reCloudFrontGeo.Match(body) {
+			return &ErrGeoRestricted{resp.StatusCode, cleanErrorMessage(string(body))}
+		}
+	}
+
+	return nil
+}
+
+func readErrorMessage(r io.Reader) string {
+	body, _ := ioutil.ReadAll(io.LimitReader(r, geoBodyLimit))
+	return cleanErrorMessage(string(body))
+}
+
+// Turn an HTML (or plain text) error page into a single line.
+func cleanErrorMessage(s string) string {
+	s = reHTMLTag.ReplaceAllString(s, " ")
+	s = strings.TrimSpace(reWhitespace.ReplaceAllString(s, " "))
+	if len(s) > 200 {
+		s = truncateString(s, 200) + "..."
+	}
+
+	return s
+}
@@ -0,0 +1,21 @@
+package plugins
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestCleanErrorMessage(t *testing.T) {
+	if got := cleanErrorMessage("<html><body>\n<h1>Not</h1>  available\n</body></html>"); got != "Not available" {
+		t.Errorf("Expected %q, got %q.", "Not available", got)
+	}
+
+	// 3 bytes per rune, so the 200 byte limit falls in the middle of one.
+	long := cleanErrorMessage("<p>" + strings.Repeat("配信", 100) + "</p>")
+	if !utf8.ValidString(long) {
+		t.Errorf("Truncated message is not valid UTF-8: %q", long)
+	} else if !strings.HasSuffix(long, "...") || len(long) > 203 {
+		t.Errorf("Expected the message to be cut to 200 bytes plus an ellipsis, got %d bytes.", len(long))
+	}
+}
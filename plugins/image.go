@@ -0,0 +1,628 @@
+package plugins
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/MinoMino/logrus"
+	"github.com/MinoMino/mindl/plugins/jpeg"
+)
+
+/*
+   ==================================================
+                         IMAGES
+     Helpers for plugins that save decoded images.
+   ==================================================
+*/
+
+// How to encode images saved with SaveImage().
+type EncodeOptions struct {
+	// Save as PNG if true, otherwise as JPEG.
+	Lossless bool
+	// The quality to use for JPEG.
+	JPEGQuality int
+	// The chroma subsampling to use for JPEG.
+	ChromaSubsampling jpeg.Subsampling
+	// The compression level to use for PNG.
+	PNGCompression png.CompressionLevel
+	// Also save a copy in the other format. See SaveImage().
+	Dual bool
+}
+
+var ErrInvalidPNGCompression = errors.New("Invalid PNG compression. Should be best, default, speed or none.")
+
+var pngCompressionLevels = map[string]png.CompressionLevel{
+	"best":    png.BestCompression,
+	"default": png.DefaultCompression,
+	"speed":   png.BestSpeed,
+	"none":    png.NoCompression,
+}
+
+// An option for the PNG compression level, which only accepts the
+// names in pngCompressionLevels. Plugins that have a "Lossless" option
+// should have one of these too.
+type PNGCompressionOption struct {
+	V string
+}
+
+func NewPNGCompressionOption() *PNGCompressionOption {
+	// These are one-time downloads that are likely to be kept around,
+	// so spend the extra CPU time on smaller files by default.
+	return &PNGCompressionOption{V: "best"}
+}
+
+func (opt *PNGCompressionOption) Key() string {
+	return "PNGCompression"
+}
+
+func (opt *PNGCompressionOption) Value() interface{} {
+	return opt.V
+}
+
+func (opt *PNGCompressionOption) Set(v string) error {
+	v = strings.ToLower(strings.TrimSpace(v))
+	if _, ok := pngCompressionLevels[v]; !ok {
+		return ErrInvalidPNGCompression
+	}
+
+	opt.V = v
+	return nil
+}
+
+func (opt *PNGCompressionOption) IsRequired() bool {
+	return false
+}
+
+func (opt *PNGCompressionOption) IsHidden() bool {
+	return false
+}
+
+func (opt *PNGCompressionOption) Comment() string {
+	return "Does nothing if Lossless is off. One of best, default, speed or none. Better compression takes more CPU time."
+}
+
+var ErrInvalidChromaSubsampling = errors.New("Invalid chroma subsampling. Should be 420 or 444.")
+
+var chromaSubsamplings = map[string]jpeg.Subsampling{
+	"420": jpeg.Subsampling420,
+	"444": jpeg.Subsampling444,
+}
+
+// An option for the chroma subsampling of JPEG images, which only accepts
+// the names in chromaSubsamplings. Plugins that have a "JPEGQuality"
+// option should have one of these too.
+type ChromaSubsamplingOption struct {
+	V string
+}
+
+func NewChromaSubsamplingOption() *ChromaSubsamplingOption {
+	// 4:2:0 is what the standard library has always used, so keep it as the default.
+	return &ChromaSubsamplingOption{V: "420"}
+}
+
+func (opt *ChromaSubsamplingOption) Key() string {
+	return "ChromaSubsampling"
+}
+
+func (opt *ChromaSubsamplingOption) Value() interface{} {
+	return opt.V
+}
+
+func (opt *ChromaSubsamplingOption) Set(v string) error {
+	v = strings.Replace(strings.TrimSpace(v), ":", "", -1)
+	if _, ok := chromaSubsamplings[v]; !ok {
+		return ErrInvalidChromaSubsampling
+	}
+
+	opt.V = v
+	return nil
+}
+
+func (opt *ChromaSubsamplingOption) IsRequired() bool {
+	return false
+}
+
+func (opt *ChromaSubsamplingOption) IsHidden() bool {
+	return false
+}
+
+func (opt *ChromaSubsamplingOption) Comment() string {
+	return "Does nothing if Lossless is on. 420 or 444. 444 keeps colored text sharp at the cost of bigger files."
+}
+
+// Get the encode options from the "Lossless", "JPEGQuality", "ChromaSubsampling",
+// "PNGCompression" and "DualOutput" options, which plugins that save images should have.
+func EncodeOptionsFromMap(opts map[string]interface{}) EncodeOptions {
+	res := EncodeOptions{JPEGQuality: jpeg.DefaultQuality, PNGCompression: png.BestCompression}
+	if lossless, ok := opts["Lossless"].(bool); ok {
+		res.Lossless = lossless
+	}
+	if quality, ok := opts["JPEGQuality"].(int); ok {
+		res.JPEGQuality = quality
+	}
+	if subsampling, ok := opts["ChromaSubsampling"].(string); ok {
+		res.ChromaSubsampling = chromaSubsamplings[subsampling]
+	}
+	if level, ok := opts["PNGCompression"].(string); ok {
+		res.PNGCompression = pngCompressionLevels[level]
+	}
+	if dual, ok := opts["DualOutput"].(bool); ok {
+		res.Dual = dual
+	}
+
+	return res
+}
+
+// Whether or not the data starts like a JPEG file.
+func IsJPEG(data []byte) bool {
+	return len(data) > 3 && data[0] == 0xFF && data[1] == 0xD8 && data[2] == 0xFF
+}
+
+// Extensions for the types of data that books can have in place of pages, but
+// that aren't images, by detected content type. See SaveContent().
+var contentExts = map[string]string{
+	"application/pdf":              "pdf",
+	"application/zip":              "zip",
+	"application/x-rar-compressed": "rar",
+}
+
+func contentType(data []byte) string {
+	ct := http.DetectContentType(data)
+	if i := strings.IndexByte(ct, ';'); i != -1 {
+		ct = ct[:i]
+	}
+
+	return ct
+}
+
+// Whether or not the data is of a known type that isn't an image and should be
+// saved as is with SaveContent(). Anything else is assumed to be an image, so
+// that what isn't fails to decode like any broken page would.
+func IsContent(data []byte) bool {
+	_, ok := contentExts[contentType(data)]
+	return ok
+}
+
+// Save data that might not be an image. If IsContent() says it isn't, it's saved
+// as is with an extension for its type. Otherwise it's decoded and saved with
+// SaveImage(), so the extension of the path is replaced by the one of the options.
+func SaveContent(rep Reporter, path string, data []byte, opts EncodeOptions) error {
+	stem := strings.TrimSuffix(path, filepath.Ext(path))
+	if ct := contentType(data); IsContent(data) {
+		log.WithField("type", ct).Debugf("Saving %s as is since it's not an image.", path)
+		_, err := rep.SaveData(stem+"."+contentExts[ct], bytes.NewReader(data), false)
+		return err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	return SaveImage(rep, stem+"."+opts.Ext(), img, opts)
+}
+
+// Make a PassThroughJPEG option, for plugins that can get images that are
+// already final JPEG files and therefore don't need to be re-encoded.
+func NewPassThroughJPEGOption() *BoolOption {
+	return &BoolOption{K: "PassThroughJPEG", V: false,
+		C: "If set to true, save JPEG images that don't need descrambling as is instead of re-encoding them. Does nothing if Lossless is on."}
+}
+
+// A pool of RGBA images of a single size, so that descramblers can reuse the
+// memory of pages that are done being saved. The size is that of the first image
+// requested, since virtually every page of a volume has the same resolution.
+// Images of any other size are allocated and garbage collected as usual.
+type RGBAPool struct {
+	pool sync.Pool
+	size image.Point
+	once sync.Once
+}
+
+// Get a blank image of the given size with its origin at (0, 0).
+func (rp *RGBAPool) Get(width, height int) *image.RGBA {
+	size := image.Pt(width, height)
+	rp.once.Do(func() { rp.size = size })
+	if size != rp.size {
+		return image.NewRGBA(image.Rectangle{Max: size})
+	}
+
+	if img, ok := rp.pool.Get().(*image.RGBA); ok {
+		for i := range img.Pix {
+			img.Pix[i] = 0
+		}
+		return img
+	}
+	return image.NewRGBA(image.Rectangle{Max: size})
+}
+
+// Give an image from Get() back to the pool. It must not be used afterwards.
+// Does nothing with images that don't belong in the pool.
+func (rp *RGBAPool) Put(img image.Image) {
+	rgba, ok := img.(*image.RGBA)
+	if !ok || rgba.Rect != (image.Rectangle{Max: rp.size}) {
+		return
+	}
+
+	rp.pool.Put(rgba)
+}
+
+// The goroutines pages are handed to for descrambling and encoding. nil means
+// the workers do it themselves, with no limit besides the number of workers.
+var descrambleQueue *descramblePool
+
+// Set the number of goroutines that descramble and encode pages, independently
+// of the number of workers. 0 or less means the workers do it themselves.
+func SetDescrambleWorkers(n int) {
+	if descrambleQueue != nil {
+		close(descrambleQueue.jobs)
+		descrambleQueue = nil
+	}
+	if n > 0 {
+		descrambleQueue = newDescramblePool(n)
+	}
+}
+
+// A fixed number of goroutines running the functions given to Descramble(), and
+// the first error any of them returned since the last call to wait().
+type descramblePool struct {
+	jobs    chan func() error
+	pending sync.WaitGroup
+	err     error
+	m       sync.Mutex
+}
+
+func newDescramblePool(n int) *descramblePool {
+	dp := &descramblePool{jobs: make(chan func() error, n)}
+	for i := 0; i < n; i++ {
+		go dp.run()
+	}
+
+	return dp
+}
+
+func (dp *descramblePool) run() {
+	for fn := range dp.jobs {
+		err := runRecovered(fn)
+		dp.m.Lock()
+		if err != nil && dp.err == nil {
+			dp.err = err
+		}
+		dp.m.Unlock()
+		dp.pending.Done()
+	}
+}
+
+// Run fn, turning a panic into an error since nothing else would recover it.
+func runRecovered(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Descrambling panicked: %v", r)
+		}
+	}()
+
+	return fn()
+}
+
+// Queue fn, blocking while the queue is full. Returns the error of a page that
+// failed earlier instead, so that workers stop downloading pages for nothing.
+func (dp *descramblePool) add(fn func() error) error {
+	dp.m.Lock()
+	err := dp.err
+	dp.m.Unlock()
+	if err != nil {
+		return err
+	}
+
+	dp.pending.Add(1)
+	dp.jobs <- fn
+	return nil
+}
+
+// Wait for every queued function to return and get the first error, if any.
+func (dp *descramblePool) wait() error {
+	dp.pending.Wait()
+	dp.m.Lock()
+	defer dp.m.Unlock()
+	err := dp.err
+	dp.err = nil
+	return err
+}
+
+// Whether or not plugins should skip descrambling and save the images as they
+// were downloaded instead, for debugging. See ScrambledSuffix.
+var NoDescramble bool
+
+// Appended to the file names of images saved as they were before descrambling.
+const ScrambledSuffix = ".scrambled"
+
+// Whether or not descramblers should report their keys and how they descrambled
+// a sample page at the info level instead of the debug level. See ReportDescrambling().
+var ReportKeys bool
+
+// Log an entry with the details of a descrambler, such as the type of keys it
+// got and the rectangles and dimensions of a sample page. Descramblers should
+// only do so once per volume to keep the noise down.
+func ReportDescrambling(entry log.FieldLogger) {
+	if ReportKeys {
+		entry.Info("Descrambler report.")
+	} else {
+		entry.Debug("Descrambler report.")
+	}
+}
+
+// Returned by CheckImageBody() if a response that should be an image isn't one.
+type ErrNotImage struct {
+	ContentType string
+	// The start of the body, to tell what the server sent instead.
+	Snippet string
+}
+
+func (e *ErrNotImage) Error() string {
+	return fmt.Sprintf("Expected an image, but got %s: %q", e.ContentType, e.Snippet)
+}
+
+// How much of a body CheckImageBody() sniffs and puts in the error.
+const (
+	sniffLength   = 512
+	snippetLength = 200
+)
+
+// Check that a response body that should be an image isn't an HTML error page or
+// the like, which sites sometimes serve with a 200. Decoding those fails with a
+// cryptic error, so this returns an *ErrNotImage instead and closes the body.
+// Otherwise it returns a body that still reads from the start.
+func CheckImageBody(body io.ReadCloser) (io.ReadCloser, error) {
+	br := bufio.NewReaderSize(body, sniffLength)
+	head, err := br.Peek(sniffLength)
+	if err != nil && err != io.EOF {
+		body.Close()
+		return nil, err
+	}
+
+	if ct := http.DetectContentType(head); len(head) == 0 || strings.HasPrefix(ct, "text/") {
+		body.Close()
+		snippet := strings.Join(strings.Fields(string(head)), " ")
+		if len(snippet) > snippetLength {
+			snippet = truncateString(snippet, snippetLength)
+		}
+		return nil, &ErrNotImage{ContentType: ct, Snippet: snippet}
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{br, body}, nil
+}
+
+// If set, the directory descramblers write each distinct set of rectangles they
+// use to, so that other programs can descramble the images without reimplementing
+// the key handling. For --export-rects.
+var ExportRectsDir string
+
+// A rectangle of a scrambled image and where it goes in the descrambled one.
+type DescrambleRect struct {
+	SrcX   int `json:"src_x"`
+	SrcY   int `json:"src_y"`
+	DstX   int `json:"dst_x"`
+	DstY   int `json:"dst_y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// Everything needed to descramble an image with a particular set of rectangles.
+// Copying the rectangles from the source image to a blank image of the
+// destination size, in order, gives the descrambled image.
+type RectMap struct {
+	// One of the pages it was used for.
+	Sample     string           `json:"sample"`
+	SrcWidth   int              `json:"src_width"`
+	SrcHeight  int              `json:"src_height"`
+	DstWidth   int              `json:"dst_width"`
+	DstHeight  int              `json:"dst_height"`
+	Rectangles []DescrambleRect `json:"rectangles"`
+}
+
+var (
+	exportedRects  = make(map[string]bool)
+	exportedRectsM sync.Mutex
+)
+
+// Write the rectangle map to a JSON file in ExportRectsDir, if set. The file is
+// named after the prefix, the source size and a hash of the rectangles, so maps
+// that are used for several pages are only written once.
+func ExportRects(prefix string, rm *RectMap) error {
+	if ExportRectsDir == "" {
+		return nil
+	}
+
+	rects, err := json.Marshal(rm.Rectangles)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%dx%d-%08x.json", prefix, rm.SrcWidth, rm.SrcHeight, crc32.ChecksumIEEE(rects))
+
+	exportedRectsM.Lock()
+	defer exportedRectsM.Unlock()
+	if exportedRects[name] {
+		return nil
+	}
+	data, err := json.MarshalIndent(rm, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(ExportRectsDir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(ExportRectsDir, name)
+	log.Debugf("Exporting rectangles to: %s", path)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return err
+	}
+	exportedRects[name] = true
+
+	return nil
+}
+
+// Whether or not pages can be decoded as they're downloaded with StreamSized().
+// Not if they're handed to the goroutines set by SetDescrambleWorkers(), since
+// the worker would then have to wait for one of them for the whole download.
+func CanStream() bool {
+	return descrambleQueue == nil
+}
+
+// Get a reader of what's copied from src through the reporter as it's received,
+// so that an image can be decoded without buffering the whole file first, while
+// still reporting the progress like CopySized() does. The reader has to be closed,
+// which stops the copying if the decoder didn't read everything.
+func StreamSized(rep Reporter, src io.Reader, size int64) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := rep.CopySized(pw, src, size)
+		pw.CloseWithError(err)
+	}()
+
+	return pr
+}
+
+// Run the CPU-bound part of saving a page. If SetDescrambleWorkers() was used,
+// it's queued for one of its goroutines and this returns right away, so that the
+// worker can move on to downloading the next page. Plugins should therefore only
+// call it once the page is buffered, and fn must not use anything that's only
+// valid until the downloader returns. Since the page is saved after its downloader
+// is done, an error fails the download as a whole rather than just the page.
+func Descramble(fn func() error) error {
+	if descrambleQueue == nil {
+		return fn()
+	}
+
+	return descrambleQueue.add(fn)
+}
+
+// Wait for the pages queued by Descramble() to be saved, and get the first error
+// any of them failed with. Must be called before a download is considered done.
+func WaitDescrambles() error {
+	if descrambleQueue == nil {
+		return nil
+	}
+
+	return descrambleQueue.wait()
+}
+
+// The file extension (without the dot) of images encoded with the options.
+func (eo EncodeOptions) Ext() string {
+	if eo.Lossless {
+		return "png"
+	}
+
+	return "jpg"
+}
+
+// Make a DualOutput option. Plugins that have a "Lossless" option should have one of these too.
+func NewDualOutputOption() *BoolOption {
+	return &BoolOption{K: "DualOutput", V: false,
+		C: "If set to true, also save a copy of each page in the format Lossless didn't pick, in a parallel directory."}
+}
+
+// Encode the image according to the options and save it through the reporter.
+// The path should have the extension returned by the options' Ext().
+//
+// If Dual is set, a copy in the other format is saved too. It's put in a
+// top-level directory of its own, named after the one in the path with the
+// format as a suffix, so that each format ends up in its own archive if zipped.
+func SaveImage(rep Reporter, path string, img image.Image, opts EncodeOptions) error {
+	if err := encodeImage(rep, path, img, opts); err != nil {
+		return err
+	} else if !opts.Dual {
+		return nil
+	}
+
+	other := opts
+	other.Lossless = !opts.Lossless
+	return encodeImage(rep, dualPath(path, other), img, other)
+}
+
+// Whether or not plugins should also save the cover of each volume with SaveCover().
+var SaveCovers bool
+
+// The name of the file SaveCover() saves covers as.
+const CoverFilename = "cover.jpg"
+
+// Whether or not a saved file is a cover from SaveCover() rather than a page.
+// Covers renamed with a prefix, like the "v01-" of --series, count too.
+func IsCover(path string) bool {
+	base := filepath.Base(path)
+	return base == CoverFilename || strings.HasSuffix(base, "-"+CoverFilename)
+}
+
+// Save the image as the cover in the directory of the volume. Always saved as a
+// JPEG regardless of Lossless, since that's what readers and library managers expect.
+func SaveCover(rep Reporter, dir string, img image.Image, opts EncodeOptions) error {
+	opts.Lossless = false
+	return encodeImage(rep, filepath.Join(dir, CoverFilename), img, opts)
+}
+
+// Get the path of the copy saved in the other format, e.g. "Title/0001.png"
+// becomes "Title [JPEG]/0001.jpg" if the other format is JPEG.
+func dualPath(path string, other EncodeOptions) string {
+	split := strings.SplitN(filepath.ToSlash(path), "/", 2)
+	if len(split) < 2 {
+		return path
+	}
+
+	format := "JPEG"
+	if other.Lossless {
+		format = "PNG"
+	}
+	dir := split[0] + " [" + format + "]"
+	file := strings.TrimSuffix(split[1], filepath.Ext(split[1])) + "." + other.Ext()
+	return filepath.Join(dir, filepath.FromSlash(file))
+}
+
+func encodeImage(rep Reporter, path string, img image.Image, opts EncodeOptions) error {
+	w, err := rep.FileWriter(path, false)
+	if err != nil {
+		return err
+	}
+
+	if opts.Lossless {
+		enc := png.Encoder{CompressionLevel: opts.PNGCompression}
+		err = enc.Encode(w, img)
+	} else {
+		err = jpeg.Encode(w, img, &jpeg.Options{Quality: opts.JPEGQuality, Subsampling: opts.ChromaSubsampling})
+	}
+	if err != nil {
+		AbortWriter(w)
+		return err
+	}
+
+	return w.Close()
+}
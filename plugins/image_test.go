@@ -0,0 +1,254 @@
+package plugins
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestRGBAPool(t *testing.T) {
+	var rp RGBAPool
+	img := rp.Get(4, 2)
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	rp.Put(img)
+
+	// Reused images have to be blank again.
+	img = rp.Get(4, 2)
+	for i, b := range img.Pix {
+		if b != 0 {
+			t.Fatalf("Pixel data at %d wasn't cleared: %#x", i, b)
+		}
+	}
+	if img.Rect != image.Rect(0, 0, 4, 2) {
+		t.Errorf("Expected a 4x2 image at the origin, got %v.", img.Rect)
+	}
+
+	// Other sizes are allocated as usual and never pooled.
+	other := rp.Get(2, 4)
+	if other.Rect != image.Rect(0, 0, 2, 4) {
+		t.Errorf("Expected a 2x4 image at the origin, got %v.", other.Rect)
+	}
+	rp.Put(other)
+	if img := rp.Get(4, 2); img.Rect != image.Rect(0, 0, 4, 2) {
+		t.Errorf("Got an image of the wrong size from the pool: %v", img.Rect)
+	}
+}
+
+// Descrambling 200 pages of 1600x2400 with a fresh image per page and with the pool.
+func BenchmarkRGBAPool(b *testing.B) {
+	const pages, width, height = 200, 1600, 2400
+	b.Run("Fresh", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for p := 0; p < pages; p++ {
+				img := image.NewRGBA(image.Rect(0, 0, width, height))
+				img.Pix[0] = 1
+			}
+		}
+	})
+	b.Run("Pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		var rp RGBAPool
+		for i := 0; i < b.N; i++ {
+			for p := 0; p < pages; p++ {
+				img := rp.Get(width, height)
+				img.Pix[0] = 1
+				rp.Put(img)
+			}
+		}
+	})
+}
+
+func TestDescramblePool(t *testing.T) {
+	SetDescrambleWorkers(2)
+	defer SetDescrambleWorkers(0)
+
+	// The worker doesn't wait for the page to be descrambled.
+	release := make(chan struct{})
+	ran := make(chan struct{}, 1)
+	if err := Descramble(func() error {
+		<-release
+		ran <- struct{}{}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ran:
+		t.Fatal("Descramble() waited for the function to return.")
+	default:
+	}
+	close(release)
+	if err := WaitDescrambles(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ran:
+	default:
+		t.Fatal("WaitDescrambles() returned before the function did.")
+	}
+
+	// The first error fails the pages queued after it and is returned by the wait.
+	errFailed := errors.New("failed")
+	Descramble(func() error { return errFailed })
+	var err error
+	for i := 0; i < 1000 && err == nil; i++ {
+		time.Sleep(time.Millisecond)
+		err = Descramble(func() error { return nil })
+	}
+	if err != errFailed {
+		t.Errorf("Expected Descramble() to return the earlier error, got %v.", err)
+	}
+	if err := WaitDescrambles(); err != errFailed {
+		t.Errorf("Expected WaitDescrambles() to return the error, got %v.", err)
+	}
+
+	Descramble(func() error { panic("oops") })
+	if err := WaitDescrambles(); err == nil {
+		t.Error("Expected a panic to be returned as an error.")
+	}
+	if err := WaitDescrambles(); err != nil {
+		t.Errorf("Expected the error to be cleared after the wait, got %v.", err)
+	}
+}
+
+type closeRecorder struct {
+	*bytes.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestCheckImageBody(t *testing.T) {
+	var img bytes.Buffer
+	if err := jpeg.Encode(&img, image.NewGray(image.Rect(0, 0, 16, 16)), nil); err != nil {
+		t.Fatal(err)
+	}
+	body := &closeRecorder{Reader: bytes.NewReader(img.Bytes())}
+	r, err := CheckImageBody(body)
+	if err != nil {
+		t.Fatalf("Expected a JPEG to pass, got: %s", err)
+	}
+	if data, _ := ioutil.ReadAll(r); !bytes.Equal(data, img.Bytes()) {
+		t.Error("The body of the JPEG wasn't read from the start.")
+	}
+
+	// An error page with multibyte characters where the snippet gets cut off.
+	page := "<!DOCTYPE html>\n<html>\n  <head><title>エラー</title></head>\n  <body>" +
+		strings.Repeat("アクセスが集中しています。", 20) + "</body>\n</html>"
+	body = &closeRecorder{Reader: bytes.NewReader([]byte(page))}
+	_, err = CheckImageBody(body)
+	e, ok := err.(*ErrNotImage)
+	if !ok {
+		t.Fatalf("Expected an *ErrNotImage for an HTML page, got: %v", err)
+	}
+	if !strings.HasPrefix(e.ContentType, "text/html") {
+		t.Errorf("Expected the content type text/html, got %s.", e.ContentType)
+	}
+	if !strings.HasPrefix(e.Snippet, "<!DOCTYPE html> <html> <head><title>エラー") {
+		t.Errorf("Expected the snippet to be the start of the page on a single line, got %q.", e.Snippet)
+	}
+	if len(e.Snippet) > snippetLength || !utf8.ValidString(e.Snippet) {
+		t.Errorf("Expected the snippet to be cut at a character at most %d bytes in, got %q.", snippetLength, e.Snippet)
+	}
+	if !body.closed {
+		t.Error("The body of the HTML page wasn't closed.")
+	}
+
+	if _, err := CheckImageBody(&closeRecorder{Reader: bytes.NewReader(nil)}); err == nil {
+		t.Error("Expected an error for an empty body.")
+	}
+}
+
+func TestSaveContent(t *testing.T) {
+	var img bytes.Buffer
+	if err := jpeg.Encode(&img, image.NewGray(image.Rect(0, 0, 16, 16)), nil); err != nil {
+		t.Fatal(err)
+	}
+	opts := EncodeOptions{Lossless: true}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		content  bool
+		expected []string
+	}{
+		{"jpeg", img.Bytes(), false, []string{"Title/0001.png"}},
+		{"pdf", []byte("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n1 0 obj"), true, []string{"Title/0001.pdf"}},
+		{"zip", []byte("PK\x03\x04\x14\x00\x00\x00"), true, []string{"Title/0001.zip"}},
+		// Anything unknown is treated like a broken image.
+		{"html", []byte("<html><body>Not found</body></html>"), false, nil},
+		{"text", []byte("Not found"), false, nil},
+		{"binary", []byte{0x00, 0x01, 0x02, 0x03, 0xfe, 0xff}, false, nil},
+	}
+
+	for _, test := range tests {
+		if content := IsContent(test.data); content != test.content {
+			t.Errorf("%s: IsContent() = %v, expected %v.", test.name, content, test.content)
+		}
+		rep := NewMemReporter()
+		err := SaveContent(rep, filepath.Join("Title", "0001"), test.data, opts)
+		if test.expected == nil && err == nil {
+			t.Errorf("%s: expected an error decoding it, but it was saved as %v.", test.name, rep.Names())
+		} else if test.expected != nil && err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if names := rep.Names(); test.expected != nil && !reflect.DeepEqual(names, test.expected) {
+			t.Errorf("%s: saved %v, expected %v.", test.name, names, test.expected)
+		}
+		if test.content && err == nil && !bytes.Equal(rep.Files[test.expected[0]], test.data) {
+			t.Errorf("%s: the data wasn't saved as is.", test.name)
+		}
+	}
+}
+
+// Decoding a page as it's received compared to buffering all of it first,
+// which is what plugins do when they need the original data.
+func BenchmarkStreamSized(b *testing.B) {
+	src := image.NewRGBA(image.Rect(0, 0, 1600, 2400))
+	for i := range src.Pix {
+		src.Pix[i] = uint8(i * 7 % 251)
+	}
+	var page bytes.Buffer
+	if err := jpeg.Encode(&page, src, &jpeg.Options{Quality: 95}); err != nil {
+		b.Fatal(err)
+	}
+	rep := NewMemReporter()
+	size := int64(page.Len())
+
+	b.Run("Buffered", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buf := &bytes.Buffer{}
+			if _, err := rep.CopySized(buf, bytes.NewReader(page.Bytes()), size); err != nil {
+				b.Fatal(err)
+			}
+			if _, _, err := image.Decode(buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Streamed", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			stream := StreamSized(rep, bytes.NewReader(page.Bytes()), size)
+			_, _, err := image.Decode(stream)
+			stream.Close()
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,135 @@
+package plugins
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// A Reporter that keeps the files saved through it in memory, for testing
+// plugins without a download manager. Safe for concurrent use.
+type MemReporter struct {
+	// The saved files by their slash-separated paths.
+	Files map[string][]byte
+	// The expected sizes passed to CopySized() and SaveDataSized(), in order.
+	Sizes []int64
+
+	m sync.Mutex
+}
+
+func NewMemReporter() *MemReporter {
+	return &MemReporter{Files: make(map[string][]byte)}
+}
+
+// The paths of the saved files, sorted.
+func (rep *MemReporter) Names() []string {
+	rep.m.Lock()
+	defer rep.m.Unlock()
+	res := make([]string, 0, len(rep.Files))
+	for name := range rep.Files {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func (rep *MemReporter) addSize(size int64) {
+	rep.m.Lock()
+	rep.Sizes = append(rep.Sizes, size)
+	rep.m.Unlock()
+}
+
+func (rep *MemReporter) Copy(dst io.Writer, src io.Reader) (int64, error) {
+	return io.Copy(dst, src)
+}
+
+func (rep *MemReporter) CopySized(dst io.Writer, src io.Reader, size int64) (int64, error) {
+	rep.addSize(size)
+	return io.Copy(dst, src)
+}
+
+func (rep *MemReporter) SaveData(dst string, src io.Reader, report bool) (int64, error) {
+	w, _ := rep.FileWriter(dst, report)
+	n, err := io.Copy(w, src)
+	if err != nil {
+		AbortWriter(w)
+		return n, err
+	}
+	return n, w.Close()
+}
+
+func (rep *MemReporter) SaveDataSized(dst string, src io.Reader, size int64, report bool) (int64, error) {
+	rep.addSize(size)
+	return rep.SaveData(dst, src, report)
+}
+
+func (rep *MemReporter) SaveFile(dst, src string) (int64, error) {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return 0, err
+	}
+	return rep.SaveData(dst, bytes.NewReader(data), false)
+}
+
+func (rep *MemReporter) TempFile() (*os.File, error) {
+	return ioutil.TempFile("", "mindl-test-")
+}
+
+func (rep *MemReporter) FileWriter(dst string, report bool) (io.WriteCloser, error) {
+	return &memWriter{rep: rep, path: filepath.ToSlash(dst)}, nil
+}
+
+func (rep *MemReporter) PartialSize(dst string) (int64, error) {
+	rep.m.Lock()
+	defer rep.m.Unlock()
+	return int64(len(rep.Files[filepath.ToSlash(dst)])), nil
+}
+
+func (rep *MemReporter) ResumeWriter(dst string, offset int64, report bool) (io.WriteCloser, error) {
+	w := &memWriter{rep: rep, path: filepath.ToSlash(dst)}
+	rep.m.Lock()
+	if data := rep.Files[w.path]; int64(len(data)) >= offset {
+		w.Write(data[:offset])
+	}
+	rep.m.Unlock()
+	return w, nil
+}
+
+// Saves what was written to it into the MemReporter when closed,
+// and drops it when aborted.
+type memWriter struct {
+	bytes.Buffer
+	rep  *MemReporter
+	path string
+}
+
+func (w *memWriter) Close() error {
+	w.rep.m.Lock()
+	w.rep.Files[w.path] = w.Bytes()
+	w.rep.m.Unlock()
+	return nil
+}
+
+func (w *memWriter) Abort() error {
+	return nil
+}
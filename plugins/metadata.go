@@ -0,0 +1,154 @@
+package plugins
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+/*
+   ==================================================
+                        METADATA
+     Information about a download beyond the files.
+   ==================================================
+*/
+
+// The direction in which the pages of a book are read.
+type PageDirection int
+
+const (
+	LeftToRight PageDirection = iota
+	RightToLeft
+)
+
+// Parse a direction as found in EPUB and most reader configs, i.e. "ltr"
+// or "rtl". Anything else, including an empty string, is left-to-right.
+func ParsePageDirection(s string) PageDirection {
+	if strings.EqualFold(strings.TrimSpace(s), "rtl") {
+		return RightToLeft
+	}
+
+	return LeftToRight
+}
+
+func (pd PageDirection) String() string {
+	if pd == RightToLeft {
+		return "rtl"
+	}
+
+	return "ltr"
+}
+
+// The Unicode normalization applied to titles by NormalizeTitle(), if any.
+var (
+	normalize     = true
+	normalization = norm.NFC
+)
+
+// Set the Unicode normalization form used for titles, i.e. "NFC", "NFD", "NFKC"
+// or "none" to leave them as the site returns them.
+func SetUnicodeNormalization(form string) error {
+	switch strings.ToUpper(form) {
+	case "NFC":
+		normalization = norm.NFC
+	case "NFD":
+		normalization = norm.NFD
+	case "NFKC":
+		normalization = norm.NFKC
+	case "NONE":
+		normalize = false
+		return nil
+	default:
+		return fmt.Errorf("Unknown Unicode normalization form: %s", form)
+	}
+	normalize = true
+
+	return nil
+}
+
+// Normalize a title returned by a site, so that the directory names and metadata
+// of every plugin are consistent with each other.
+func NormalizeTitle(title string) string {
+	if !normalize {
+		return title
+	}
+
+	return normalization.String(title)
+}
+
+// Make a Directory option, for plugins that name the directory of a volume after its title.
+func NewDirectoryOption() *StringOption {
+	return &StringOption{K: "Directory",
+		C: "If set, the name of the directory to save to instead of one based on the title."}
+}
+
+// Get the name of the directory of a volume, which is the Directory option if
+// it's set and the name based on the title otherwise. Since the option could
+// be anything, it's made into a single path component.
+func DirectoryName(opts map[string]interface{}, name string) string {
+	dir, _ := opts["Directory"].(string)
+	if strings.Trim(dir, " .") == "" {
+		return name
+	}
+
+	return SanitizeFilename(dir)
+}
+
+type Metadata struct {
+	Title string
+	// The series and volume, if the plugin can tell them apart from the title.
+	Series, Volume string
+	Direction      PageDirection
+}
+
+// Optional interface for plugins that know more about what they download
+// than the files themselves. If implemented, the metadata is written to a
+// ComicInfo.xml in each top-level directory once the download finishes, so
+// that comic readers display the book correctly.
+type MetadataProvider interface {
+	// Called after every file has been downloaded, or right after DownloadGenerator()
+	// if only the metadata was asked for. Can return nil.
+	Metadata() *Metadata
+}
+
+type comicInfo struct {
+	XMLName   xml.Name `xml:"ComicInfo"`
+	Title     string   `xml:",omitempty"`
+	Series    string   `xml:",omitempty"`
+	Number    string   `xml:",omitempty"`
+	PageCount int      `xml:",omitempty"`
+	Manga     string   `xml:",omitempty"`
+}
+
+// Get the metadata as a ComicInfo.xml document for a directory with the given number of pages.
+func (md *Metadata) ComicInfo(pages int) ([]byte, error) {
+	ci := comicInfo{Title: md.Title, Series: md.Series, Number: md.Volume, PageCount: pages}
+	if md.Direction == RightToLeft {
+		ci.Manga = "YesAndRightToLeft"
+	}
+
+	out, err := xml.MarshalIndent(ci, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(xml.Header), out...), nil
+}
@@ -0,0 +1,68 @@
+package plugins
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"sort"
+	"sync"
+)
+
+/*
+   ==================================================
+                        REGISTRY
+     Plugins register themselves in their init(),
+     so adding one is just a matter of importing it.
+   ==================================================
+*/
+
+var (
+	registry     = make(map[string]Plugin)
+	registryLock sync.Mutex
+)
+
+// Make a plugin available to mindl. Meant to be called from the init()
+// of the plugin's package. Panics if a plugin with the same name exists.
+func Register(p Plugin) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if p == nil {
+		panic("Register called with a nil plugin.")
+	} else if _, ok := registry[p.Name()]; ok {
+		panic("Register called twice for plugin: " + p.Name())
+	}
+
+	registry[p.Name()] = p
+}
+
+// Get all registered plugins, sorted by name.
+func Registered() []Plugin {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	res := make([]Plugin, 0, len(registry))
+	for _, p := range registry {
+		res = append(res, p)
+	}
+	sort.Sort(byName(res))
+
+	return res
+}
+
+type byName []Plugin
+
+func (s byName) Len() int           { return len(s) }
+func (s byName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byName) Less(i, j int) bool { return s[i].Name() < s[j].Name() }
@@ -0,0 +1,79 @@
+package plugins
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Sleeps for a while unless the context is done first. Plugins should sleep
+// with Sleep() instead of time.Sleep, so that tests can swap it for one that
+// doesn't actually wait and so that downloads can be cancelled mid-sleep.
+type Sleeper interface {
+	// Sleep for the duration, or return the error of the context if it's done first.
+	Sleep(ctx context.Context, d time.Duration) error
+}
+
+// A Sleeper that uses a timer.
+type TimerSleeper struct{}
+
+func (TimerSleeper) Sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// The Sleeper used by Sleep(). Tests can replace it.
+var DefaultSleeper Sleeper = TimerSleeper{}
+
+var (
+	sleepCtx = context.Background()
+	sleepM   sync.Mutex
+)
+
+// Set the context that cancels sleeps started with Sleep(), e.g. one that's
+// done when the current download is. nil means they're never cancelled.
+func SetSleepContext(ctx context.Context) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	sleepM.Lock()
+	sleepCtx = ctx
+	sleepM.Unlock()
+}
+
+// Sleep for the duration with the DefaultSleeper. Returns an error if the
+// context set with SetSleepContext() is done before the duration is over.
+func Sleep(d time.Duration) error {
+	sleepM.Lock()
+	ctx := sleepCtx
+	sleepM.Unlock()
+
+	return DefaultSleeper.Sleep(ctx, d)
+}
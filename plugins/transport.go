@@ -0,0 +1,382 @@
+package plugins
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/MinoMino/logrus"
+)
+
+/*
+   ==================================================
+                       TRANSPORT
+     The http.RoundTripper used by NewHTTPClient().
+   ==================================================
+*/
+
+// Usage statistics for all the requests made through clients
+// created with NewHTTPClient().
+type HTTPStats struct {
+	// Number of requests sent.
+	Requests int64
+	// Number of requests that either failed outright or
+	// that got a response with a status code >= 400.
+	Failed int64
+	// Number of response body bytes read.
+	Bytes int64
+	// Number of attempts retried by Retry() and RetryIf().
+	Retries int64
+}
+
+var httpStats HTTPStats
+
+// Get a snapshot of the HTTP usage so far. Take the difference
+// between two snapshots to get the usage of a single download.
+func GetHTTPStats() HTTPStats {
+	return HTTPStats{
+		Requests: atomic.LoadInt64(&httpStats.Requests),
+		Failed:   atomic.LoadInt64(&httpStats.Failed),
+		Bytes:    atomic.LoadInt64(&httpStats.Bytes),
+		Retries:  atomic.LoadInt64(&httpStats.Retries),
+	}
+}
+
+func (s HTTPStats) Add(o HTTPStats) HTTPStats {
+	return HTTPStats{s.Requests + o.Requests, s.Failed + o.Failed, s.Bytes + o.Bytes, s.Retries + o.Retries}
+}
+
+func (s HTTPStats) Sub(o HTTPStats) HTTPStats {
+	return HTTPStats{s.Requests - o.Requests, s.Failed - o.Failed, s.Bytes - o.Bytes, s.Retries - o.Retries}
+}
+
+// Wraps a RoundTripper and keeps track of the usage.
+type statsTransport struct {
+	http.RoundTripper
+}
+
+func (t *statsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := waitJitter(req); err != nil {
+		return nil, err
+	}
+	if requestLimiter != nil {
+		if err := requestLimiter.wait(req); err != nil {
+			return nil, err
+		}
+	}
+	release, err := acquireHost(req)
+	if err != nil {
+		return nil, err
+	}
+
+	atomic.AddInt64(&httpStats.Requests, 1)
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		release()
+		atomic.AddInt64(&httpStats.Failed, 1)
+		return resp, err
+	}
+	// Hold on to the host's slot until the body has been read.
+	resp.Body = &releasingReadCloser{ReadCloser: resp.Body, release: release}
+
+	if resp.StatusCode >= 400 {
+		atomic.AddInt64(&httpStats.Failed, 1)
+	}
+	logResponse(req, resp)
+	resp.Body = &countingReadCloser{resp.Body}
+	if err := decompressBody(req, resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// Whether or not to log the status and the interesting headers of every
+// response at the info level instead of the debug level. Set by --log-headers.
+var LogHeaders bool
+
+// Log the status and headers that tell what a response is and where it came from,
+// which helps with CDN quirks or e.g. an HTML error page served instead of an image.
+// The URL is redacted like in dumps, since the log can end up in bug reports.
+func logResponse(req *http.Request, resp *http.Response) {
+	entry := log.WithFields(log.Fields{
+		"url":            redactURL(req.URL),
+		"status":         resp.StatusCode,
+		"content_type":   resp.Header.Get("Content-Type"),
+		"content_length": resp.ContentLength,
+		"server":         resp.Header.Get("Server"),
+	})
+	if LogHeaders {
+		entry.Info("Got response.")
+	} else {
+		entry.Debug("Got response.")
+	}
+}
+
+// The transport asks for gzip and transparently decompresses responses by itself,
+// which helps a lot with the larger JSON and JS responses of the APIs. However, it
+// doesn't if the request sets Accept-Encoding manually, so we handle that here to
+// make sure plugins always get decompressed bodies. Images are already compressed,
+// so servers don't compress them and image downloads don't benefit from any of this.
+func decompressBody(req *http.Request, resp *http.Response) error {
+	if resp.Uncompressed || req.Method == "HEAD" {
+		return nil
+	}
+
+	var r io.ReadCloser
+	var err error
+	switch strings.ToLower(resp.Header.Get("Content-Encoding")) {
+	case "gzip":
+		r, err = gzip.NewReader(resp.Body)
+	case "deflate":
+		r, err = zlib.NewReader(resp.Body)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	resp.Body = &decompressingReadCloser{r, resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
+
+// Reads from the decompressor, but closes both it and the original body.
+type decompressingReadCloser struct {
+	io.ReadCloser
+	body io.ReadCloser
+}
+
+func (d *decompressingReadCloser) Close() error {
+	d.ReadCloser.Close()
+	return d.body.Close()
+}
+
+// Counts the bytes read from a response body.
+type countingReadCloser struct {
+	io.ReadCloser
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	atomic.AddInt64(&httpStats.Bytes, int64(n))
+	return n, err
+}
+
+// Releases a slot taken with acquireHost() when closed.
+type releasingReadCloser struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (r *releasingReadCloser) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.release)
+	return err
+}
+
+// Semaphores limiting the number of concurrent requests to a host, keyed on
+// the host as given to SetHostConcurrency(). Hosts without one aren't limited
+// beyond the number of workers.
+var hostLimits map[string]chan struct{}
+
+// Limit the number of concurrent requests to some hosts, e.g. to go easier on
+// an API than on the CDN the images are on. A limit applies to the host itself
+// and its subdomains. Must be called before any requests are made.
+func SetHostConcurrency(limits map[string]int) error {
+	res := make(map[string]chan struct{})
+	for host, n := range limits {
+		if n <= 0 {
+			return fmt.Errorf("Invalid concurrency for %s: %d. Should be a positive integer.", host, n)
+		}
+		res[strings.ToLower(host)] = make(chan struct{}, n)
+	}
+
+	hostLimits = res
+	return nil
+}
+
+// Get the semaphore of the most specific host the request's host falls under.
+func hostSemaphore(host string) chan struct{} {
+	host = strings.ToLower(host)
+	for {
+		if sem, ok := hostLimits[host]; ok {
+			return sem
+		}
+		i := strings.Index(host, ".")
+		if i == -1 {
+			return nil
+		}
+		host = host[i+1:]
+	}
+}
+
+// Block until we can make a request to the host, or until the request is cancelled.
+// The returned function must be called when done with the request.
+func acquireHost(req *http.Request) (release func(), err error) {
+	sem := hostSemaphore(req.URL.Hostname())
+	if sem == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+}
+
+// Spaces out requests so that we stay at or below a certain rate. Some
+// jitter is added to each interval so that requests don't come in at a
+// perfectly regular pace, which would look a lot like a bot.
+type rateLimiter struct {
+	interval time.Duration
+	next     time.Time
+	m        sync.Mutex
+}
+
+// Shared by all clients made with NewHTTPClient(). nil if there's no limit.
+var requestLimiter *rateLimiter
+
+// Limit the number of requests per second made through clients created
+// with NewHTTPClient(), across all of them. A rate <= 0 disables the limit.
+func SetRequestRate(rate float64) {
+	if rate <= 0 {
+		requestLimiter = nil
+		return
+	}
+
+	requestLimiter = &rateLimiter{interval: time.Duration(float64(time.Second) / rate)}
+}
+
+// Block until the request is allowed to be sent, or until it's cancelled.
+func (rl *rateLimiter) wait(req *http.Request) error {
+	rl.m.Lock()
+	now := time.Now()
+	if rl.next.Before(now) {
+		rl.next = now
+	}
+	delay := rl.next.Sub(now)
+	// Jitter of up to ±25% of the interval.
+	jitter := time.Duration((rand.Float64() - 0.5) * 0.5 * float64(rl.interval))
+	rl.next = rl.next.Add(rl.interval + jitter)
+	rl.m.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+}
+
+// The maximum random delay before each request. 0 means no delay.
+var requestJitter time.Duration
+
+// Delay every request made through clients created with NewHTTPClient() by a
+// random amount of time up to max, so that API calls made in a tight loop don't
+// come in at the pace of a bot. Unlike SetRequestRate(), it slows down every
+// request even when they're few and far between, so keep it small.
+func SetRequestJitter(max time.Duration) {
+	if max < 0 {
+		max = 0
+	}
+	requestJitter = max
+}
+
+// Block for a random delay of up to requestJitter, or until the request is cancelled.
+func waitJitter(req *http.Request) error {
+	if requestJitter <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(requestJitter))))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+}
+
+// The maximum number of idle connections kept per host. Should be at least the
+// number of workers, or connections will keep getting closed and reopened
+// when downloading lots of small images from the same host in parallel.
+var MaxIdleConnsPerHost = 10
+
+var (
+	sharedTransport     *http.Transport
+	sharedTransportOnce sync.Once
+)
+
+func newTransport() http.RoundTripper {
+	// All clients share the same transport so that connections are pooled across
+	// them. It's created on first use, by which point MaxIdleConnsPerHost is set.
+	sharedTransportOnce.Do(func() {
+		sharedTransport = newHTTPTransport(MaxIdleConnsPerHost)
+	})
+	var rt http.RoundTripper = &statsTransport{sharedTransport}
+	if DumpResponsesDir != "" {
+		rt = &dumpTransport{rt}
+	}
+
+	return rt
+}
+
+func newHTTPTransport(maxIdleConnsPerHost int) *http.Transport {
+	// Same as http.DefaultTransport apart from the idle connection limits. Since
+	// we use a custom dialer, HTTP/2 has to be explicitly enabled, which is worth
+	// it as image CDNs often support it and it multiplexes requests on a single
+	// connection.
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
@@ -0,0 +1,115 @@
+package plugins
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// Serves pages of the given size and counts the connections opened to it.
+func newPageServer(size int) (*httptest.Server, *int64) {
+	page := bytes.Repeat([]byte{0xff}, size)
+	var conns int64
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(page)
+	}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	srv.Start()
+	return srv, &conns
+}
+
+// Get the pages with the workers splitting them between them, like a download would.
+func getPages(client *http.Client, url string, pages, workers int) error {
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(first int) {
+			defer wg.Done()
+			for n := first; n < pages; n += workers {
+				res, err := client.Get(url)
+				if err != nil {
+					errs <- err
+					return
+				}
+				_, err = io.Copy(ioutil.Discard, res.Body)
+				res.Body.Close()
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return nil
+	}
+}
+
+func TestNewHTTPClientSharesTransport(t *testing.T) {
+	a, b := NewHTTPClient(HTTPTimeout), NewHTTPClient(HTTPTimeout)
+	ta, ok := a.Transport.(*statsTransport)
+	if !ok {
+		t.Fatalf("Expected a *statsTransport, got %T.", a.Transport)
+	}
+	tb := b.Transport.(*statsTransport)
+	if ta.RoundTripper != tb.RoundTripper {
+		t.Error("Clients got different transports, so they can't share connections.")
+	}
+}
+
+func TestSharedTransportReusesConnections(t *testing.T) {
+	srv, conns := newPageServer(1024)
+	defer srv.Close()
+
+	const workers = 4
+	for i := 0; i < 3; i++ {
+		if err := getPages(NewHTTPClient(HTTPTimeout), srv.URL, 20, workers); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt64(conns); n > workers {
+		t.Errorf("Expected at most %d connections across all clients, got %d.", workers, n)
+	}
+}
+
+// A 200-page download with 10 workers through a transport with the default
+// idle connection limit and through the one NewHTTPClient() uses.
+func BenchmarkTransport200Pages(b *testing.B) {
+	const pages, workers = 200, 10
+	bench := func(b *testing.B, client *http.Client) {
+		srv, conns := newPageServer(64 * 1024)
+		defer srv.Close()
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := getPages(client, srv.URL, pages, workers); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(atomic.LoadInt64(conns))/float64(b.N), "conns/op")
+	}
+
+	b.Run("Default", func(b *testing.B) {
+		bench(b, &http.Client{Transport: &http.Transport{}})
+	})
+	b.Run("Tuned", func(b *testing.B) {
+		bench(b, &http.Client{Transport: newHTTPTransport(workers)})
+	})
+}
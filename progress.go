@@ -0,0 +1,207 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "github.com/MinoMino/mindl/plugins"
+
+	"github.com/MinoMino/minprogress"
+)
+
+// Receives updates about a download from the DownloadManager. This keeps
+// the manager itself unaware of how (or if) progress is displayed, so that
+// it can be used without the terminal UI.
+//
+// The methods can be called concurrently by different workers.
+type ProgressObserver interface {
+	// Called when the plugin has been initialized and we start spawning workers.
+	// The total is UnknownTotal if the plugin doesn't know how many files to expect.
+	// The workers are how many will run at the same time at most, which is lower than
+	// the maximum if the plugin doesn't have enough downloaders to keep them all busy.
+	OnStart(total, workers int)
+	// Called whenever a worker receives data from the network.
+	OnProgress(worker, bytes int)
+	// Called when a worker starts receiving data it knows the size of in advance.
+	// If add is set, it's still receiving other sized data at the same time, and
+	// the size is in addition to what it's already expecting.
+	OnFileSize(worker int, size int64, add bool)
+	// Called when a worker is done, regardless of whether or not it succeeded.
+	OnWorkerDone(worker int)
+	// Called when a file has been written to disk.
+	OnFileDone(path string)
+	// Called when an error causes the download to abort.
+	OnError(err error)
+	// Called at the very end of a download, with the error returned if any.
+	OnFinish(paths []string, err error)
+}
+
+// The default ProgressObserver, which keeps track of the progress with
+// a minprogress.ProgressBar that can be displayed through String().
+type ProgressBarObserver struct {
+	// The width of the bar itself and the padding to its left. A zero
+	// width means it's based on the width of the terminal.
+	Width, Padding int
+	progress       *minprogress.ProgressBar
+	last           string
+	// The expected and received number of bytes of the data each worker
+	// is currently receiving, if known.
+	sizes map[int]*[2]int64
+	// What Summary() needs, which the bar keeps to itself.
+	total, done int
+	bytes       int64
+	started     time.Time
+	m           sync.Mutex
+}
+
+func (pb *ProgressBarObserver) OnStart(total, workers int) {
+	var progress *minprogress.ProgressBar
+	if total == UnknownTotal {
+		progress = minprogress.NewProgressBar(minprogress.UnknownTotal)
+	} else {
+		progress = minprogress.NewProgressBar(total)
+	}
+	progress.SpeedUnits = minprogress.DataUnits
+	progress.Unit = "file"
+	progress.Units = "files"
+	progress.ReportsPerSample = 8 * workers
+	if pb.Width > 0 {
+		progress.Width = pb.Width
+	}
+	if pb.Padding > 0 {
+		progress.Padding = pb.Padding
+	}
+
+	pb.m.Lock()
+	pb.progress = progress
+	pb.last = ""
+	pb.sizes = make(map[int]*[2]int64)
+	pb.total, pb.done, pb.bytes = total, 0, 0
+	pb.started = time.Now()
+	pb.m.Unlock()
+}
+
+func (pb *ProgressBarObserver) OnProgress(worker, bytes int) {
+	pb.progress.Report(worker, bytes)
+	pb.m.Lock()
+	pb.bytes += int64(bytes)
+	if size, ok := pb.sizes[worker]; ok {
+		size[1] += int64(bytes)
+	}
+	pb.m.Unlock()
+}
+
+func (pb *ProgressBarObserver) OnFileSize(worker int, size int64, add bool) {
+	pb.m.Lock()
+	if current, ok := pb.sizes[worker]; ok && add {
+		current[0] += size
+	} else {
+		pb.sizes[worker] = &[2]int64{size, 0}
+	}
+	pb.m.Unlock()
+}
+
+func (pb *ProgressBarObserver) OnWorkerDone(worker int) {
+	pb.progress.Done(worker)
+	pb.m.Lock()
+	delete(pb.sizes, worker)
+	pb.m.Unlock()
+}
+
+func (pb *ProgressBarObserver) OnFileDone(path string) {
+	pb.m.Lock()
+	pb.last = path
+	pb.done++
+	pb.m.Unlock()
+	pb.progress.Progress(1)
+}
+
+func (pb *ProgressBarObserver) OnError(err error) {}
+
+func (pb *ProgressBarObserver) OnFinish(paths []string, err error) {}
+
+// The progress bar followed by how far along the files currently being
+// received are if we know their sizes, and the name of the last file we got.
+func (pb *ProgressBarObserver) String() string {
+	pb.m.Lock()
+	defer pb.m.Unlock()
+	if pb.progress == nil {
+		return ""
+	}
+
+	res := pb.progress.String()
+	var expected, received int64
+	for _, size := range pb.sizes {
+		expected += size[0]
+		received += size[1]
+	}
+	if expected > 0 && received < expected {
+		res += fmt.Sprintf(" | Current: %d%%", received*100/expected)
+	}
+	if pb.last != "" {
+		res += " | Last: " + filepath.Base(pb.last)
+	}
+
+	return res
+}
+
+// A compact form of the progress without the bar, for when it's logged in
+// intervals rather than displayed. See formatSummary().
+func (pb *ProgressBarObserver) Summary() string {
+	pb.m.Lock()
+	defer pb.m.Unlock()
+	if pb.progress == nil {
+		return ""
+	}
+
+	// minprogress doesn't expose the speed and ETA it shows, so they're
+	// worked out the same way from what we've been told so far.
+	speed, eta := int64(-1), time.Duration(-1)
+	elapsed := time.Since(pb.started)
+	if secs := elapsed.Seconds(); secs >= 1 {
+		speed = int64(float64(pb.bytes) / secs)
+	}
+	if pb.total != UnknownTotal && pb.done > 0 && pb.done < pb.total {
+		eta = elapsed * time.Duration(pb.total-pb.done) / time.Duration(pb.done)
+	}
+
+	return formatSummary(pb.done, pb.total, speed, eta)
+}
+
+// Format the progress like "45/200 files, 3.2 MiB/s, ETA 1m10s". The total can
+// be UnknownTotal, and the speed in bytes per second and ETA can be negative
+// if unknown, in which case they're left out.
+func formatSummary(done, total int, speed int64, eta time.Duration) string {
+	var res string
+	if total == UnknownTotal {
+		res = fmt.Sprintf("%d files", done)
+	} else {
+		res = fmt.Sprintf("%d/%d files", done, total)
+	}
+	if speed >= 0 {
+		res += fmt.Sprintf(", %s/s", formatBytes(speed))
+	}
+	if eta >= 0 {
+		res += ", ETA " + eta.Round(time.Second).String()
+	}
+
+	return res
+}
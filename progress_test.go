@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/MinoMino/mindl/plugins"
+)
+
+func TestFormatSummary(t *testing.T) {
+	tests := []struct {
+		done, total int
+		speed       int64
+		eta         time.Duration
+		expected    string
+	}{
+		{0, 200, -1, -1, "0/200 files"},
+		{45, 200, 3355443, 70 * time.Second, "45/200 files, 3.2 MiB/s, ETA 1m10s"},
+		{45, 200, 512, 1499 * time.Millisecond, "45/200 files, 512 B/s, ETA 1s"},
+		{199, 200, 1024, 0, "199/200 files, 1.0 KiB/s, ETA 0s"},
+		{200, 200, 2048, -1, "200/200 files, 2.0 KiB/s"},
+		{12, UnknownTotal, 0, -1, "12 files, 0 B/s"},
+		{12, UnknownTotal, -1, -1, "12 files"},
+	}
+
+	for _, test := range tests {
+		res := formatSummary(test.done, test.total, test.speed, test.eta)
+		if res != test.expected {
+			t.Errorf("formatSummary(%d, %d, %d, %s) = %q, expected %q.",
+				test.done, test.total, test.speed, test.eta, res, test.expected)
+		}
+	}
+}
+
+func TestProgressBarObserverFileSize(t *testing.T) {
+	pb := &ProgressBarObserver{Width: 10}
+	pb.OnStart(10, 1)
+	pb.OnFileSize(0, 100, false)
+	pb.OnProgress(0, 50)
+	// Another file received at the same time by the same worker.
+	pb.OnFileSize(0, 100, true)
+	if !strings.Contains(pb.String(), "Current: 25%") {
+		t.Errorf("Expected 25%% of both files, got: %s", pb.String())
+	}
+	// The next file on its own starts over.
+	pb.OnFileSize(0, 200, false)
+	pb.OnProgress(0, 50)
+	if !strings.Contains(pb.String(), "Current: 25%") {
+		t.Errorf("Expected 25%% of the new file, got: %s", pb.String())
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/MinoMino/mindl/plugins"
+)
+
+// How files are numbered when several volumes are downloaded into one directory.
+type SeriesNumbering int
+
+const (
+	// Continue where the previous volume left off, so that the first page
+	// of the second volume of 180 pages becomes 0181.
+	ContinueNumbering SeriesNumbering = iota
+	// Keep the numbering, but prefix the files with the volume, e.g. v02-0001.
+	PrefixVolume
+)
+
+var ErrInvalidSeriesNumbering = errors.New("Invalid series numbering. Should be continue or prefix.")
+
+func ParseSeriesNumbering(s string) (SeriesNumbering, error) {
+	switch strings.ToLower(s) {
+	case "continue":
+		return ContinueNumbering, nil
+	case "prefix":
+		return PrefixVolume, nil
+	}
+
+	return ContinueNumbering, ErrInvalidSeriesNumbering
+}
+
+var reLeadingNumber = regexp.MustCompile(`^(\d+)(.*)$`)
+
+// Renames the files of consecutive downloads so that they all end up in a single
+// directory without colliding. Pages are assumed to be numbered by plugins with
+// a leading number in the file name, as they are with all the current plugins.
+type SeriesNamer struct {
+	Dir       string
+	Numbering SeriesNumbering
+	// The current volume, starting at 1.
+	volume int
+	// What to add to page numbers of the current volume.
+	offset int
+	// The highest page number we've seen in the current volume.
+	highest int
+	m       sync.Mutex
+}
+
+func NewSeriesNamer(dir string, numbering SeriesNumbering) *SeriesNamer {
+	return &SeriesNamer{Dir: plugins.SanitizeFilename(dir), Numbering: numbering, volume: 1}
+}
+
+// Rename a path returned by a plugin, which always has a top-level directory.
+// That directory is replaced by the series directory, and the file renamed
+// according to the numbering.
+func (sn *SeriesNamer) Rename(p string) string {
+	split := strings.SplitN(filepath.ToSlash(p), "/", 2)
+	if len(split) < 2 {
+		return p
+	}
+	dir, file := path.Split(split[1])
+
+	sn.m.Lock()
+	defer sn.m.Unlock()
+	switch {
+	// Covers have no page number to offset, so they'd all end up with the same name.
+	case sn.Numbering == PrefixVolume || plugins.IsCover(file):
+		file = fmt.Sprintf("v%02d-%s", sn.volume, file)
+	default:
+		if m := reLeadingNumber.FindStringSubmatch(file); m != nil {
+			n, err := strconv.Atoi(m[1])
+			if err != nil {
+				break
+			} else if n > sn.highest {
+				sn.highest = n
+			}
+			file = fmt.Sprintf("%0*d%s", len(m[1]), n+sn.offset, m[2])
+		}
+	}
+
+	return filepath.Join(sn.Dir, filepath.FromSlash(dir), file)
+}
+
+// The current volume, starting at 1.
+func (sn *SeriesNamer) Volume() int {
+	sn.m.Lock()
+	defer sn.m.Unlock()
+	return sn.volume
+}
+
+// Move on to the next volume. Should be called after each download,
+// whether or not it succeeded, since it could've saved files anyway.
+func (sn *SeriesNamer) NextVolume() {
+	sn.m.Lock()
+	defer sn.m.Unlock()
+	sn.offset += sn.highest
+	sn.highest = 0
+	sn.volume++
+}
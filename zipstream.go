@@ -0,0 +1,161 @@
+package main
+
+// mindl - A downloader for various sites and services.
+// Copyright (C) 2016  Mino <mino@minomino.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Writes the files of a download straight into one archive per top-level
+// directory, instead of writing them to disk and zipping them afterwards.
+// A zip.Writer can only write one file at a time, so files are added whole
+// and in the order they finish, with a mutex coordinating the workers.
+type ZipStreamer struct {
+	directory string
+	// If set, the modification time of every file in the archives.
+	modified time.Time
+	archives map[string]*streamedArchive
+	order    []string
+	// Set by Discard(), after which nothing can be added.
+	discarded bool
+	m         sync.Mutex
+}
+
+type streamedArchive struct {
+	// Where it's written until it's complete.
+	tmp string
+	f   *os.File
+	w   *zip.Writer
+	// The names of the files added so far.
+	names map[string]bool
+}
+
+func NewZipStreamer(directory string, modified time.Time) *ZipStreamer {
+	return &ZipStreamer{
+		directory: directory,
+		modified:  modified,
+		archives:  make(map[string]*streamedArchive),
+	}
+}
+
+// Add a file to the archive of its top-level directory. The path is
+// relative to the download directory, like the ones plugins give reporters.
+func (zs *ZipStreamer) Add(path string, r io.Reader) error {
+	split := strings.SplitN(filepath.ToSlash(path), "/", 2)
+	if len(split) < 2 {
+		return ErrNoParent
+	}
+	dir, name := split[0], split[1]
+
+	zs.m.Lock()
+	defer zs.m.Unlock()
+	// Workers can still be saving files after a failed download discarded
+	// the archives, which would otherwise leave new ones behind.
+	if zs.discarded {
+		return ErrStreamDiscarded
+	}
+	a, ok := zs.archives[dir]
+	if !ok {
+		tmp := filepath.Join(zs.directory, dir+".zip.tmp")
+		f, err := createFile(tmp)
+		if err != nil {
+			return err
+		}
+		a = &streamedArchive{tmp: tmp, f: f, w: zip.NewWriter(f), names: make(map[string]bool)}
+		zs.archives[dir] = a
+		zs.order = append(zs.order, dir)
+	}
+
+	// Entries can't be replaced, so keep the first one if a page is saved
+	// again, e.g. when it's retried after failing later on.
+	if a.names[name] {
+		log.Debugf("Not adding '%s' to the archive again.", path)
+		return nil
+	}
+	fw, err := a.w.CreateHeader(zipHeader(name, zs.modified))
+	if err != nil {
+		return err
+	}
+	a.names[name] = true
+	_, err = io.Copy(fw, r)
+	return err
+}
+
+// Finish the archives and move each into place with the name given by the
+// function for its top-level directory. Returns the paths of the archives.
+func (zs *ZipStreamer) Close(name func(dir string) string) ([]string, error) {
+	zs.m.Lock()
+	defer zs.m.Unlock()
+	res := make([]string, 0, len(zs.order))
+	for _, dir := range zs.order {
+		a := zs.archives[dir]
+		if err := a.w.Close(); err != nil {
+			return nil, err
+		} else if err := a.f.Close(); err != nil {
+			return nil, err
+		}
+
+		path := uniquePath(filepath.Join(zs.directory, name(dir)), res)
+		log.Infof("Finished streaming files to: %s", filepath.Base(path))
+		if err := os.Rename(a.tmp, path); err != nil {
+			return nil, err
+		}
+		res = append(res, path)
+		delete(zs.archives, dir)
+	}
+	zs.order = nil
+
+	return res, nil
+}
+
+// Delete the archives that haven't been closed, e.g. when the download fails.
+// Adding files afterwards fails with ErrStreamDiscarded.
+func (zs *ZipStreamer) Discard() {
+	zs.m.Lock()
+	defer zs.m.Unlock()
+	zs.discarded = true
+	for dir, a := range zs.archives {
+		a.f.Close()
+		os.Remove(a.tmp)
+		delete(zs.archives, dir)
+	}
+	zs.order = nil
+}
+
+// A file being written by a plugin that's added to the archive when closed,
+// or discarded if aborted.
+type streamedFile struct {
+	bytes.Buffer
+	zs   *ZipStreamer
+	path string
+}
+
+func (sf *streamedFile) Close() error {
+	return sf.zs.Add(sf.path, &sf.Buffer)
+}
+
+func (sf *streamedFile) Abort() error {
+	sf.Reset()
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	. "github.com/MinoMino/mindl/plugins"
+)
+
+// Get the names of the entries in the archive.
+func zipEntries(t testing.TB, path string) []string {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+
+	var res []string
+	for _, f := range zr.File {
+		res = append(res, f.Name)
+	}
+	return res
+}
+
+func TestStreamedFileAbort(t *testing.T) {
+	root, err := ioutil.TempDir("", "mindl-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	zs := NewZipStreamer(root, time.Time{})
+	saved := make(chan string, 10)
+	dr := &DownloadReporter{saved: saved, dstdir: root, stream: zs}
+
+	// A failed write, like an encoder giving up halfway through.
+	w, err := dr.FileWriter(filepath.Join("a", "0001.jpg"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("truncat"))
+	if err := AbortWriter(w); err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 0 {
+		t.Errorf("The aborted file was reported as saved: %s", <-saved)
+	}
+
+	// The retry, which gets the name to itself.
+	for i := 0; i < 2; i++ {
+		w, err = dr.FileWriter(filepath.Join("a", "0001.jpg"), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("complete"))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	archives, err := zs.Close(func(dir string) string { return dir + ".zip" })
+	if err != nil {
+		t.Fatal(err)
+	} else if len(archives) != 1 {
+		t.Fatalf("Expected 1 archive, got %v.", archives)
+	}
+	if entries := zipEntries(t, archives[0]); !reflect.DeepEqual(entries, []string{"0001.jpg"}) {
+		t.Errorf("Expected a single entry for 0001.jpg, got %v.", entries)
+	}
+	zr, _ := zip.OpenReader(archives[0])
+	defer zr.Close()
+	r, _ := zr.File[0].Open()
+	data, _ := ioutil.ReadAll(r)
+	if string(data) != "complete" {
+		t.Errorf("Expected the entry to have the complete file, got %q.", data)
+	}
+}
+
+func TestZipStreamerDiscard(t *testing.T) {
+	root, err := ioutil.TempDir("", "mindl-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	zs := NewZipStreamer(root, time.Time{})
+	if err := zs.Add(filepath.Join("a", "0001.jpg"), bytes.NewReader([]byte("page"))); err != nil {
+		t.Fatal(err)
+	}
+	zs.Discard()
+	// A worker still running after an interrupt.
+	if err := zs.Add(filepath.Join("b", "0001.jpg"), bytes.NewReader([]byte("page"))); err != ErrStreamDiscarded {
+		t.Errorf("Expected ErrStreamDiscarded when adding after discarding, got: %v", err)
+	}
+	if entries, _ := ioutil.ReadDir(root); len(entries) != 0 {
+		t.Errorf("Expected nothing left in the download directory, found %s.", entries[0].Name())
+	}
+}
+
+// Writing 200 pages to disk and zipping them afterwards, and streaming them
+// straight into the archive. Reports the bytes written to disk per download.
+func BenchmarkZipStreamer(b *testing.B) {
+	const pages, size = 200, 256 * 1024
+	// Random, so that it doesn't compress any more than an image would.
+	page := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(page)
+	name := func(n int) string {
+		return filepath.Join("a", string(rune('a'+n/26))+string(rune('a'+n%26))+".jpg")
+	}
+	bench := func(b *testing.B, download func(root string) (written int64)) {
+		var written int64
+		for i := 0; i < b.N; i++ {
+			root, err := ioutil.TempDir("", "mindl-bench-")
+			if err != nil {
+				b.Fatal(err)
+			}
+			written += download(root)
+			os.RemoveAll(root)
+		}
+		b.ReportMetric(float64(written)/float64(b.N), "disk-B/op")
+	}
+	archiveSize := func(path string) int64 {
+		info, err := os.Stat(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return info.Size()
+	}
+
+	b.Run("Disk", func(b *testing.B) {
+		bench(b, func(root string) int64 {
+			var files []string
+			for n := 0; n < pages; n++ {
+				path := filepath.Join(root, name(n))
+				os.MkdirAll(filepath.Dir(path), 0755)
+				if err := ioutil.WriteFile(path, page, 0644); err != nil {
+					b.Fatal(err)
+				}
+				files = append(files, filepath.Base(path))
+			}
+			archive := filepath.Join(root, "a.zip")
+			if err := zipFiles(archive, filepath.Join(root, "a"), files, time.Time{}); err != nil {
+				b.Fatal(err)
+			}
+			return pages*size + archiveSize(archive)
+		})
+	})
+	b.Run("Stream", func(b *testing.B) {
+		bench(b, func(root string) int64 {
+			zs := NewZipStreamer(root, time.Time{})
+			for n := 0; n < pages; n++ {
+				if err := zs.Add(name(n), bytes.NewReader(page)); err != nil {
+					b.Fatal(err)
+				}
+			}
+			archives, err := zs.Close(func(dir string) string { return dir + ".zip" })
+			if err != nil {
+				b.Fatal(err)
+			}
+			return archiveSize(archives[0])
+		})
+	})
+}